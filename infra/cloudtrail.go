@@ -12,11 +12,16 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// feedRebuildSchedule is how often the feed Lambda function checks for a
+// feed that's been left dirty
+const feedRebuildSchedule = "rate(1 hour)"
+
 // CloudTrailDecorator returns the decorator that provisions
 // the infrastructure
 type CloudTrailDecorator struct {
 	stepFunctionResourceName string
 	s3BucketResourceName     string
+	feedLambdaResourceName   string
 	lambdaFuncs              []*sparta.LambdaAWSInfo
 }
 
@@ -92,9 +97,6 @@ func (id *CloudTrailDecorator) DecorateService(context map[string]interface{},
 	trailResourceName := sparta.CloudFormationResourceName("CloudTrail",
 		id.stepFunctionResourceName,
 		id.s3BucketResourceName)
-	eventBridgeResourceName := sparta.CloudFormationResourceName("EventBridge",
-		id.stepFunctionResourceName,
-		id.s3BucketResourceName)
 	iamRoleResourceName := sparta.CloudFormationResourceName("IAMRole",
 		id.stepFunctionResourceName,
 		id.s3BucketResourceName)
@@ -191,52 +193,113 @@ func (id *CloudTrailDecorator) DecorateService(context map[string]interface{},
 	}
 	template.AddResource(iamRoleResourceName, iamRoleResource)
 
-	// Create the EventBridgeRule
+	// Create the EventBridge rules that map events in the target bucket
+	// to running the Step function. Deletes don't include the key when
+	// several objects are deleted at once, so they have their own pattern.
 	additionalParams := map[string]interface{}{
 		"S3BucketResourceName": id.s3BucketResourceName,
 	}
-	eventData, eventDataErr := os.Open("./infra/eventpattern_put.json")
-	if eventDataErr != nil {
-		return eventDataErr
+	eventPatterns := []struct {
+		resourcePrefix string
+		patternPath    string
+	}{
+		{"EventBridge", "./infra/eventpattern_put.json"},
+		{"EventBridgeDelete", "./infra/eventpattern_delete.json"},
 	}
-	jsonData, jsonDataErr := spartaCF.ConvertToInlineJSONTemplateExpression(eventData, additionalParams)
-	if jsonDataErr != nil {
-		return jsonDataErr
+	for _, eachPattern := range eventPatterns {
+		eventBridgeResourceName := sparta.CloudFormationResourceName(eachPattern.resourcePrefix,
+			id.stepFunctionResourceName,
+			id.s3BucketResourceName)
+		eventData, eventDataErr := os.Open(eachPattern.patternPath)
+		if eventDataErr != nil {
+			return eventDataErr
+		}
+		jsonData, jsonDataErr := spartaCF.ConvertToInlineJSONTemplateExpression(eventData, additionalParams)
+		eventData.Close()
+		if jsonDataErr != nil {
+			return jsonDataErr
+		}
+		eventBridgeResource := &gocf.EventsRule{
+			Description: gocf.String(fmt.Sprintf("Rule to trigger %s from an S3 event in %s",
+				id.stepFunctionResourceName,
+				id.s3BucketResourceName)),
+			EventPattern: jsonData,
+			Targets: &gocf.EventsRuleTargetList{
+				gocf.EventsRuleTarget{
+					Arn:     gocf.Ref(id.stepFunctionResourceName).String(),
+					ID:      gocf.String("SpartaCast"),
+					RoleArn: gocf.GetAtt(iamRoleResourceName, "Arn").String(),
+				},
+			},
+		}
+		cfResource = template.AddResource(eventBridgeResourceName,
+			eventBridgeResource)
+		cfResource.DependsOn = []string{id.stepFunctionResourceName,
+			iamRoleResourceName,
+			trailResourceName}
 	}
 
-	// Now create the EventBridge rule that maps events in the target bucket
-	// to running the Step function
-	eventBridgeResource := &gocf.EventsRule{
-		Description: gocf.String(fmt.Sprintf("Rule to trigger %s from an S3 event in %s",
-			id.stepFunctionResourceName,
-			id.s3BucketResourceName)),
-		EventPattern: jsonData,
+	// Finished episodes rebuild the feed after a quiet period. If the
+	// execution holding the latest generation fails before it rebuilds the
+	// feed, no other execution will, so the schedule rebuilds a feed that's
+	// been left dirty. It invokes the feed Lambda function directly rather
+	// than starting the Step function, which returns right away if the feed
+	// is clean.
+	scheduleResourceName := sparta.CloudFormationResourceName("EventBridgeSchedule",
+		id.feedLambdaResourceName,
+		id.s3BucketResourceName)
+	schedulePermissionResourceName := sparta.CloudFormationResourceName("EventBridgeSchedulePermission",
+		id.feedLambdaResourceName,
+		id.s3BucketResourceName)
+	scheduleData, scheduleDataErr := os.Open("./infra/event_rebuildfeed.json")
+	if scheduleDataErr != nil {
+		return scheduleDataErr
+	}
+	defer scheduleData.Close()
+	scheduleInput, scheduleInputErr := spartaCF.ConvertToInlineJSONTemplateExpression(scheduleData, additionalParams)
+	if scheduleInputErr != nil {
+		return scheduleInputErr
+	}
+	scheduleResource := &gocf.EventsRule{
+		Description: gocf.String(fmt.Sprintf("Rule to rebuild a dirty feed in %s with %s",
+			id.s3BucketResourceName,
+			id.feedLambdaResourceName)),
+		ScheduleExpression: gocf.String(feedRebuildSchedule),
 		Targets: &gocf.EventsRuleTargetList{
 			gocf.EventsRuleTarget{
-				Arn:     gocf.Ref(id.stepFunctionResourceName).String(),
-				ID:      gocf.String("SpartaCast"),
-				RoleArn: gocf.GetAtt(iamRoleResourceName, "Arn").String(),
+				Arn:   gocf.GetAtt(id.feedLambdaResourceName, "Arn").String(),
+				ID:    gocf.String("SpartaCastRebuildFeed"),
+				Input: scheduleInput,
 			},
 		},
 	}
-	cfResource = template.AddResource(eventBridgeResourceName,
-		eventBridgeResource)
-	cfResource.DependsOn = []string{id.stepFunctionResourceName,
-		iamRoleResourceName,
-		trailResourceName}
+	cfResource = template.AddResource(scheduleResourceName, scheduleResource)
+	cfResource.DependsOn = []string{id.feedLambdaResourceName}
+
+	schedulePermission := &gocf.LambdaPermission{
+		Action:       gocf.String("lambda:InvokeFunction"),
+		FunctionName: gocf.GetAtt(id.feedLambdaResourceName, "Arn").String(),
+		Principal:    gocf.String("events.amazonaws.com"),
+		SourceArn:    gocf.GetAtt(scheduleResourceName, "Arn").String(),
+	}
+	cfResource = template.AddResource(schedulePermissionResourceName, schedulePermission)
+	cfResource.DependsOn = []string{scheduleResourceName}
 	return nil
 
 }
 
 // NewCloudTrailDecorator returns an instance of the CloudTrailDecorator
-// instance
+// instance. The feed Lambda function is the target of the scheduled feed
+// rebuild.
 func NewCloudTrailDecorator(lambdaFuncs []*sparta.LambdaAWSInfo,
 	stepFunctionResourceName string,
-	s3BucketResourceName string) (*CloudTrailDecorator, error) {
+	s3BucketResourceName string,
+	feedLambdaResourceName string) (*CloudTrailDecorator, error) {
 
 	return &CloudTrailDecorator{
 		lambdaFuncs:              lambdaFuncs,
 		stepFunctionResourceName: stepFunctionResourceName,
 		s3BucketResourceName:     s3BucketResourceName,
+		feedLambdaResourceName:   feedLambdaResourceName,
 	}, nil
 }
@@ -0,0 +1,286 @@
+package lambda
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Blob storage
+////////////////////////////////////////////////////////////////////////////////
+
+// ErrBlobNotFound is returned, wrapped with the key, when a blob doesn't
+// exist
+var ErrBlobNotFound = errors.New("Blob not found")
+
+// ErrBlobChanged is returned, wrapped with the key, when a conditional put
+// finds that the blob changed since it was read
+var ErrBlobChanged = errors.New("Blob changed")
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	Metadata     map[string]string
+}
+
+// BlobStore is the storage for the source files, manifests, audio and feed
+// of a podcast. Keys are slash separated paths, like S3 keys.
+type BlobStore interface {
+	// Get returns the content of the blob
+	Get(key string) ([]byte, *BlobInfo, error)
+	// Put creates or replaces the blob
+	Put(key string, body []byte, contentType string) (*BlobInfo, error)
+	// PutIfMatch is a Put that only replaces the blob if its ETag is etag,
+	// or only creates it if etag is empty. Otherwise it returns
+	// ErrBlobChanged.
+	PutIfMatch(key string, body []byte, contentType string, etag string) (*BlobInfo, error)
+	// Head returns the blob's info without its content
+	Head(key string) (*BlobInfo, error)
+	// Copy copies the source blob, which may be the destination, and sets
+	// the copy's content type
+	Copy(sourceKey string, destKey string, contentType string) error
+	// Delete deletes the blob. Deleting a blob that doesn't exist isn't
+	// an error.
+	Delete(key string) error
+	// List returns the blobs whose keys start with prefix, in key order
+	List(prefix string) ([]*BlobInfo, error)
+	// URL returns the URL of the blob
+	URL(key string) string
+	// KeyFromURL returns the key of the blob at the URL, such as a
+	// synthesis task's OutputUri
+	KeyFromURL(blobURL string) (string, error)
+}
+
+// blobStoreConstructor returns the BlobStore for a bucket that a handler
+// uses
+type blobStoreConstructor func(awsSession *session.Session, bucket string) BlobStore
+
+// s3BlobStore is a BlobStore backed by an S3 bucket
+type s3BlobStore struct {
+	s3Svc  *s3.S3
+	bucket string
+	region string
+}
+
+// NewS3BlobStore returns a BlobStore backed by the S3 bucket
+func NewS3BlobStore(awsSession *session.Session, bucket string) BlobStore {
+	return &s3BlobStore{
+		s3Svc:  s3.New(awsSession),
+		bucket: bucket,
+		region: aws.StringValue(awsSession.Config.Region),
+	}
+}
+
+// s3Error returns err, or ErrBlobNotFound if it's S3's error for a missing
+// key
+func s3Error(key string, err error) error {
+	if awsErr, isAWSErr := err.(awserr.Error); isAWSErr {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return fmt.Errorf("%s: %w", key, ErrBlobNotFound)
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return fmt.Errorf("%s: %w", key, ErrBlobChanged)
+		}
+	}
+	return err
+}
+
+func s3Metadata(metadata map[string]*string) map[string]string {
+	blobMetadata := make(map[string]string)
+	for eachKey, eachValue := range metadata {
+		blobMetadata[eachKey] = aws.StringValue(eachValue)
+	}
+	return blobMetadata
+}
+
+func (sbs *s3BlobStore) Get(key string) ([]byte, *BlobInfo, error) {
+	s3GetObjectResp, s3GetObjectRespErr := sbs.s3Svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(sbs.bucket),
+		Key:    aws.String(key),
+	})
+	if s3GetObjectRespErr != nil {
+		return nil, nil, s3Error(key, s3GetObjectRespErr)
+	}
+	defer s3GetObjectResp.Body.Close()
+	allBytes, allBytesErr := ioutil.ReadAll(s3GetObjectResp.Body)
+	if allBytesErr != nil {
+		return nil, nil, allBytesErr
+	}
+	return allBytes, &BlobInfo{
+		Key:          key,
+		Size:         int64(len(allBytes)),
+		ContentType:  aws.StringValue(s3GetObjectResp.ContentType),
+		ETag:         aws.StringValue(s3GetObjectResp.ETag),
+		LastModified: aws.TimeValue(s3GetObjectResp.LastModified),
+		Metadata:     s3Metadata(s3GetObjectResp.Metadata),
+	}, nil
+}
+
+func (sbs *s3BlobStore) Put(key string, body []byte, contentType string) (*BlobInfo, error) {
+	return sbs.put(&s3.PutObjectInput{
+		Bucket: aws.String(sbs.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	}, body, contentType)
+}
+
+func (sbs *s3BlobStore) PutIfMatch(key string, body []byte, contentType string, etag string) (*BlobInfo, error) {
+	// S3 conditional writes fail with PreconditionFailed, or
+	// ConditionalRequestConflict if a concurrent write is in flight. The
+	// SDK's PutObjectInput doesn't have the conditional headers, so they're
+	// set on the request, which signs them along with the rest.
+	conditionHeaders := map[string]string{"If-None-Match": "*"}
+	if etag != "" {
+		conditionHeaders = map[string]string{"If-Match": etag}
+	}
+	putInfo, putErr := sbs.put(&s3.PutObjectInput{
+		Bucket: aws.String(sbs.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	}, body, contentType, request.WithSetRequestHeaders(conditionHeaders))
+	// If-Match fails with NoSuchKey once the blob is deleted, which is
+	// also a change since it was read
+	if etag != "" && errors.Is(putErr, ErrBlobNotFound) {
+		return nil, fmt.Errorf("%s: %w", key, ErrBlobChanged)
+	}
+	return putInfo, putErr
+}
+
+func (sbs *s3BlobStore) put(s3PutObjectInput *s3.PutObjectInput,
+	body []byte,
+	contentType string,
+	options ...request.Option) (*BlobInfo, error) {
+	key := aws.StringValue(s3PutObjectInput.Key)
+	if contentType != "" {
+		s3PutObjectInput.ContentType = aws.String(contentType)
+	}
+	s3PutObjectResp, s3PutObjectRespErr := sbs.s3Svc.PutObjectWithContext(aws.BackgroundContext(),
+		s3PutObjectInput,
+		options...)
+	if s3PutObjectRespErr != nil {
+		return nil, s3Error(key, s3PutObjectRespErr)
+	}
+	return &BlobInfo{
+		Key:         key,
+		Size:        int64(len(body)),
+		ContentType: contentType,
+		ETag:        aws.StringValue(s3PutObjectResp.ETag),
+	}, nil
+}
+
+func (sbs *s3BlobStore) Head(key string) (*BlobInfo, error) {
+	s3HeadObjectResp, s3HeadObjectRespErr := sbs.s3Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(sbs.bucket),
+		Key:    aws.String(key),
+	})
+	if s3HeadObjectRespErr != nil {
+		return nil, s3Error(key, s3HeadObjectRespErr)
+	}
+	return &BlobInfo{
+		Key:          key,
+		Size:         aws.Int64Value(s3HeadObjectResp.ContentLength),
+		ContentType:  aws.StringValue(s3HeadObjectResp.ContentType),
+		ETag:         aws.StringValue(s3HeadObjectResp.ETag),
+		LastModified: aws.TimeValue(s3HeadObjectResp.LastModified),
+		Metadata:     s3Metadata(s3HeadObjectResp.Metadata),
+	}, nil
+}
+
+func (sbs *s3BlobStore) Copy(sourceKey string, destKey string, contentType string) error {
+	// Replacing the content type replaces all the metadata, so carry the
+	// existing metadata over
+	s3HeadObjectResp, s3HeadObjectRespErr := sbs.s3Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(sbs.bucket),
+		Key:    aws.String(sourceKey),
+	})
+	if s3HeadObjectRespErr != nil {
+		return s3Error(sourceKey, s3HeadObjectRespErr)
+	}
+	if s3HeadObjectResp.Metadata == nil {
+		s3HeadObjectResp.Metadata = make(map[string]*string)
+	}
+	_, s3CopyObjectRespErr := sbs.s3Svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(sbs.bucket),
+		CopySource:        aws.String(fmt.Sprintf("%s/%s", sbs.bucket, sourceKey)),
+		Key:               aws.String(destKey),
+		ContentType:       aws.String(contentType),
+		Metadata:          s3HeadObjectResp.Metadata,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	})
+	return s3CopyObjectRespErr
+}
+
+func (sbs *s3BlobStore) Delete(key string) error {
+	_, s3DeleteObjectRespErr := sbs.s3Svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(sbs.bucket),
+		Key:    aws.String(key),
+	})
+	return s3DeleteObjectRespErr
+}
+
+func (sbs *s3BlobStore) List(prefix string) ([]*BlobInfo, error) {
+	blobs := []*BlobInfo{}
+	listObjectsInput := &s3.ListObjectsInput{
+		Bucket: aws.String(sbs.bucket),
+		Prefix: aws.String(prefix),
+	}
+	for {
+		listObjectsResp, listObjectsRespErr := sbs.s3Svc.ListObjects(listObjectsInput)
+		if listObjectsRespErr != nil {
+			return nil, listObjectsRespErr
+		}
+		for _, eachObject := range listObjectsResp.Contents {
+			blobs = append(blobs, &BlobInfo{
+				Key:          aws.StringValue(eachObject.Key),
+				Size:         aws.Int64Value(eachObject.Size),
+				ETag:         aws.StringValue(eachObject.ETag),
+				LastModified: aws.TimeValue(eachObject.LastModified),
+			})
+		}
+		if !aws.BoolValue(listObjectsResp.IsTruncated) || len(blobs) == 0 {
+			break
+		}
+		// Without a delimiter NextMarker isn't set, so continue from
+		// the last key
+		listObjectsInput.Marker = aws.String(blobs[len(blobs)-1].Key)
+	}
+	return blobs, nil
+}
+
+func (sbs *s3BlobStore) URL(key string) string {
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s",
+		sbs.bucket,
+		sbs.region,
+		key)
+}
+
+func (sbs *s3BlobStore) KeyFromURL(blobURL string) (string, error) {
+	parsedURL, parsedURLErr := url.Parse(blobURL)
+	if parsedURLErr != nil {
+		return "", parsedURLErr
+	}
+	// Either virtual hosted or path style
+	if strings.HasPrefix(parsedURL.Host, sbs.bucket+".") {
+		return strings.TrimPrefix(parsedURL.Path, "/"), nil
+	}
+	bucketPrefix := fmt.Sprintf("/%s/", sbs.bucket)
+	if !strings.HasPrefix(parsedURL.Path, bucketPrefix) {
+		return "", fmt.Errorf("URL %s isn't in bucket %s", blobURL, sbs.bucket)
+	}
+	return strings.TrimPrefix(parsedURL.Path, bucketPrefix), nil
+}
@@ -0,0 +1,233 @@
+package lambda
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Local blob storage
+////////////////////////////////////////////////////////////////////////////////
+
+// localContentTypes are the content types of the files SpartaCast writes,
+// which aren't all in the system's MIME types
+var localContentTypes = map[string]string{
+	".mp3":  ContentTypeMP3,
+	".md":   "text/markdown",
+	".json": "application/json",
+	".xml":  "application/rss+xml",
+}
+
+// localBlobStore is a BlobStore backed by a directory, where each key is a
+// file. Content types aren't stored, they're derived from the key's
+// extension.
+type localBlobStore struct {
+	root string
+}
+
+// NewLocalBlobStore returns a BlobStore backed by the directory at root
+func NewLocalBlobStore(root string) (BlobStore, error) {
+	absRoot, absRootErr := filepath.Abs(root)
+	if absRootErr != nil {
+		return nil, absRootErr
+	}
+	// Walking doesn't follow a symlinked root
+	resolvedRoot, resolvedRootErr := filepath.EvalSymlinks(absRoot)
+	if resolvedRootErr == nil {
+		absRoot = resolvedRoot
+	}
+	return &localBlobStore{
+		root: absRoot,
+	}, nil
+}
+
+func (lbs *localBlobStore) path(key string) (string, error) {
+	cleanKey := path.Clean("/" + key)
+	if cleanKey == "/" || cleanKey != "/"+key {
+		return "", fmt.Errorf("Invalid key: %s", key)
+	}
+	return filepath.Join(lbs.root, filepath.FromSlash(cleanKey)), nil
+}
+
+func (lbs *localBlobStore) info(key string, fileInfo os.FileInfo, body []byte) *BlobInfo {
+	contentType, contentTypeExists := localContentTypes[path.Ext(key)]
+	if !contentTypeExists {
+		contentType = mime.TypeByExtension(path.Ext(key))
+	}
+	blobInfo := &BlobInfo{
+		Key:          key,
+		Size:         fileInfo.Size(),
+		ContentType:  contentType,
+		LastModified: fileInfo.ModTime(),
+		Metadata:     make(map[string]string),
+	}
+	if body != nil {
+		bodyHash := md5.Sum(body)
+		blobInfo.ETag = `"` + hex.EncodeToString(bodyHash[:]) + `"`
+	}
+	return blobInfo
+}
+
+func (lbs *localBlobStore) Get(key string) ([]byte, *BlobInfo, error) {
+	blobPath, blobPathErr := lbs.path(key)
+	if blobPathErr != nil {
+		return nil, nil, blobPathErr
+	}
+	body, bodyErr := ioutil.ReadFile(blobPath)
+	if os.IsNotExist(bodyErr) {
+		return nil, nil, fmt.Errorf("%s: %w", key, ErrBlobNotFound)
+	}
+	if bodyErr != nil {
+		return nil, nil, bodyErr
+	}
+	fileInfo, fileInfoErr := os.Stat(blobPath)
+	if fileInfoErr != nil {
+		return nil, nil, fileInfoErr
+	}
+	return body, lbs.info(key, fileInfo, body), nil
+}
+
+func (lbs *localBlobStore) Put(key string, body []byte, contentType string) (*BlobInfo, error) {
+	blobPath, blobPathErr := lbs.path(key)
+	if blobPathErr != nil {
+		return nil, blobPathErr
+	}
+	mkdirErr := os.MkdirAll(filepath.Dir(blobPath), 0755)
+	if mkdirErr != nil {
+		return nil, mkdirErr
+	}
+	// Write and rename, so that readers never see a partial blob
+	tempFile, tempFileErr := ioutil.TempFile(filepath.Dir(blobPath), ".blob-")
+	if tempFileErr != nil {
+		return nil, tempFileErr
+	}
+	_, writeErr := tempFile.Write(body)
+	closeErr := tempFile.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(tempFile.Name(), blobPath)
+	}
+	if writeErr != nil {
+		os.Remove(tempFile.Name())
+		return nil, writeErr
+	}
+	fileInfo, fileInfoErr := os.Stat(blobPath)
+	if fileInfoErr != nil {
+		return nil, fileInfoErr
+	}
+	return lbs.info(key, fileInfo, body), nil
+}
+
+// localConditionalPutMutex serializes conditional puts. It only protects
+// against other conditional puts in this process.
+var localConditionalPutMutex sync.Mutex
+
+func (lbs *localBlobStore) PutIfMatch(key string, body []byte, contentType string, etag string) (*BlobInfo, error) {
+	localConditionalPutMutex.Lock()
+	defer localConditionalPutMutex.Unlock()
+
+	currentETag := ""
+	blobInfo, blobInfoErr := lbs.Head(key)
+	if blobInfoErr == nil {
+		currentETag = blobInfo.ETag
+	} else if !errors.Is(blobInfoErr, ErrBlobNotFound) {
+		return nil, blobInfoErr
+	}
+	if currentETag != etag {
+		return nil, fmt.Errorf("%s: %w", key, ErrBlobChanged)
+	}
+	return lbs.Put(key, body, contentType)
+}
+
+func (lbs *localBlobStore) Head(key string) (*BlobInfo, error) {
+	_, blobInfo, blobInfoErr := lbs.Get(key)
+	return blobInfo, blobInfoErr
+}
+
+func (lbs *localBlobStore) Copy(sourceKey string, destKey string, contentType string) error {
+	if sourceKey == destKey {
+		// Content types are derived from the key, so there's
+		// nothing to do
+		_, headErr := lbs.Head(sourceKey)
+		return headErr
+	}
+	body, _, bodyErr := lbs.Get(sourceKey)
+	if bodyErr != nil {
+		return bodyErr
+	}
+	_, putErr := lbs.Put(destKey, body, contentType)
+	return putErr
+}
+
+func (lbs *localBlobStore) Delete(key string) error {
+	blobPath, blobPathErr := lbs.path(key)
+	if blobPathErr != nil {
+		return blobPathErr
+	}
+	removeErr := os.Remove(blobPath)
+	if os.IsNotExist(removeErr) {
+		return nil
+	}
+	return removeErr
+}
+
+func (lbs *localBlobStore) List(prefix string) ([]*BlobInfo, error) {
+	blobs := []*BlobInfo{}
+	walkErr := filepath.Walk(lbs.root, func(walkPath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.IsDir() || strings.HasPrefix(fileInfo.Name(), ".blob-") {
+			return nil
+		}
+		relPath, relPathErr := filepath.Rel(lbs.root, walkPath)
+		if relPathErr != nil {
+			return relPathErr
+		}
+		key := filepath.ToSlash(relPath)
+		if strings.HasPrefix(key, prefix) {
+			blobs = append(blobs, lbs.info(key, fileInfo, nil))
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	sort.Slice(blobs, func(lhs int, rhs int) bool {
+		return blobs[lhs].Key < blobs[rhs].Key
+	})
+	return blobs, nil
+}
+
+func (lbs *localBlobStore) URL(key string) string {
+	blobURL := &url.URL{
+		Scheme: "file",
+		Path:   filepath.ToSlash(filepath.Join(lbs.root, filepath.FromSlash(key))),
+	}
+	return blobURL.String()
+}
+
+func (lbs *localBlobStore) KeyFromURL(blobURL string) (string, error) {
+	parsedURL, parsedURLErr := url.Parse(blobURL)
+	if parsedURLErr != nil {
+		return "", parsedURLErr
+	}
+	rootPrefix := filepath.ToSlash(lbs.root) + "/"
+	if parsedURL.Scheme != "file" || !strings.HasPrefix(parsedURL.Path, rootPrefix) {
+		return "", fmt.Errorf("URL %s isn't in directory %s", blobURL, lbs.root)
+	}
+	return strings.TrimPrefix(parsedURL.Path, rootPrefix), nil
+}
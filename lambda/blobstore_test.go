@@ -0,0 +1,240 @@
+package lambda
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+)
+
+func testLocalBlobStore(t *testing.T) (BlobStore, func()) {
+	root, rootErr := ioutil.TempDir("", "spartacast")
+	if rootErr != nil {
+		t.Fatalf("Failed to create blob store directory: %s", rootErr)
+	}
+	blobStore, blobStoreErr := NewLocalBlobStore(root)
+	if blobStoreErr != nil {
+		t.Fatalf("Failed to create blob store: %s", blobStoreErr)
+	}
+	return blobStore, func() {
+		os.RemoveAll(root)
+	}
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	blobStore, cleanup := testLocalBlobStore(t)
+	defer cleanup()
+
+	putInfo, putInfoErr := blobStore.Put("public/feed/episode1.mp3", []byte("audio"), ContentTypeMP3)
+	if putInfoErr != nil {
+		t.Fatalf("Failed to put blob: %s", putInfoErr)
+	}
+	body, getInfo, getErr := blobStore.Get("public/feed/episode1.mp3")
+	if getErr != nil {
+		t.Fatalf("Failed to get blob: %s", getErr)
+	}
+	if string(body) != "audio" ||
+		getInfo.Size != 5 ||
+		getInfo.ContentType != ContentTypeMP3 ||
+		getInfo.ETag != putInfo.ETag {
+		t.Fatalf("Unexpected blob: %q, %+v", body, getInfo)
+	}
+
+	copyErr := blobStore.Copy("public/feed/episode1.mp3", "public/feed/copy.mp3", ContentTypeMP3)
+	if copyErr != nil {
+		t.Fatalf("Failed to copy blob: %s", copyErr)
+	}
+	blobStore.Put("public/metadata/episode1.md.json", []byte("{}"), "application/json")
+	blobs, blobsErr := blobStore.List("public/feed/")
+	if blobsErr != nil {
+		t.Fatalf("Failed to list blobs: %s", blobsErr)
+	}
+	if len(blobs) != 2 ||
+		blobs[0].Key != "public/feed/copy.mp3" ||
+		blobs[1].Key != "public/feed/episode1.mp3" {
+		t.Fatalf("Unexpected blobs: %+v", blobs)
+	}
+
+	blobURL := blobStore.URL("public/feed/episode1.mp3")
+	if !strings.HasPrefix(blobURL, "file://") {
+		t.Fatalf("Unexpected URL: %s", blobURL)
+	}
+	key, keyErr := blobStore.KeyFromURL(blobURL)
+	if keyErr != nil || key != "public/feed/episode1.mp3" {
+		t.Fatalf("Unexpected key for URL %s: %s, %v", blobURL, key, keyErr)
+	}
+
+	deleteErr := blobStore.Delete("public/feed/episode1.mp3")
+	if deleteErr != nil {
+		t.Fatalf("Failed to delete blob: %s", deleteErr)
+	}
+	_, headErr := blobStore.Head("public/feed/episode1.mp3")
+	if !errors.Is(headErr, ErrBlobNotFound) {
+		t.Fatalf("Expected ErrBlobNotFound, got: %v", headErr)
+	}
+	if blobStore.Delete("public/feed/episode1.mp3") != nil {
+		t.Fatalf("Deleting a missing blob should succeed")
+	}
+	_, invalidErr := blobStore.Put("../outside.txt", []byte("nope"), "")
+	if invalidErr == nil {
+		t.Fatalf("Expected an error for a key outside the store")
+	}
+}
+
+func TestS3BlobStoreKeyFromURL(t *testing.T) {
+	blobStore := &s3BlobStore{
+		bucket: "my-bucket",
+		region: "us-west-2",
+	}
+	testURLs := []string{
+		"https://s3.us-west-2.amazonaws.com/my-bucket/public/feed/episode1.mp3",
+		"https://my-bucket.s3.us-west-2.amazonaws.com/public/feed/episode1.mp3",
+		blobStore.URL("public/feed/episode1.mp3"),
+	}
+	for _, eachURL := range testURLs {
+		key, keyErr := blobStore.KeyFromURL(eachURL)
+		if keyErr != nil || key != "public/feed/episode1.mp3" {
+			t.Fatalf("Unexpected key for URL %s: %s, %v", eachURL, key, keyErr)
+		}
+	}
+	_, keyErr := blobStore.KeyFromURL("https://s3.us-west-2.amazonaws.com/other-bucket/episode1.mp3")
+	if keyErr == nil {
+		t.Fatalf("Expected an error for a URL in another bucket")
+	}
+}
+
+func TestLocalFeedPipeline(t *testing.T) {
+	blobStore, cleanup := testLocalBlobStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	feedBytes, feedBytesErr := ioutil.ReadFile(testFile("feed.md"))
+	if feedBytesErr != nil {
+		t.Fatalf("Failed to read feed: %s", feedBytesErr)
+	}
+	blobStore.Put(FeedConfigName, feedBytes, "")
+	manifest := &SpartaCastTask{
+		Key: "episode1.md",
+		Item: &Item{
+			Title:   "Episode 1",
+			PubDate: "2020-01-02T03:04:05Z",
+		},
+	}
+	manifestBytes, _ := json.Marshal(manifest)
+	blobStore.Put(manifestKeyPath("episode1.md"), manifestBytes, "application/json")
+
+	metadata, metadataErr := readFeedMetadata(blobStore, logger)
+	if metadataErr != nil {
+		t.Fatalf("Failed to read feed metadata: %s", metadataErr)
+	}
+	if metadata.feed == nil || len(metadata.entries) != 1 {
+		t.Fatalf("Unexpected feed metadata: %+v", metadata)
+	}
+	if !strings.HasPrefix(metadata.entries[0].SelfLink, "file://") {
+		t.Fatalf("Unexpected self link: %s", metadata.entries[0].SelfLink)
+	}
+	createErr := createFeed(blobStore, metadata, time.Now(), logger)
+	if createErr != nil {
+		t.Fatalf("Failed to create feed: %s", createErr)
+	}
+	_, feedInfoErr := blobStore.Head("public/feed/feed.xml")
+	if feedInfoErr != nil {
+		t.Fatalf("Failed to find feed.xml: %s", feedInfoErr)
+	}
+}
+
+// testS3Server is an S3 endpoint that implements conditional PutObject
+// requests the way S3 does
+func testS3Server(t *testing.T) (*httptest.Server, *[]*http.Request) {
+	var mutex sync.Mutex
+	etags := make(map[string]string)
+	requests := []*http.Request{}
+	writeError := func(w http.ResponseWriter, status int, code string) {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests = append(requests, r)
+		if r.Method != http.MethodPut {
+			writeError(w, http.StatusNotImplemented, "NotImplemented")
+			return
+		}
+		etag, exists := etags[r.URL.Path]
+		switch {
+		case r.Header.Get("If-None-Match") == "*" && exists:
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		case r.Header.Get("If-Match") != "" && !exists:
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		case r.Header.Get("If-Match") != "" && r.Header.Get("If-Match") != etag:
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		etags[r.URL.Path] = fmt.Sprintf(`"%d"`, len(requests))
+		w.Header().Set("ETag", etags[r.URL.Path])
+	}))
+	return server, &requests
+}
+
+func TestS3BlobStorePutIfMatch(t *testing.T) {
+	server, requests := testS3Server(t)
+	defer server.Close()
+	awsSession, awsSessionErr := session.NewSession(&aws.Config{
+		Region:           aws.String("us-west-2"),
+		Endpoint:         aws.String(server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})
+	if awsSessionErr != nil {
+		t.Fatalf("Failed to create session: %s", awsSessionErr)
+	}
+	blobStore := NewS3BlobStore(awsSession, "spartacast-eventbucket")
+	key := eventRecordKeyPath("episode1.md")
+
+	// An empty etag only creates the blob...
+	created, createdErr := blobStore.PutIfMatch(key, []byte("{}"), "application/json", "")
+	if createdErr != nil {
+		t.Fatalf("Failed to create blob: %s", createdErr)
+	}
+	_, createdErr = blobStore.PutIfMatch(key, []byte("{}"), "application/json", "")
+	if !errors.Is(createdErr, ErrBlobChanged) {
+		t.Fatalf("Expected a second create to fail with ErrBlobChanged, got: %v", createdErr)
+	}
+	// ...and an etag only replaces that version
+	_, replacedErr := blobStore.PutIfMatch(key, []byte("{}"), "application/json", created.ETag)
+	if replacedErr != nil {
+		t.Fatalf("Failed to replace blob: %s", replacedErr)
+	}
+	_, replacedErr = blobStore.PutIfMatch(key, []byte("{}"), "application/json", created.ETag)
+	if !errors.Is(replacedErr, ErrBlobChanged) {
+		t.Fatalf("Expected a stale replace to fail with ErrBlobChanged, got: %v", replacedErr)
+	}
+	_, replacedErr = blobStore.PutIfMatch(eventRecordKeyPath("episode2.md"), []byte("{}"), "application/json", created.ETag)
+	if !errors.Is(replacedErr, ErrBlobChanged) {
+		t.Fatalf("Expected replacing a deleted blob to fail with ErrBlobChanged, got: %v", replacedErr)
+	}
+
+	// The conditions are signed headers, which S3 requires
+	for _, eachRequest := range *requests {
+		signedHeaders := eachRequest.Header.Get("Authorization")
+		if !strings.Contains(signedHeaders, "if-match") &&
+			!strings.Contains(signedHeaders, "if-none-match") {
+			t.Fatalf("Expected a signed condition header: %s", signedHeaders)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package lambda
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Chunked synthesis
+////////////////////////////////////////////////////////////////////////////////
+
+// pollyMaxBilledCharacters is the maximum number of billed characters in a
+// single StartSpeechSynthesisTask request. SSML tags aren't billed.
+const pollyMaxBilledCharacters = 100000
+
+// pollyMaxTotalCharacters is the maximum number of characters in a single
+// StartSpeechSynthesisTask request, including the SSML tags
+const pollyMaxTotalCharacters = 200000
+
+// ssmlSplittableTags are the tags that can be closed at a chunk boundary
+// and reopened in the next chunk without changing how the text is read.
+// Tags like <say-as> and <sub> must stay whole.
+var ssmlSplittableTags = map[string]bool{
+	"p":                   true,
+	"s":                   true,
+	"prosody":             true,
+	"emphasis":            true,
+	"lang":                true,
+	"amazon:domain":       true,
+	"amazon:effect":       true,
+	"amazon:auto-breaths": true,
+}
+
+// sentenceSplitIndex returns the byte index just past the last sentence
+// boundary in text that leaves at most maxRunes runes before it. If there's
+// no sentence boundary, it falls back to the last whitespace and reports
+// that the index isn't at a sentence boundary. It returns 0 if text can't
+// be split within maxRunes.
+func sentenceSplitIndex(text string, maxRunes int) (int, bool) {
+	sentenceIndex := 0
+	spaceIndex := 0
+	runeCount := 0
+	prevRune := rune(0)
+	for byteIndex, eachRune := range text {
+		if runeCount > maxRunes {
+			break
+		}
+		if unicode.IsSpace(eachRune) {
+			if strings.ContainsRune(".!?", prevRune) {
+				sentenceIndex = byteIndex
+			}
+			spaceIndex = byteIndex
+		}
+		prevRune = eachRune
+		runeCount++
+	}
+	if runeCount <= maxRunes {
+		return len(text), true
+	}
+	if sentenceIndex != 0 {
+		return sentenceIndex, true
+	}
+	return spaceIndex, false
+}
+
+// splitPlainText splits text into chunks of at most limit runes
+func splitPlainText(text string, limit int) []string {
+	chunks := []string{}
+	text = strings.TrimSpace(text)
+	for text != "" {
+		splitIndex, _ := sentenceSplitIndex(text, limit)
+		if splitIndex == 0 {
+			// One very long word, so split it at the limit
+			splitIndex = len(text)
+			runeCount := 0
+			for byteIndex := range text {
+				if runeCount == limit {
+					splitIndex = byteIndex
+					break
+				}
+				runeCount++
+			}
+		}
+		chunks = append(chunks, strings.TrimSpace(text[:splitIndex]))
+		text = strings.TrimSpace(text[splitIndex:])
+	}
+	return chunks
+}
+
+// ssmlSafePoint is the position just before an element that can't be
+// split, where the chunk can end if the element's content doesn't fit
+type ssmlSafePoint struct {
+	length int
+	billed int
+	open   []xml.StartElement
+}
+
+// ssmlChunker accumulates the tokens of a <speak> document into chunks that
+// are each a complete <speak> document. Each chunk has at most limit
+// billed characters and, tags included, totalLimit bytes, which are at
+// least as many as its characters.
+type ssmlChunker struct {
+	limit      int
+	totalLimit int
+	chunks     []string
+	current    strings.Builder
+	billed     int
+	root       *xml.StartElement
+	open       []xml.StartElement
+	safePoint  *ssmlSafePoint
+	// pending is a start element that's written once it's known whether
+	// it's empty, so that <break/> round trips as is
+	pending *xml.StartElement
+}
+
+func writeSSMLStart(w io.Writer, element xml.StartElement, empty bool) {
+	io.WriteString(w, "<"+ssmlRawName(element.Name))
+	for _, eachAttr := range element.Attr {
+		io.WriteString(w, " "+ssmlRawName(eachAttr.Name)+`="`+ssmlEscaper.Replace(eachAttr.Value)+`"`)
+	}
+	if empty {
+		io.WriteString(w, "/>")
+	} else {
+		io.WriteString(w, ">")
+	}
+}
+
+func writeSSMLEnd(w io.Writer, openElements []xml.StartElement) {
+	for i := len(openElements) - 1; i >= 0; i-- {
+		io.WriteString(w, "</"+ssmlRawName(openElements[i].Name)+">")
+	}
+}
+
+// ssmlRawName returns the name of a token from xml.Decoder.RawToken, where
+// the Space is the unresolved prefix
+func ssmlRawName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// remaining returns how many more billed characters and how many more
+// bytes in total the current chunk can take, leaving room for the pending
+// element and the end tags that close the chunk
+func (sc *ssmlChunker) remaining() (int, int) {
+	closing := strings.Builder{}
+	if sc.pending != nil {
+		writeSSMLStart(&closing, *sc.pending, false)
+	}
+	writeSSMLEnd(&closing, sc.open)
+	writeSSMLEnd(&closing, []xml.StartElement{*sc.root})
+	return sc.limit - sc.billed, sc.totalLimit - sc.current.Len() - closing.Len()
+}
+
+// fits returns true if all of text fits in the current chunk
+func (sc *ssmlChunker) fits(text string) bool {
+	billedRemaining, totalRemaining := sc.remaining()
+	return utf8.RuneCountInString(text) <= billedRemaining &&
+		len(ssmlEscaper.Replace(text)) <= totalRemaining
+}
+
+// fitsElement returns true if the element's start and end tags fit in the
+// current chunk
+func (sc *ssmlChunker) fitsElement(element xml.StartElement) bool {
+	tags := strings.Builder{}
+	writeSSMLStart(&tags, element, false)
+	writeSSMLEnd(&tags, []xml.StartElement{element})
+	_, totalRemaining := sc.remaining()
+	return tags.Len() <= totalRemaining
+}
+
+// splitIndex is the sentenceSplitIndex of text within what's remaining of
+// the current chunk. Escaping may lengthen the text, so the split moves
+// back until the escaped text fits too.
+func (sc *ssmlChunker) splitIndex(text string) (int, bool) {
+	billedRemaining, totalRemaining := sc.remaining()
+	maxRunes := billedRemaining
+	if totalRemaining < maxRunes {
+		maxRunes = totalRemaining
+	}
+	for maxRunes > 0 {
+		splitIndex, atSentence := sentenceSplitIndex(text, maxRunes)
+		overflow := len(ssmlEscaper.Replace(text[:splitIndex])) - totalRemaining
+		if overflow <= 0 {
+			return splitIndex, atSentence
+		}
+		maxRunes -= overflow
+	}
+	return 0, false
+}
+
+func (sc *ssmlChunker) flushPending() {
+	if sc.pending != nil {
+		writeSSMLStart(&sc.current, *sc.pending, false)
+		sc.pending = nil
+	}
+}
+
+// splittable returns true if the chunk can end at the current position
+func (sc *ssmlChunker) splittable() bool {
+	for _, eachElement := range sc.open {
+		if !ssmlSplittableTags[ssmlRawName(eachElement.Name)] {
+			return false
+		}
+	}
+	return true
+}
+
+// startChunk opens a new chunk, reopening the root and any open elements.
+// A pending element is reopened along with the rest.
+func (sc *ssmlChunker) startChunk() {
+	sc.current.Reset()
+	sc.billed = 0
+	sc.safePoint = nil
+	sc.pending = nil
+	writeSSMLStart(&sc.current, *sc.root, false)
+	for _, eachElement := range sc.open {
+		writeSSMLStart(&sc.current, eachElement, false)
+	}
+}
+
+// endChunk closes the open elements and the root of the current chunk. A
+// pending element hasn't been written, so it's left for the next chunk.
+func (sc *ssmlChunker) endChunk() {
+	openElements := sc.open
+	if sc.pending != nil {
+		openElements = openElements[:len(openElements)-1]
+	}
+	writeSSMLEnd(&sc.current, openElements)
+	io.WriteString(&sc.current, "</"+ssmlRawName(sc.root.Name)+">")
+	// Don't synthesize a trailing chunk of nothing but markup
+	if sc.billed == 0 && len(sc.chunks) != 0 {
+		return
+	}
+	sc.chunks = append(sc.chunks, sc.current.String())
+}
+
+// splitAtSafePoint ends the chunk before the element that can't be split
+// and moves everything after it into a new chunk
+func (sc *ssmlChunker) splitAtSafePoint() {
+	safePoint := sc.safePoint
+	written := sc.current.String()
+	sc.current.Reset()
+	io.WriteString(&sc.current, written[:safePoint.length])
+	writeSSMLEnd(&sc.current, safePoint.open)
+	io.WriteString(&sc.current, "</"+ssmlRawName(sc.root.Name)+">")
+	sc.chunks = append(sc.chunks, sc.current.String())
+
+	sc.current.Reset()
+	writeSSMLStart(&sc.current, *sc.root, false)
+	for _, eachElement := range safePoint.open {
+		writeSSMLStart(&sc.current, eachElement, false)
+	}
+	io.WriteString(&sc.current, written[safePoint.length:])
+	sc.billed -= safePoint.billed
+	sc.safePoint = nil
+}
+
+func (sc *ssmlChunker) text(text string) {
+	if !sc.fits(text) &&
+		!sc.splittable() &&
+		sc.safePoint != nil &&
+		sc.safePoint.billed != 0 {
+		sc.splitAtSafePoint()
+	}
+	for !sc.fits(text) && sc.splittable() {
+		splitIndex, atSentence := sc.splitIndex(text)
+		if !atSentence && sc.billed != 0 {
+			// Rather than end the chunk mid-sentence, end it at
+			// the preceding tag
+			splitIndex = 0
+		} else if splitIndex == 0 {
+			// Nothing fits in an empty chunk, so there's nowhere safe
+			// to split
+			break
+		}
+		if splitIndex != 0 {
+			sc.flushPending()
+			io.WriteString(&sc.current, ssmlEscaper.Replace(text[:splitIndex]))
+		}
+		sc.endChunk()
+		sc.startChunk()
+		text = strings.TrimLeftFunc(text[splitIndex:], unicode.IsSpace)
+	}
+	if text != "" {
+		sc.flushPending()
+		io.WriteString(&sc.current, ssmlEscaper.Replace(text))
+		sc.billed += utf8.RuneCountInString(text)
+	}
+}
+
+// splitSSML splits a <speak> document into <speak> documents with at most
+// limit billed characters and totalLimit characters, tags included, each.
+// Chunks end at sentence boundaries and any open elements are closed and
+// then reopened in the next chunk.
+func splitSSML(ssml string, limit int, totalLimit int) ([]string, error) {
+	chunker := &ssmlChunker{
+		limit:      limit,
+		totalLimit: totalLimit,
+	}
+	decoder := xml.NewDecoder(strings.NewReader(ssml))
+	for {
+		token, tokenErr := decoder.RawToken()
+		if tokenErr == io.EOF {
+			break
+		}
+		if tokenErr != nil {
+			return nil, tokenErr
+		}
+		switch typedToken := token.(type) {
+		case xml.StartElement:
+			element := typedToken.Copy()
+			if chunker.root == nil {
+				chunker.root = &element
+				chunker.startChunk()
+				continue
+			}
+			chunker.flushPending()
+			// Markup isn't billed, but counts towards the total
+			if !chunker.fitsElement(element) && chunker.splittable() && chunker.billed != 0 {
+				chunker.endChunk()
+				chunker.startChunk()
+			}
+			if chunker.splittable() && !ssmlSplittableTags[ssmlRawName(element.Name)] {
+				chunker.safePoint = &ssmlSafePoint{
+					length: chunker.current.Len(),
+					billed: chunker.billed,
+					open:   append([]xml.StartElement{}, chunker.open...),
+				}
+			}
+			chunker.pending = &element
+			chunker.open = append(chunker.open, element)
+		case xml.EndElement:
+			if len(chunker.open) == 0 {
+				// The root element
+				chunker.endChunk()
+				continue
+			}
+			if chunker.pending != nil {
+				writeSSMLStart(&chunker.current, *chunker.pending, true)
+				chunker.pending = nil
+			} else {
+				writeSSMLEnd(&chunker.current, chunker.open[len(chunker.open)-1:])
+			}
+			chunker.open = chunker.open[:len(chunker.open)-1]
+		case xml.CharData:
+			if chunker.root != nil {
+				chunker.text(string(typedToken))
+			}
+		}
+	}
+	return chunker.chunks, nil
+}
+
+// splitSpeechText splits the classified speech text into chunks that are
+// each within Polly's per-task limits of limit billed characters and
+// totalLimit characters in all. Plain text is all billed.
+func splitSpeechText(speechText string,
+	speechKind speechTextKind,
+	limit int,
+	totalLimit int) ([]string, error) {
+	if speechKind == speechTextPlain {
+		if totalLimit < limit {
+			limit = totalLimit
+		}
+		return splitPlainText(speechText, limit), nil
+	}
+	return splitSSML(speechText, limit, totalLimit)
+}
@@ -0,0 +1,198 @@
+package lambda
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/service/polly"
+)
+
+func TestSplitPlainText(t *testing.T) {
+	testCases := []struct {
+		name     string
+		text     string
+		limit    int
+		expected []string
+	}{
+		{
+			name:     "fits",
+			text:     "One. Two.",
+			limit:    100,
+			expected: []string{"One. Two."},
+		},
+		{
+			name:     "sentences",
+			text:     "One fish. Two fish. Red fish.",
+			limit:    20,
+			expected: []string{"One fish. Two fish.", "Red fish."},
+		},
+		{
+			name:     "words",
+			text:     "one two three four",
+			limit:    9,
+			expected: []string{"one two", "three", "four"},
+		},
+		{
+			name:     "long word",
+			text:     "abcdefghij",
+			limit:    4,
+			expected: []string{"abcd", "efgh", "ij"},
+		},
+	}
+	for _, eachTestCase := range testCases {
+		t.Run(eachTestCase.name, func(t *testing.T) {
+			chunks := splitPlainText(eachTestCase.text, eachTestCase.limit)
+			if strings.Join(chunks, "|") != strings.Join(eachTestCase.expected, "|") {
+				t.Fatalf("Unexpected chunks.\nExpected: %q\nActual:   %q",
+					eachTestCase.expected,
+					chunks)
+			}
+		})
+	}
+}
+
+func TestSplitSSML(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ssml     string
+		limit    int
+		expected []string
+	}{
+		{
+			name:     "fits",
+			ssml:     `<speak>Hello <break time="1s"/> world.</speak>`,
+			limit:    100,
+			expected: []string{`<speak>Hello <break time="1s"/> world.</speak>`},
+		},
+		{
+			name:  "paragraphs",
+			ssml:  "<speak><p>One fish. Two fish.</p><p>Red fish. Blue fish.</p></speak>",
+			limit: 25,
+			expected: []string{
+				"<speak><p>One fish. Two fish.</p></speak>",
+				"<speak><p>Red fish. Blue fish.</p></speak>",
+			},
+		},
+		{
+			name:  "reopened tags",
+			ssml:  `<speak xml:lang="en-US"><amazon:domain name="news"><p>One fish. Two fish. Red fish.</p></amazon:domain></speak>`,
+			limit: 20,
+			expected: []string{
+				`<speak xml:lang="en-US"><amazon:domain name="news"><p>One fish. Two fish.</p></amazon:domain></speak>`,
+				`<speak xml:lang="en-US"><amazon:domain name="news"><p>Red fish.</p></amazon:domain></speak>`,
+			},
+		},
+		{
+			name:  "unsplittable",
+			ssml:  `<speak>Hi. <say-as interpret-as="characters">ABC. DEF. GHI.</say-as> Bye.</speak>`,
+			limit: 8,
+			expected: []string{
+				`<speak>Hi. </speak>`,
+				`<speak><say-as interpret-as="characters">ABC. DEF. GHI.</say-as></speak>`,
+				`<speak>Bye.</speak>`,
+			},
+		},
+		{
+			name:  "escaped",
+			ssml:  "<speak>Q&amp;A one. Q&amp;A two.</speak>",
+			limit: 10,
+			expected: []string{
+				"<speak>Q&amp;A one.</speak>",
+				"<speak>Q&amp;A two.</speak>",
+			},
+		},
+	}
+	for _, eachTestCase := range testCases {
+		t.Run(eachTestCase.name, func(t *testing.T) {
+			chunks, chunksErr := splitSSML(eachTestCase.ssml, eachTestCase.limit, pollyMaxTotalCharacters)
+			if chunksErr != nil {
+				t.Fatalf("Failed to split: %s", chunksErr)
+			}
+			if strings.Join(chunks, "\n") != strings.Join(eachTestCase.expected, "\n") {
+				t.Fatalf("Unexpected chunks.\nExpected:\n%s\nActual:\n%s",
+					strings.Join(eachTestCase.expected, "\n"),
+					strings.Join(chunks, "\n"))
+			}
+		})
+	}
+}
+
+func TestSplitSSMLTotalLimit(t *testing.T) {
+	// Markup isn't billed, so a document heavy with tags reaches the total
+	// limit first
+	ssml := "<speak>" + strings.Repeat(`<p>Hi.<break time="1s"/></p>`, 200) + "</speak>"
+	totalLimit := 500
+	chunks, chunksErr := splitSSML(ssml, pollyMaxBilledCharacters, totalLimit)
+	if chunksErr != nil {
+		t.Fatalf("Failed to split: %s", chunksErr)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("Expected several chunks, got: %d", len(chunks))
+	}
+	billed := 0
+	for i, eachChunk := range chunks {
+		if len(eachChunk) > totalLimit {
+			t.Fatalf("Chunk %d has %d characters", i, len(eachChunk))
+		}
+		_, _, parseErr := parseXMLDocument(eachChunk)
+		if parseErr != nil {
+			t.Fatalf("Chunk %d is malformed: %s", i, parseErr)
+		}
+		billed += utf8.RuneCountInString(stripTags(eachChunk))
+	}
+	if billed != utf8.RuneCountInString(stripTags(ssml)) {
+		t.Fatalf("Expected the chunks to keep all %d billed characters, got %d",
+			utf8.RuneCountInString(stripTags(ssml)),
+			billed)
+	}
+}
+
+func TestSplitLongEpisode(t *testing.T) {
+	paragraph := "<p>" + strings.Repeat("This is a sentence in a very long episode. ", 100) + "</p>"
+	ssml := markdownToSSML("", polly.EngineNeural)
+	ssml = strings.Replace(ssml, "</speak>", strings.Repeat(paragraph, 60)+"</speak>", 1)
+
+	chunks, chunksErr := splitSpeechText(ssml,
+		speechTextSSML,
+		pollyMaxBilledCharacters,
+		pollyMaxTotalCharacters)
+	if chunksErr != nil {
+		t.Fatalf("Failed to split: %s", chunksErr)
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 3 chunks, got: %d", len(chunks))
+	}
+	for i, eachChunk := range chunks {
+		validateErr := validateSSML(eachChunk, polly.EngineNeural)
+		if validateErr != nil {
+			t.Fatalf("Chunk %d is invalid: %s", i, validateErr)
+		}
+		billed := 0
+		_, _, parseErr := parseXMLDocument(eachChunk)
+		if parseErr != nil {
+			t.Fatalf("Chunk %d is malformed: %s", i, parseErr)
+		}
+		billed = utf8.RuneCountInString(stripTags(eachChunk))
+		if billed > pollyMaxBilledCharacters {
+			t.Fatalf("Chunk %d has %d billed characters", i, billed)
+		}
+	}
+}
+
+// stripTags returns the text content of an SSML document
+func stripTags(ssml string) string {
+	text := strings.Builder{}
+	inTag := false
+	for _, eachRune := range ssml {
+		switch {
+		case eachRune == '<':
+			inTag = true
+		case eachRune == '>':
+			inTag = false
+		case !inTag:
+			text.WriteRune(eachRune)
+		}
+	}
+	return text.String()
+}
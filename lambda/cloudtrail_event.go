@@ -29,6 +29,7 @@ type CloudTrail struct {
 			Host       string `json:"Host"`
 			BucketName string `json:"bucketName"`
 			Key        string `json:"key"`
+			CopySource string `json:"x-amz-copy-source"`
 		} `json:"requestParameters"`
 		Resources []struct {
 			Arn       string `json:"ARN"`
@@ -0,0 +1,194 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	spartaCF "github.com/mweagle/Sparta/aws/cloudformation"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+// removeDeletedEpisodes removes the manifest, audio and state of every episode
+// whose source no longer exists and returns their keys. DeleteObjects
+// events don't reliably name each key, so rather than trusting the event
+// every manifest is checked. The manifest is kept as a tombstone first, so
+// that a renamed episode can keep its GUID and pubDate.
+func removeDeletedEpisodes(blobStore BlobStore,
+	logger *logrus.Logger) ([]string, error) {
+
+	manifestPrefix := fmt.Sprintf("%s/%s/", PublicKeyPath, KeyComponentMetadata)
+	manifestBlobs, manifestBlobsErr := blobStore.List(manifestPrefix)
+	if manifestBlobsErr != nil {
+		return nil, manifestBlobsErr
+	}
+	removedKeys := []string{}
+	for _, eachBlob := range manifestBlobs {
+		if !strings.HasSuffix(eachBlob.Key, ".json") {
+			continue
+		}
+		manifestBytes, _, manifestBytesErr := blobStore.Get(eachBlob.Key)
+		if manifestBytesErr != nil {
+			return nil, manifestBytesErr
+		}
+		manifest := SpartaCastTask{}
+		unmarshalErr := json.Unmarshal(manifestBytes, &manifest)
+		if unmarshalErr != nil {
+			return nil, unmarshalErr
+		}
+		sourceKey := manifest.Key
+		if sourceKey == "" {
+			sourceKey = strings.TrimSuffix(strings.TrimPrefix(eachBlob.Key, manifestPrefix), ".json")
+		}
+		_, sourceInfoErr := blobStore.Head(sourceKey)
+		if sourceInfoErr == nil {
+			continue
+		}
+		if !errors.Is(sourceInfoErr, ErrBlobNotFound) {
+			return nil, sourceInfoErr
+		}
+
+		// Gone...keep the tombstone, then delete the audio and the manifest
+		_, putErr := blobStore.Put(tombstoneKeyPath(sourceKey), manifestBytes, "application/json")
+		if putErr != nil {
+			return nil, putErr
+		}
+		outputURIs := []string{}
+		if manifest.SynthesisTask != nil && manifest.SynthesisTask.OutputUri != nil {
+			outputURIs = append(outputURIs, *manifest.SynthesisTask.OutputUri)
+		}
+		for _, eachPart := range manifest.Parts {
+			if eachPart.SynthesisTask != nil && eachPart.SynthesisTask.OutputUri != nil {
+				outputURIs = append(outputURIs, *eachPart.SynthesisTask.OutputUri)
+			}
+		}
+		for _, eachURI := range outputURIs {
+			outputKey, outputKeyErr := blobStore.KeyFromURL(eachURI)
+			if outputKeyErr != nil {
+				continue
+			}
+			deleteErr := blobStore.Delete(outputKey)
+			if deleteErr != nil {
+				return nil, deleteErr
+			}
+		}
+		deleteErr := blobStore.Delete(partsKeyPath(sourceKey))
+		if deleteErr != nil {
+			return nil, deleteErr
+		}
+		deleteErr = blobStore.Delete(itemKeyPath(sourceKey))
+		if deleteErr != nil {
+			return nil, deleteErr
+		}
+		// Without the event record, uploading the same content again
+		// isn't mistaken for a duplicate event
+		deleteErr = blobStore.Delete(eventRecordKeyPath(sourceKey))
+		if deleteErr != nil {
+			return nil, deleteErr
+		}
+		deleteErr = blobStore.Delete(eachBlob.Key)
+		if deleteErr != nil {
+			return nil, deleteErr
+		}
+		logger.WithFields(logrus.Fields{
+			"key":        sourceKey,
+			"outputURIs": outputURIs,
+		}).Info("Removed deleted episode")
+		removedKeys = append(removedKeys, sourceKey)
+	}
+	return removedKeys, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+/*
+  ___      _     _
+ |   \ ___| |___| |_ ___
+ | |) / -_) / -_)  _/ -_)
+ |___/\___|_\___|\__\___|
+*/
+////////////////////////////////////////////////////////////////////////////////
+// Handle the S3 delete function
+type handleDeleteTask struct {
+	s3BucketResourceName string
+	newBlobStore         blobStoreConstructor
+}
+
+func (lambda *handleDeleteTask) Name() string {
+	return HandleDeleteTaskName
+}
+
+func (lambda *handleDeleteTask) Handler() interface{} {
+	handler := func(ctx context.Context, ctEvent CloudTrail) (*SpartaCastTask, error) {
+		logInputEvent(ctx, ctEvent)
+
+		logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+		awsSession, _ := ctx.Value(sparta.ContextKeyAWSSession).(*session.Session)
+		if awsSession == nil {
+			return nil, fmt.Errorf("Failed to extract AWS Session")
+		}
+
+		bucketName := ctEvent.Detail.RequestParameters.BucketName
+		blobStore := lambda.newBlobStore(awsSession, bucketName)
+		removedKeys, removedKeysErr := removeDeletedEpisodes(blobStore, logger)
+		if removedKeysErr != nil {
+			return nil, removedKeysErr
+		}
+		logger.WithFields(logrus.Fields{
+			"eventName":   ctEvent.Detail.EventName,
+			"removedKeys": removedKeys,
+		}).Info("Removed deleted episodes")
+
+		// Without a feed.md there's no feed to regenerate
+		_, feedConfigInfoErr := blobStore.Head(FeedConfigName)
+		if feedConfigInfoErr != nil && !errors.Is(feedConfigInfoErr, ErrBlobNotFound) {
+			return nil, feedConfigInfoErr
+		}
+		if feedConfigInfoErr != nil {
+			logger.WithFields(logrus.Fields{
+				"key": FeedConfigName,
+			}).Warn("Feed config deleted, leaving the feed as is")
+		}
+
+		// Pass the bucket along to the feed task
+		return &SpartaCastTask{
+			Bucket:            bucketName,
+			Key:               ctEvent.Detail.RequestParameters.Key,
+			FeedConfigMissing: feedConfigInfoErr != nil,
+		}, nil
+	}
+	return handler
+}
+
+func (lambda *handleDeleteTask) Role() interface{} {
+	role := sparta.IAMRoleDefinition{}
+
+	role.Privileges = append(role.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"s3:Get*",
+				"s3:Put*",
+				"s3:Head*",
+				"s3:DeleteObject",
+			},
+			Resource: spartaCF.S3AllKeysArnForBucket(gocf.Ref(lambda.s3BucketResourceName)),
+		},
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"s3:ListBucket"},
+			Resource: gocf.GetAtt(lambda.s3BucketResourceName, "Arn"),
+		},
+	)
+
+	return role
+}
+
+// newHandleDeleteTask returns an s3 delete event handler
+func newHandleDeleteTask(s3BucketResourceName string) sparta.AWSLambdaProvider {
+	return &handleDeleteTask{
+		s3BucketResourceName: s3BucketResourceName,
+		newBlobStore:         NewS3BlobStore,
+	}
+}
@@ -0,0 +1,227 @@
+package lambda
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	sparta "github.com/mweagle/Sparta"
+)
+
+func TestCopySourceKey(t *testing.T) {
+	for eachCopySource, eachExpected := range map[string]string{
+		"spartacast-eventbucket/episode1.md":                  "episode1.md",
+		"/spartacast-eventbucket/season%201/episode1.md":      "season 1/episode1.md",
+		"spartacast-eventbucket/episode1.md?versionId=abc123": "episode1.md",
+		"otherbucket/episode1.md":                             "",
+		"":                                                    "",
+	} {
+		if sourceKey := copySourceKey("spartacast-eventbucket", eachCopySource); sourceKey != eachExpected {
+			t.Fatalf("Unexpected key for %q: %q != %q", eachCopySource, sourceKey, eachExpected)
+		}
+	}
+}
+
+func TestDeleteAndRenameEpisode(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{}, logger)
+	executor.Clock = NewFakeClock(time.Now())
+	execute := func(event []byte) []*LocalTransition {
+		transitions, executeErr := executor.Execute(event)
+		if executeErr != nil {
+			t.Fatalf("Failed to execute: %s", executeErr)
+		}
+		return transitions
+	}
+	execute(testUploadEvent("episode1.md"))
+	original := testManifest(t, blobStore, "episode1.md")
+	originalEnclosure, _ := blobStore.KeyFromURL(original.Item.EnclosureLink)
+
+	// A rename is a copy and a delete. The copy's execution usually
+	// finishes after the delete, so the source is gone by then.
+	blobStore.Copy("episode1.md", "episode-one.md", "")
+	blobStore.Delete("episode1.md")
+	execute(testEvent("CopyObject", "episode-one.md", "spartacast-eventbucket/episode1.md"))
+	transitions := execute(testEvent(EventNameDeleteObject, "episode1.md", ""))
+	expected := strings.Join([]string{StateBranchOnUploadType,
+		HandleDeleteTaskName,
+		StateCheckFeedConfig,
+		HandleFeedTaskName,
+		StateCheckFeedRebuilt,
+		StateFeedGenerated}, " -> ")
+	if transitionStates(transitions) != expected {
+		t.Fatalf("Unexpected transitions.\nExpected: %s\nActual:   %s",
+			expected,
+			transitionStates(transitions))
+	}
+	renamed := testManifest(t, blobStore, "episode-one.md")
+	if renamed.Item.GUID != original.Item.GUID || renamed.Item.PubDate != original.Item.PubDate {
+		t.Fatalf("Expected the renamed episode to keep %s (%s), got %s (%s)",
+			original.Item.GUID,
+			original.Item.PubDate,
+			renamed.Item.GUID,
+			renamed.Item.PubDate)
+	}
+	for _, eachKey := range []string{manifestKeyPath("episode1.md"), originalEnclosure} {
+		_, headErr := blobStore.Head(eachKey)
+		if !errors.Is(headErr, ErrBlobNotFound) {
+			t.Fatalf("Expected %s to be deleted: %v", eachKey, headErr)
+		}
+	}
+	feedBytes, _, _ := blobStore.Get("public/feed/feed.xml")
+	if strings.Count(string(feedBytes), original.Item.GUID) != 1 {
+		t.Fatalf("Expected one feed item with GUID %s:\n%s", original.Item.GUID, feedBytes)
+	}
+
+	tombstone, _, tombstoneErr := blobStore.Get(tombstoneKeyPath("episode1.md"))
+	if tombstoneErr != nil || !strings.HasPrefix(tombstoneKeyPath("episode1.md"), StateKeyPath+"/") {
+		t.Fatalf("Expected a private tombstone: %v", tombstoneErr)
+	}
+	if !strings.Contains(string(tombstone), original.Item.GUID) {
+		t.Fatalf("Expected the tombstone to keep GUID %s:\n%s", original.Item.GUID, tombstone)
+	}
+
+	// If the delete's execution finishes first, the GUID is in the tombstone
+	blobStore.Copy("episode-one.md", "episode-1.md", "")
+	blobStore.Delete("episode-one.md")
+	execute(testEvent(EventNameDeleteObject, "episode-one.md", ""))
+	execute(testEvent("CopyObject", "episode-1.md", "spartacast-eventbucket/episode-one.md"))
+	if guid := testManifest(t, blobStore, "episode-1.md").Item.GUID; guid != original.Item.GUID {
+		t.Fatalf("Expected the renamed episode to keep %s, got %s", original.Item.GUID, guid)
+	}
+
+	// A copy whose source still exists is a new episode
+	blobStore.Copy("episode-1.md", "episode-2.md", "")
+	execute(testEvent("CopyObject", "episode-2.md", "spartacast-eventbucket/episode-1.md"))
+	if guid := testManifest(t, blobStore, "episode-2.md").Item.GUID; guid == original.Item.GUID {
+		t.Fatalf("Expected a copied episode to have a new GUID")
+	}
+
+	// DeleteObjects events don't need to name the keys
+	blobStore.Delete("episode-1.md")
+	blobStore.Delete("episode-2.md")
+	execute(testEvent(EventNameDeleteObjects, "", ""))
+	manifests, _ := blobStore.List(PublicKeyPath + "/" + KeyComponentMetadata + "/")
+	if len(manifests) != 0 {
+		t.Fatalf("Expected every manifest to be deleted, found %d", len(manifests))
+	}
+}
+
+func TestDeleteAndReuploadEpisode(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{}, logger)
+	executor.Clock = NewFakeClock(time.Now())
+	execute := func(event []byte) {
+		_, executeErr := executor.Execute(event)
+		if executeErr != nil {
+			t.Fatalf("Failed to execute: %s", executeErr)
+		}
+	}
+	execute(testUploadEvent("episode1.md"))
+	original := testManifest(t, blobStore, "episode1.md")
+	episodeBytes, _, _ := blobStore.Get("episode1.md")
+	blobStore.Delete("episode1.md")
+	execute(testEvent(EventNameDeleteObject, "episode1.md", ""))
+	_, headErr := blobStore.Head(eventRecordKeyPath("episode1.md"))
+	if !errors.Is(headErr, ErrBlobNotFound) {
+		t.Fatalf("Expected the event record to be deleted: %v", headErr)
+	}
+
+	// Uploading the same content again, within the duplicate event
+	// window, puts the episode back in the feed
+	blobStore.Put("episode1.md", episodeBytes, "")
+	execute(testUploadEvent("episode1.md"))
+	reuploaded := testManifest(t, blobStore, "episode1.md")
+	if reuploaded.Item.GUID != original.Item.GUID {
+		t.Fatalf("Expected the reuploaded episode to keep %s, got %s",
+			original.Item.GUID,
+			reuploaded.Item.GUID)
+	}
+	feedBytes, _, _ := blobStore.Get("public/feed/feed.xml")
+	if !strings.Contains(string(feedBytes), original.Item.GUID) {
+		t.Fatalf("Expected the feed to include GUID %s:\n%s", original.Item.GUID, feedBytes)
+	}
+}
+
+// deniedHeadStore fails to Head the denied key, like S3 does for a missing
+// key without s3:ListBucket
+type deniedHeadStore struct {
+	BlobStore
+	denied string
+}
+
+func (dhs *deniedHeadStore) Head(key string) (*BlobInfo, error) {
+	if key == dhs.denied {
+		return nil, errors.New("AccessDenied: Access Denied")
+	}
+	return dhs.BlobStore.Head(key)
+}
+
+func TestRenameSourceError(t *testing.T) {
+	localStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	blobStore := &deniedHeadStore{BlobStore: localStore}
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{}, logger)
+	executor.Clock = NewFakeClock(time.Now())
+	_, executeErr := executor.Execute(testUploadEvent("episode1.md"))
+	if executeErr != nil {
+		t.Fatalf("Failed to execute: %s", executeErr)
+	}
+
+	// If the copy source can't be checked, the copy fails rather than
+	// getting a new GUID
+	blobStore.Copy("episode1.md", "episode-one.md", "")
+	blobStore.Delete("episode1.md")
+	blobStore.denied = "episode1.md"
+	_, executeErr = executor.Execute(testEvent("CopyObject", "episode-one.md", "spartacast-eventbucket/episode1.md"))
+	if executeErr == nil || !strings.Contains(executeErr.Error(), "AccessDenied") {
+		t.Fatalf("Expected the rename check to fail, got: %v", executeErr)
+	}
+	_, headErr := blobStore.Head(manifestKeyPath("episode-one.md"))
+	if !errors.Is(headErr, ErrBlobNotFound) {
+		t.Fatalf("Expected no manifest for the copy: %v", headErr)
+	}
+}
+
+func TestDeleteFeedConfig(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{}, logger)
+	executor.Clock = NewFakeClock(time.Now())
+	_, executeErr := executor.Execute(testUploadEvent("episode1.md"))
+	if executeErr != nil {
+		t.Fatalf("Failed to execute: %s", executeErr)
+	}
+	feedBytes, _, _ := blobStore.Get("public/feed/feed.xml")
+
+	// Without feed.md, the delete ends before the feed task
+	blobStore.Delete(FeedConfigName)
+	transitions, executeErr := executor.Execute(testEvent(EventNameDeleteObject, FeedConfigName, ""))
+	if executeErr != nil {
+		t.Fatalf("Failed to execute: %s", executeErr)
+	}
+	expected := strings.Join([]string{StateBranchOnUploadType,
+		HandleDeleteTaskName,
+		StateCheckFeedConfig,
+		StateFeedConfigDeleted}, " -> ")
+	if transitionStates(transitions) != expected {
+		t.Fatalf("Unexpected transitions.\nExpected: %s\nActual:   %s",
+			expected,
+			transitionStates(transitions))
+	}
+	unchangedBytes, _, _ := blobStore.Get("public/feed/feed.xml")
+	if string(unchangedBytes) != string(feedBytes) {
+		t.Fatalf("Expected the feed to be left as is")
+	}
+}
@@ -0,0 +1,185 @@
+package lambda
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/polly"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Multi-voice dialogue
+////////////////////////////////////////////////////////////////////////////////
+
+// dialogueSampleRate is the sample rate for every turn of a dialogue. The
+// engines default to different rates and the turns are concatenated into a
+// single MP3, so they need to agree.
+const dialogueSampleRate = "24000"
+
+// speakerTurnExpr matches the start of a turn, either **Alice:** or
+// **Alice**:, followed by the first line of what's said
+var speakerTurnExpr = regexp.MustCompile(`^\s*\*\*([^*:]+?)(?::\*\*|\*\*:)\s*(.*)$`)
+
+// Speaker is a voice in a multi-voice episode, declared as a row of the
+// episode's Speakers table
+type Speaker struct {
+	Name              string `json:"speaker" markson:"speaker"`
+	PollyVoiceID      string `json:"voice" markson:"voice"`
+	PollyEngineType   string `json:"engine,omitempty" markson:"engine,oneof=standard|neural"`
+	PollyLanguageCode string `json:"language,omitempty" markson:"language"`
+}
+
+// speechSegment is a run of the episode that's read by a single voice
+type speechSegment struct {
+	Speaker      string
+	VoiceID      string
+	Engine       string
+	LanguageCode string
+	Markdown     string
+	// Line is the source line that the Markdown starts on
+	Line int
+}
+
+// episodeSegments returns the segments of the episode in reading order. An
+// episode without Speakers is a single segment in the episode's voice.
+// Otherwise each **Name:** turn starts a segment in that speaker's voice,
+// and any text before the first turn is read in the episode's voice.
+// Consecutive turns in the same voice are merged into one segment.
+func episodeSegments(item *Item) ([]*speechSegment, error) {
+	narrator := &speechSegment{
+		VoiceID:      aws.StringValue(valOrDefault(item.PollyVoiceID, polly.VoiceIdJoanna)),
+		Engine:       aws.StringValue(valOrDefault(item.PollyEngineType, polly.EngineNeural)),
+		LanguageCode: aws.StringValue(valOrDefault(item.PollyLanguageCode, polly.LanguageCodeEnUs)),
+		Markdown:     item.Episode,
+		Line:         item.EpisodeLine,
+	}
+	if len(item.Speakers) == 0 {
+		return []*speechSegment{narrator}, nil
+	}
+	speakers := make(map[string]*Speaker)
+	for i, eachSpeaker := range item.Speakers {
+		speakerKey := strings.ToLower(strings.TrimSpace(eachSpeaker.Name))
+		if speakerKey == "" {
+			return nil, fmt.Errorf("Speaker %d has no name", i+1)
+		}
+		speakers[speakerKey] = &item.Speakers[i]
+	}
+
+	segments := []*speechSegment{}
+	current := &speechSegment{
+		VoiceID:      narrator.VoiceID,
+		Engine:       narrator.Engine,
+		LanguageCode: narrator.LanguageCode,
+	}
+	lines := []string{}
+	linesStart := 0
+	flushSegment := func() {
+		segmentText := strings.Join(lines, "\n")
+		current.Markdown = strings.TrimSpace(segmentText)
+		current.Line = item.EpisodeLine + linesStart + sourceLineOffset(segmentText, current.Markdown)
+		if current.Markdown != "" {
+			segments = append(segments, current)
+		}
+		lines = []string{}
+	}
+	inFence := false
+	for i, eachLine := range strings.Split(item.Episode, "\n") {
+		trimmedLine := strings.TrimSpace(eachLine)
+		if strings.HasPrefix(trimmedLine, "```") || strings.HasPrefix(trimmedLine, "~~~") {
+			inFence = !inFence
+		}
+		turnMatch := speakerTurnExpr.FindStringSubmatch(eachLine)
+		if inFence || turnMatch == nil {
+			lines = append(lines, eachLine)
+			continue
+		}
+		speaker, speakerExists := speakers[strings.ToLower(strings.TrimSpace(turnMatch[1]))]
+		if !speakerExists {
+			return nil, fmt.Errorf("Unknown speaker %q, expected one of: %s",
+				turnMatch[1],
+				strings.Join(speakerNames(item.Speakers), ", "))
+		}
+		flushSegment()
+		linesStart = i
+		current = &speechSegment{
+			Speaker:      speaker.Name,
+			VoiceID:      aws.StringValue(valOrDefault(speaker.PollyVoiceID, narrator.VoiceID)),
+			Engine:       aws.StringValue(valOrDefault(speaker.PollyEngineType, narrator.Engine)),
+			LanguageCode: aws.StringValue(valOrDefault(speaker.PollyLanguageCode, narrator.LanguageCode)),
+		}
+		lines = append(lines, turnMatch[2])
+	}
+	flushSegment()
+	return mergeSegments(segments), nil
+}
+
+// hasCodeBlock returns true if the Markdown has a fenced code block, which
+// is read verbatim instead of the rest of its segment
+func hasCodeBlock(markdown string) bool {
+	for _, eachLine := range strings.Split(markdown, "\n") {
+		trimmedLine := strings.TrimSpace(eachLine)
+		if strings.HasPrefix(trimmedLine, "```") || strings.HasPrefix(trimmedLine, "~~~") {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeSegments merges consecutive segments in the same voice, so that
+// they're synthesized in a single task. Each merged turn stays its own
+// paragraph and starts on its source line, so that SSML issues are still
+// positioned in the source. Segments with a code block are left alone.
+func mergeSegments(segments []*speechSegment) []*speechSegment {
+	merged := []*speechSegment{}
+	for _, eachSegment := range segments {
+		if len(merged) == 0 {
+			merged = append(merged, eachSegment)
+			continue
+		}
+		previous := merged[len(merged)-1]
+		if previous.VoiceID != eachSegment.VoiceID ||
+			previous.Engine != eachSegment.Engine ||
+			previous.LanguageCode != eachSegment.LanguageCode ||
+			hasCodeBlock(previous.Markdown) ||
+			hasCodeBlock(eachSegment.Markdown) {
+			merged = append(merged, eachSegment)
+			continue
+		}
+		lineGap := eachSegment.Line - previous.Line - strings.Count(previous.Markdown, "\n")
+		if lineGap < 2 {
+			lineGap = 2
+		}
+		previous.Markdown += strings.Repeat("\n", lineGap) + eachSegment.Markdown
+		previous.Speaker = joinSpeakerNames(previous.Speaker, eachSegment.Speaker)
+	}
+	return merged
+}
+
+// joinSpeakerNames adds the speaker to the comma separated names of a
+// merged segment, unless it's already one of them
+func joinSpeakerNames(names string, speaker string) string {
+	if speaker == "" {
+		return names
+	}
+	if names == "" {
+		return speaker
+	}
+	for _, eachName := range strings.Split(names, ", ") {
+		if eachName == speaker {
+			return names
+		}
+	}
+	return names + ", " + speaker
+}
+
+func speakerNames(speakers []Speaker) []string {
+	names := make([]string, 0, len(speakers))
+	for _, eachSpeaker := range speakers {
+		names = append(names, eachSpeaker.Name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,172 @@
+package lambda
+
+import (
+	"strings"
+	"testing"
+
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaCast/markson"
+)
+
+func TestEpisodeSegments(t *testing.T) {
+	speakers := []Speaker{
+		{Name: "Alice", PollyVoiceID: "Ivy"},
+		{Name: "Bob", PollyVoiceID: "Matthew", PollyEngineType: "standard", PollyLanguageCode: "en-GB"},
+	}
+	testCases := []struct {
+		name     string
+		item     Item
+		expected []speechSegment
+		errText  string
+	}{
+		{
+			name: "narrator",
+			item: Item{
+				PollyVoiceID: "Brian",
+				Episode:      "Just me.",
+			},
+			expected: []speechSegment{
+				{VoiceID: "Brian", Engine: "neural", LanguageCode: "en-US", Markdown: "Just me."},
+			},
+		},
+		{
+			name: "turns",
+			item: Item{
+				Speakers:    speakers,
+				Episode:     "Welcome to the show.\n\n**Alice:** Hi Bob.\nHow are you?\n\n**Bob**: Fine, thanks.",
+				EpisodeLine: 10,
+			},
+			expected: []speechSegment{
+				{VoiceID: "Joanna", Engine: "neural", LanguageCode: "en-US", Markdown: "Welcome to the show.", Line: 10},
+				{Speaker: "Alice", VoiceID: "Ivy", Engine: "neural", LanguageCode: "en-US", Markdown: "Hi Bob.\nHow are you?", Line: 12},
+				{Speaker: "Bob", VoiceID: "Matthew", Engine: "standard", LanguageCode: "en-GB", Markdown: "Fine, thanks.", Line: 15},
+			},
+		},
+		{
+			name: "case insensitive",
+			item: Item{
+				Speakers: speakers,
+				Episode:  "**alice:** Hello.",
+			},
+			expected: []speechSegment{
+				{Speaker: "Alice", VoiceID: "Ivy", Engine: "neural", LanguageCode: "en-US", Markdown: "Hello."},
+			},
+		},
+		{
+			name: "fenced",
+			item: Item{
+				Speakers: speakers,
+				Episode:  "**Alice:** Listen.\n```\n**Bob:** Not a turn.\n```",
+			},
+			expected: []speechSegment{
+				{Speaker: "Alice", VoiceID: "Ivy", Engine: "neural", LanguageCode: "en-US", Markdown: "Listen.\n```\n**Bob:** Not a turn.\n```"},
+			},
+		},
+		{
+			name: "same voice",
+			item: Item{
+				Speakers: []Speaker{
+					{Name: "Alice", PollyVoiceID: "Ivy"},
+					{Name: "Carol", PollyVoiceID: "Ivy"},
+					speakers[1],
+				},
+				Episode:     "**Alice:** Hi Carol.\n**Carol:** Hi Alice.\n\n\n**Alice:** Bye.\n**Bob:** Bye all.",
+				EpisodeLine: 3,
+			},
+			expected: []speechSegment{
+				{Speaker: "Alice, Carol", VoiceID: "Ivy", Engine: "neural", LanguageCode: "en-US", Markdown: "Hi Carol.\n\nHi Alice.\n\nBye.", Line: 3},
+				{Speaker: "Bob", VoiceID: "Matthew", Engine: "standard", LanguageCode: "en-GB", Markdown: "Bye all.", Line: 8},
+			},
+		},
+		{
+			name: "same voice with code",
+			item: Item{
+				Speakers: speakers,
+				Episode:  "**Alice:** Hi.\n**Alice:** Listen.\n```\n<speak>Hi</speak>\n```",
+			},
+			expected: []speechSegment{
+				{Speaker: "Alice", VoiceID: "Ivy", Engine: "neural", LanguageCode: "en-US", Markdown: "Hi."},
+				{Speaker: "Alice", VoiceID: "Ivy", Engine: "neural", LanguageCode: "en-US", Markdown: "Listen.\n```\n<speak>Hi</speak>\n```", Line: 1},
+			},
+		},
+		{
+			name: "unknown speaker",
+			item: Item{
+				Speakers: speakers,
+				Episode:  "**Carol:** Who am I?",
+			},
+			errText: "Unknown speaker \"Carol\", expected one of: Alice, Bob",
+		},
+	}
+	for _, eachTestCase := range testCases {
+		t.Run(eachTestCase.name, func(t *testing.T) {
+			segments, segmentsErr := episodeSegments(&eachTestCase.item)
+			if eachTestCase.errText != "" {
+				if segmentsErr == nil || !strings.Contains(segmentsErr.Error(), eachTestCase.errText) {
+					t.Fatalf("Expected error %q, got: %v", eachTestCase.errText, segmentsErr)
+				}
+				return
+			}
+			if segmentsErr != nil {
+				t.Fatalf("Failed to segment episode: %s", segmentsErr)
+			}
+			if len(segments) != len(eachTestCase.expected) {
+				t.Fatalf("Expected %d segments, got %d: %+v",
+					len(eachTestCase.expected),
+					len(segments),
+					segments)
+			}
+			for i, eachSegment := range segments {
+				if *eachSegment != eachTestCase.expected[i] {
+					t.Fatalf("Unexpected segment %d.\nExpected: %+v\nActual:   %+v",
+						i,
+						eachTestCase.expected[i],
+						*eachSegment)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDialogueEpisode(t *testing.T) {
+	episode := `# Title
+
+A conversation
+
+# Speakers
+
+| Speaker | Voice   | Engine   | Language |
+|---------|---------|----------|----------|
+| Alice   | Joanna  | neural   | en-US    |
+| Bob     | Matthew | standard | en-GB    |
+
+# Episode
+
+**Alice:** Hi Bob.
+
+**Bob:** Hi Alice.
+`
+	logger, _ := sparta.NewLogger("info")
+	configEntry := Item{}
+	specErr := ParseSpartaConfigSpec(strings.NewReader(episode),
+		&configEntry,
+		logger,
+		markson.Strict())
+	if specErr != nil {
+		t.Fatalf("Failed to parse: %v", specErr)
+	}
+	if len(configEntry.Speakers) != 2 ||
+		configEntry.Speakers[1].Name != "Bob" ||
+		configEntry.Speakers[1].PollyVoiceID != "Matthew" ||
+		configEntry.Speakers[1].PollyEngineType != "standard" ||
+		configEntry.Speakers[1].PollyLanguageCode != "en-GB" {
+		t.Fatalf("Unexpected speakers: %+v", configEntry.Speakers)
+	}
+	segments, segmentsErr := episodeSegments(&configEntry)
+	if segmentsErr != nil {
+		t.Fatalf("Failed to segment episode: %s", segmentsErr)
+	}
+	if len(segments) != 2 || segments[1].VoiceID != "Matthew" {
+		t.Fatalf("Unexpected segments: %+v", segments)
+	}
+}
@@ -2,16 +2,22 @@ package lambda
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/polly"
 	sparta "github.com/mweagle/Sparta"
 	spartaCF "github.com/mweagle/Sparta/aws/cloudformation"
+	"github.com/mweagle/SpartaCast/markson"
 	gocf "github.com/mweagle/go-cloudformation"
 	"github.com/sirupsen/logrus"
+	"gopkg.in/russross/blackfriday.v2"
 )
 
 func valOrDefault(value string, defVal string) *string {
@@ -24,6 +30,338 @@ func valOrDefault(value string, defVal string) *string {
 	return aws.String(value)
 }
 
+// speakFenceLanguages are the fenced code block languages that can hold a
+// <speak> document
+var speakFenceLanguages = map[string]bool{
+	"html": true,
+	"xml":  true,
+	"ssml": true,
+}
+
+// isSpeakFence returns true if node is an html, xml or ssml fenced code
+// block whose content is a <speak> document
+func isSpeakFence(node *blackfriday.Node) bool {
+	infoFields := strings.Fields(string(node.CodeBlockData.Info))
+	if len(infoFields) == 0 || !speakFenceLanguages[strings.ToLower(infoFields[0])] {
+		return false
+	}
+	rootName, _, docErr := parseXMLDocument(string(node.Literal))
+	return docErr == nil && rootName == "speak"
+}
+
+// episodeSpeechText returns the text to synthesize from the Markdown source
+// of the Episode section. A <speak> document, a code block that's the only
+// content of the section or an html fenced <speak> document is used
+// verbatim. Otherwise the Markdown is converted to SSML for the engine and
+// any code blocks are read as text.
+func episodeSpeechText(episodeMarkdown string, engine string) string {
+	rootName, _, _ := parseXMLDocument(strings.TrimSpace(episodeMarkdown))
+	if rootName == "speak" {
+		return episodeMarkdown
+	}
+	mdParser := blackfriday.New(blackfriday.WithExtensions(blackfriday.CommonExtensions))
+	tree := mdParser.Parse([]byte(episodeMarkdown))
+	for node := tree.FirstChild; node != nil; node = node.Next {
+		if node.Type != blackfriday.CodeBlock {
+			continue
+		}
+		soleContent := node.Prev == nil && node.Next == nil
+		if soleContent || isSpeakFence(node) {
+			return string(node.Literal)
+		}
+	}
+	return markdownToSSML(episodeMarkdown, engine)
+}
+
+// episodeSynthesisRequests returns a synthesis request for each part of
+// the episode, in reading order, and the speaker of each request
+func episodeSynthesisRequests(configEntry *Item,
+	bucket string,
+	key string,
+	logger *logrus.Logger) ([]*SynthesisRequest, []string, error) {
+
+	// Dialogue episodes have a segment per turn, everything else
+	// is a single segment
+	segments, segmentsErr := episodeSegments(configEntry)
+	if segmentsErr != nil {
+		return nil, nil, fmt.Errorf("%s: %s", key, segmentsErr)
+	}
+	outputKeyPrefix := fmt.Sprintf("%s/%s/%s",
+		PublicKeyPath,
+		KeyComponentFeed,
+		key)
+
+	// Prepare all the requests before starting any, so that an invalid
+	// turn doesn't leave orphaned tasks behind
+	synthesisRequests := []*SynthesisRequest{}
+	synthesisRequestSpeakers := []string{}
+	for _, eachSegment := range segments {
+		// Create it in the /public folder. SSML fragments are wrapped
+		// in a <speak> tag....
+		speechSource := episodeSpeechText(eachSegment.Markdown, eachSegment.Engine)
+		speechLine := eachSegment.Line + sourceLineOffset(eachSegment.Markdown, strings.TrimSpace(speechSource))
+		speechText, speechKind := classifySpeechText(speechSource)
+		logger.WithFields(logrus.Fields{
+			"speaker":  eachSegment.Speaker,
+			"value":    speechText,
+			"textType": speechKind,
+		}).Debug("User Text")
+
+		// The synthesis task is asynchronous, so catch SSML that the
+		// engine would reject before starting it
+		if speechKind != speechTextPlain {
+			validateErr := validateSSML(speechText, eachSegment.Engine)
+			if validationErr, isValidationErr := validateErr.(*ssmlValidationError); isValidationErr {
+				validationErr.Source = key
+				validationErr.Line = speechLine
+			}
+			if validateErr != nil {
+				return nil, nil, validateErr
+			}
+		}
+
+		// Long segments are synthesized in parts that are concatenated
+		// once they're all complete
+		speechChunks, speechChunksErr := splitSpeechText(speechText,
+			speechKind,
+			pollyMaxBilledCharacters,
+			pollyMaxTotalCharacters)
+		if speechChunksErr != nil {
+			return nil, nil, speechChunksErr
+		}
+		for _, eachChunk := range speechChunks {
+			synthesisRequest := &SynthesisRequest{
+				Bucket:       bucket,
+				KeyPrefix:    outputKeyPrefix,
+				Text:         eachChunk,
+				TextType:     speechKind.pollyTextType(),
+				VoiceID:      eachSegment.VoiceID,
+				Engine:       eachSegment.Engine,
+				LanguageCode: eachSegment.LanguageCode,
+			}
+			if len(configEntry.Speakers) != 0 {
+				synthesisRequest.SampleRate = dialogueSampleRate
+			}
+			synthesisRequests = append(synthesisRequests, synthesisRequest)
+			synthesisRequestSpeakers = append(synthesisRequestSpeakers, eachSegment.Speaker)
+		}
+	}
+	if len(synthesisRequests) == 0 {
+		return nil, nil, fmt.Errorf("Episode %s has no text to synthesize", key)
+	}
+	return synthesisRequests, synthesisRequestSpeakers, nil
+}
+
+// speechContentHash returns a hash of everything that affects the audio
+// of the requests: the text and how it's read. Properties such as the
+// title and description don't change it.
+func speechContentHash(synthesisRequests []*SynthesisRequest) string {
+	contentHash := sha256.New()
+	for _, eachRequest := range synthesisRequests {
+		for _, eachValue := range []string{eachRequest.Text,
+			eachRequest.TextType,
+			eachRequest.VoiceID,
+			eachRequest.Engine,
+			eachRequest.LanguageCode,
+			eachRequest.SampleRate} {
+			// Length prefix each value so that they can't run together
+			fmt.Fprintf(contentHash, "%d:%s", len(eachValue), eachValue)
+		}
+	}
+	return hex.EncodeToString(contentHash.Sum(nil))
+}
+
+// startSynthesisRequests starts a synthesis task for each request and
+// returns the parts in reading order
+func startSynthesisRequests(synthesisRequests []*SynthesisRequest,
+	synthesisRequestSpeakers []string,
+	synthesizer SpeechSynthesizer,
+	logger *logrus.Logger) ([]*SynthesisPart, error) {
+	logger.WithFields(logrus.Fields{
+		"parts": len(synthesisRequests),
+	}).Info("Starting speech synthesis")
+
+	synthesisParts := []*SynthesisPart{}
+	for i, eachRequest := range synthesisRequests {
+		synthesisTask, synthesisTaskErr := synthesizer.StartSynthesis(eachRequest)
+		if synthesisTaskErr != nil {
+			return nil, synthesisTaskErr
+		}
+		synthesisParts = append(synthesisParts, &SynthesisPart{
+			SynthesisTask: synthesisTask,
+			Speaker:       synthesisRequestSpeakers[i],
+		})
+	}
+	return synthesisParts, nil
+}
+
+// startEpisodeSynthesis starts a synthesis task for each part of the
+// episode and returns the parts in reading order
+func startEpisodeSynthesis(configEntry *Item,
+	bucket string,
+	key string,
+	synthesizer SpeechSynthesizer,
+	logger *logrus.Logger) ([]*SynthesisPart, error) {
+	synthesisRequests, synthesisRequestSpeakers, synthesisRequestsErr := episodeSynthesisRequests(configEntry,
+		bucket,
+		key,
+		logger)
+	if synthesisRequestsErr != nil {
+		return nil, synthesisRequestsErr
+	}
+	return startSynthesisRequests(synthesisRequests,
+		synthesisRequestSpeakers,
+		synthesizer,
+		logger)
+}
+
+// unchangedEpisodeTask returns the task for an episode whose speech
+// content hasn't changed since its existing manifest, or nil if it has to
+// be synthesized. The task reuses the existing audio.
+func unchangedEpisodeTask(blobStore BlobStore,
+	configEntry *Item,
+	bucket string,
+	key string,
+	contentHash string,
+	logger *logrus.Logger) *SpartaCastTask {
+	existing := existingManifest(blobStore, key, logger)
+	if existing == nil ||
+		existing.ContentHash != contentHash ||
+		existing.SynthesisTask == nil ||
+		aws.StringValue(existing.SynthesisTask.TaskStatus) != polly.TaskStatusCompleted {
+		return nil
+	}
+	// The audio has to still be there
+	enclosureKey, enclosureKeyErr := blobStore.KeyFromURL(aws.StringValue(existing.SynthesisTask.OutputUri))
+	if enclosureKeyErr != nil {
+		return nil
+	}
+	_, enclosureInfoErr := blobStore.Head(enclosureKey)
+	if enclosureInfoErr != nil {
+		return nil
+	}
+	return &SpartaCastTask{
+		SynthesisTask:    existing.SynthesisTask,
+		Parts:            existing.Parts,
+		Bucket:           bucket,
+		Item:             configEntry,
+		Key:              key,
+		ContentHash:      contentHash,
+		SynthesisSkipped: true,
+	}
+}
+
+// newEpisodeTask parses the episode source and starts synthesizing it.
+// The returned task is passed along the state machine.
+func newEpisodeTask(blobStore BlobStore,
+	synthesizer SpeechSynthesizer,
+	bucket string,
+	key string,
+	now time.Time,
+	logger *logrus.Logger) (*SpartaCastTask, error) {
+
+	// Parse the input. If it's a feed.md, then it's a feed,
+	// otherwise it's an episode. Episodes are parsed strictly so that
+	// a misspelled property fails the execution rather than silently
+	// falling back to a default...
+	configEntry := Item{}
+	configEntryErr := unmarshalSpartaCastConfigFromBlobStore(blobStore,
+		key,
+		&configEntry,
+		logger,
+		markson.Strict(),
+	)
+	if configEntryErr != nil {
+		return nil, configEntryErr
+	}
+	// An explicit pubDate overrides the date the episode was first published
+	// and a publishAt keeps it out of the feed until then
+	for eachPropertyName, eachDate := range map[string]*string{
+		"pubDate":   &configEntry.PubDate,
+		"publishAt": &configEntry.PublishAt,
+	} {
+		if *eachDate == "" {
+			continue
+		}
+		parsedDate, parsedDateErr := parseDateProperty(eachPropertyName, *eachDate)
+		if parsedDateErr != nil {
+			return nil, fmt.Errorf("Failed to parse %s: %s", key, parsedDateErr)
+		}
+		*eachDate = parsedDate
+	}
+
+	synthesisRequests, synthesisRequestSpeakers, synthesisRequestsErr := episodeSynthesisRequests(&configEntry,
+		bucket,
+		key,
+		logger)
+	if synthesisRequestsErr != nil {
+		return nil, synthesisRequestsErr
+	}
+	contentHash := speechContentHash(synthesisRequests)
+
+	// Pass the info along, but ignore the user content
+	configEntry.Episode = ""
+
+	// If only properties such as the title changed, keep the audio and
+	// just update the manifest
+	unchangedTask := unchangedEpisodeTask(blobStore,
+		&configEntry,
+		bucket,
+		key,
+		contentHash,
+		logger)
+	if unchangedTask != nil {
+		logger.WithFields(logrus.Fields{
+			"key":         key,
+			"contentHash": contentHash,
+		}).Info("Speech content is unchanged, skipping synthesis")
+		createMetadataErr := newCreateMetadataTask(unchangedTask, blobStore, now, logger)()
+		if createMetadataErr != nil {
+			return nil, createMetadataErr
+		}
+		publishAtErr := setPublishAt(unchangedTask)
+		if publishAtErr != nil {
+			return nil, publishAtErr
+		}
+		return unchangedTask, nil
+	}
+
+	synthesisParts, synthesisPartsErr := startSynthesisRequests(synthesisRequests,
+		synthesisRequestSpeakers,
+		synthesizer,
+		logger)
+	if synthesisPartsErr != nil {
+		return nil, synthesisPartsErr
+	}
+	taskStatus := &SpartaCastTask{
+		SynthesisTask: synthesisParts[0].SynthesisTask,
+		Bucket:        bucket,
+		Item:          &configEntry,
+		Key:           key,
+		ContentHash:   contentHash,
+	}
+	if len(synthesisParts) > 1 {
+		taskStatus.Parts = synthesisParts
+	}
+	return taskStatus, nil
+}
+
+// copySourceKey returns the key of a CopyObject's x-amz-copy-source, which
+// is a URL encoded bucket/key with an optional versionId, if it's in the
+// same bucket
+func copySourceKey(bucket string, copySource string) string {
+	sourcePath := strings.SplitN(copySource, "?", 2)[0]
+	unescapedPath, unescapedPathErr := url.PathUnescape(strings.TrimPrefix(sourcePath, "/"))
+	if unescapedPathErr != nil {
+		return ""
+	}
+	pathParts := strings.SplitN(unescapedPath, "/", 2)
+	if len(pathParts) != 2 || pathParts[0] != bucket {
+		return ""
+	}
+	return pathParts[1]
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 /*
   ___      _             _
@@ -36,6 +374,8 @@ func valOrDefault(value string, defVal string) *string {
 // Handle the S3 state change function
 type handleEpisodeS3StateChangeTask struct {
 	s3BucketResourceName string
+	newSynthesizer       speechSynthesizerConstructor
+	newBlobStore         blobStoreConstructor
 }
 
 func (lambda *handleEpisodeS3StateChangeTask) Name() string {
@@ -55,60 +395,47 @@ func (lambda *handleEpisodeS3StateChangeTask) Handler() interface{} {
 			return nil, fmt.Errorf("Failed to extract AWS Session")
 		}
 
-		// Parse the input. If it's a feed.md, then it's a feed,
-		// otherwise it's an episode...
-		configEntry := Item{}
-		configEntryErr := unmarshalSpartaCastConfigFromS3(awsSession,
-			ctEvent.Detail.RequestParameters.BucketName,
+		// Don't synthesize a duplicate event a second time
+		now := contextClock(ctx).Now()
+		blobStore := lambda.newBlobStore(awsSession, ctEvent.Detail.RequestParameters.BucketName)
+		duplicateEvent, duplicateEventErr := claimEpisodeEvent(blobStore,
 			ctEvent.Detail.RequestParameters.Key,
-			&configEntry,
-			logger,
-		)
-		if configEntryErr != nil {
-			return nil, configEntryErr
-		}
-
-		// Tell Polly to create it and dump it in the /public folder
-		// It's SSML iff it starts with a <speak> tag....
-		isSSML := strings.HasPrefix("<speak>", configEntry.Episode)
-		logger.WithFields(logrus.Fields{
-			"value":  configEntry.Episode,
-			"isSSML": isSSML,
-		}).Debug("User Text")
-
-		outputKeyPrefix := fmt.Sprintf("%s/%s/%s",
-			PublicKeyPath,
-			KeyComponentFeed,
-			ctEvent.Detail.RequestParameters.Key)
-
-		pollyService := polly.New(awsSession)
-		textType := polly.TextTypeText
-		if isSSML {
-			textType = polly.TextTypeSsml
+			ctEvent.Detail.EventID,
+			now,
+			logger)
+		if duplicateEventErr != nil {
+			return nil, duplicateEventErr
 		}
-		pollyInput := &polly.StartSpeechSynthesisTaskInput{
-			OutputFormat:       aws.String(polly.OutputFormatMp3),
-			OutputS3BucketName: aws.String(ctEvent.Detail.RequestParameters.BucketName),
-			OutputS3KeyPrefix:  aws.String(outputKeyPrefix),
-			VoiceId:            valOrDefault(configEntry.PollyVoiceID, polly.VoiceIdJoanna),
-			Engine:             valOrDefault(configEntry.PollyEngineType, polly.EngineNeural),
-			LanguageCode:       valOrDefault(configEntry.PollyLanguageCode, polly.LanguageCodeEnUs),
-			Text:               aws.String(configEntry.Episode),
-			TextType:           aws.String(textType),
+		if duplicateEvent {
+			return &SpartaCastTask{
+				Bucket:         ctEvent.Detail.RequestParameters.BucketName,
+				Key:            ctEvent.Detail.RequestParameters.Key,
+				DuplicateEvent: true,
+			}, nil
 		}
 
-		pollyResp, pollyRespErr := pollyService.StartSpeechSynthesisTask(pollyInput)
-		if pollyRespErr != nil {
-			return nil, pollyRespErr
+		taskStatus, taskStatusErr := newEpisodeTask(blobStore,
+			lambda.newSynthesizer(awsSession),
+			ctEvent.Detail.RequestParameters.BucketName,
+			ctEvent.Detail.RequestParameters.Key,
+			now,
+			logger)
+		if taskStatusErr != nil {
+			return nil, failEpisodeEvent(blobStore,
+				&SpartaCastTask{
+					Key:     ctEvent.Detail.RequestParameters.Key,
+					EventID: ctEvent.Detail.EventID,
+				},
+				taskStatusErr,
+				logger)
 		}
-
-		// Pass the info along, but ignore the user content
-		configEntry.Episode = ""
-		taskStatus := &SpartaCastTask{
-			SynthesisTask: pollyResp.SynthesisTask,
-			Bucket:        ctEvent.Detail.RequestParameters.BucketName,
-			Item:          &configEntry,
-			Key:           ctEvent.Detail.RequestParameters.Key,
+		taskStatus.EventID = ctEvent.Detail.EventID
+		// A copied episode may be the first half of a rename
+		taskStatus.CopySource = copySourceKey(ctEvent.Detail.RequestParameters.BucketName,
+			ctEvent.Detail.RequestParameters.CopySource)
+		storeErr := storeState(taskStatus, blobStore)
+		if storeErr != nil {
+			return nil, failEpisodeEvent(blobStore, taskStatus, storeErr, logger)
 		}
 		// Return the SpartaCastTask item along the State machine
 		return taskStatus, nil
@@ -127,6 +454,10 @@ func (lambda *handleEpisodeS3StateChangeTask) Role() interface{} {
 			},
 			Resource: spartaCF.S3AllKeysArnForBucket(gocf.Ref(lambda.s3BucketResourceName)),
 		},
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"s3:ListBucket"},
+			Resource: gocf.GetAtt(lambda.s3BucketResourceName, "Arn"),
+		},
 		sparta.IAMRolePrivilege{
 			Actions:  []string{"polly:*"},
 			Resource: "*",
@@ -139,5 +470,7 @@ func (lambda *handleEpisodeS3StateChangeTask) Role() interface{} {
 func newHandleEpisodeS3EventTask(s3BucketResourceName string) sparta.AWSLambdaProvider {
 	return &handleEpisodeS3StateChangeTask{
 		s3BucketResourceName: s3BucketResourceName,
+		newSynthesizer:       NewPollySynthesizer,
+		newBlobStore:         NewS3BlobStore,
 	}
 }
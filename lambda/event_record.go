@@ -0,0 +1,172 @@
+package lambda
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// duplicateEventWindow is how long an upload of the same content as the
+// last claimed event is a duplicate. The console often calls PutObject
+// more than once per upload. Afterwards the same content is synthesized
+// again, which the content hash skips if the audio is current.
+const duplicateEventWindow = 10 * time.Minute
+
+const (
+	// eventStatusClaimed is the status of an event whose execution is
+	// synthesizing the episode or has finished it
+	eventStatusClaimed = "claimed"
+	// eventStatusFailed is the status of an event whose execution failed.
+	// It no longer makes its redeliveries or uploads duplicates.
+	eventStatusFailed = "failed"
+)
+
+// episodeEventRecord is the last event that claimed the synthesis of an
+// episode
+type episodeEventRecord struct {
+	EventID string
+	ETag    string
+	Time    string
+	Status  string
+}
+
+func eventRecordKeyPath(baseKeyName string) string {
+	return fmt.Sprintf("%s/%s/%s.json",
+		StateKeyPath,
+		KeyComponentEvents,
+		baseKeyName)
+}
+
+// isDuplicate returns true if the event with the source ETag repeats the
+// recorded event. EventBridge delivers events at least once, so the same
+// CloudTrail eventID can arrive again.
+func (record *episodeEventRecord) isDuplicate(eventID string, etag string, now time.Time) bool {
+	if record.Status == eventStatusFailed {
+		return false
+	}
+	if eventID != "" && record.EventID == eventID {
+		return true
+	}
+	claimTime, claimTimeErr := time.Parse(time.RFC3339, record.Time)
+	return claimTimeErr == nil &&
+		record.ETag == etag &&
+		now.Sub(claimTime) < duplicateEventWindow
+}
+
+// claimEpisodeEvent records that the event is synthesizing the episode at
+// key and returns false, or returns true if the event is a duplicate. The
+// record is written conditionally, so of concurrent duplicates only one
+// claims it.
+func claimEpisodeEvent(blobStore BlobStore,
+	key string,
+	eventID string,
+	now time.Time,
+	logger *logrus.Logger) (bool, error) {
+
+	sourceInfo, sourceInfoErr := blobStore.Head(key)
+	if sourceInfoErr != nil {
+		return false, sourceInfoErr
+	}
+	recordKey := eventRecordKeyPath(key)
+	for i := 0; i != 3; i++ {
+		recordETag := ""
+		recordBytes, recordInfo, recordErr := blobStore.Get(recordKey)
+		if recordErr == nil {
+			record := episodeEventRecord{}
+			unmarshalErr := json.Unmarshal(recordBytes, &record)
+			if unmarshalErr == nil && record.isDuplicate(eventID, sourceInfo.ETag, now) {
+				logger.WithFields(logrus.Fields{
+					"key":     key,
+					"eventID": eventID,
+					"etag":    sourceInfo.ETag,
+					"record":  record,
+				}).Info("Duplicate event")
+				return true, nil
+			}
+			recordETag = recordInfo.ETag
+		} else if !errors.Is(recordErr, ErrBlobNotFound) {
+			return false, recordErr
+		}
+
+		recordBytes, recordBytesErr := json.Marshal(&episodeEventRecord{
+			EventID: eventID,
+			ETag:    sourceInfo.ETag,
+			Time:    now.UTC().Format(time.RFC3339),
+			Status:  eventStatusClaimed,
+		})
+		if recordBytesErr != nil {
+			return false, recordBytesErr
+		}
+		_, putErr := blobStore.PutIfMatch(recordKey, recordBytes, "application/json", recordETag)
+		if putErr == nil {
+			return false, nil
+		}
+		if !errors.Is(putErr, ErrBlobChanged) {
+			return false, putErr
+		}
+		// Another execution claimed it first, so check whether this
+		// event duplicates that one
+	}
+	return false, fmt.Errorf("Failed to claim event %s for %s: its record is contended", eventID, key)
+}
+
+// releaseEpisodeEvent marks the event's claim on the episode at key as
+// failed, so that a redelivery or an upload of the same content
+// synthesizes it again. A claim that a later event has taken over is left
+// alone.
+func releaseEpisodeEvent(blobStore BlobStore,
+	key string,
+	eventID string,
+	logger *logrus.Logger) error {
+
+	recordKey := eventRecordKeyPath(key)
+	recordBytes, recordInfo, recordErr := blobStore.Get(recordKey)
+	if errors.Is(recordErr, ErrBlobNotFound) {
+		return nil
+	}
+	if recordErr != nil {
+		return recordErr
+	}
+	record := episodeEventRecord{}
+	unmarshalErr := json.Unmarshal(recordBytes, &record)
+	if unmarshalErr != nil {
+		return unmarshalErr
+	}
+	if record.EventID != eventID || record.Status == eventStatusFailed {
+		return nil
+	}
+	record.Status = eventStatusFailed
+	releasedBytes, releasedBytesErr := json.Marshal(&record)
+	if releasedBytesErr != nil {
+		return releasedBytesErr
+	}
+	_, putErr := blobStore.PutIfMatch(recordKey, releasedBytes, "application/json", recordInfo.ETag)
+	if putErr != nil && !errors.Is(putErr, ErrBlobChanged) {
+		return putErr
+	}
+	logger.WithFields(logrus.Fields{
+		"key":     key,
+		"eventID": eventID,
+	}).Info("Released event")
+	return nil
+}
+
+// failEpisodeEvent releases the claim of the task's event and returns the
+// error that failed the execution
+func failEpisodeEvent(blobStore BlobStore,
+	input *SpartaCastTask,
+	taskErr error,
+	logger *logrus.Logger) error {
+
+	releaseErr := releaseEpisodeEvent(blobStore, input.Key, input.EventID, logger)
+	if releaseErr != nil {
+		logger.WithFields(logrus.Fields{
+			"key":   input.Key,
+			"error": releaseErr,
+		}).Warn("Failed to release event")
+	}
+	return taskErr
+}
@@ -0,0 +1,76 @@
+package lambda
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	sparta "github.com/mweagle/Sparta"
+)
+
+func TestLocalBlobStorePutIfMatch(t *testing.T) {
+	blobStore, cleanup := testLocalBlobStore(t)
+	defer cleanup()
+
+	createInfo, createErr := blobStore.PutIfMatch("public/events/episode1.md.json", []byte("1"), "application/json", "")
+	if createErr != nil {
+		t.Fatalf("Failed to create blob: %s", createErr)
+	}
+	_, existsErr := blobStore.PutIfMatch("public/events/episode1.md.json", []byte("2"), "application/json", "")
+	if !errors.Is(existsErr, ErrBlobChanged) {
+		t.Fatalf("Expected ErrBlobChanged for an existing blob, got: %v", existsErr)
+	}
+	_, matchErr := blobStore.PutIfMatch("public/events/episode1.md.json", []byte("3"), "application/json", createInfo.ETag)
+	if matchErr != nil {
+		t.Fatalf("Failed to replace blob: %s", matchErr)
+	}
+	_, staleErr := blobStore.PutIfMatch("public/events/episode1.md.json", []byte("4"), "application/json", createInfo.ETag)
+	if !errors.Is(staleErr, ErrBlobChanged) {
+		t.Fatalf("Expected ErrBlobChanged for a stale ETag, got: %v", staleErr)
+	}
+	body, _, _ := blobStore.Get("public/events/episode1.md.json")
+	if string(body) != "3" {
+		t.Fatalf("Unexpected blob: %q", body)
+	}
+}
+
+func TestDuplicateEvent(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	clock := NewFakeClock(time.Now())
+	synthesizer := &FakeSynthesizer{}
+	executor := NewLocalExecutor(blobStore, synthesizer, logger)
+	executor.Clock = clock
+	execute := func(event json.RawMessage) string {
+		transitions, executeErr := executor.Execute(event)
+		if executeErr != nil {
+			t.Fatalf("Failed to execute: %s", executeErr)
+		}
+		return transitionStates(transitions)
+	}
+	event := testUploadEvent("episode1.md")
+	execute(event)
+	requests := len(synthesizer.Requests())
+
+	// A redelivered event stops before synthesis...
+	if states := execute(event); !strings.HasSuffix(states, StateCheckDuplicateEvent+" -> "+StateDuplicateEvent) {
+		t.Fatalf("Unexpected transitions for a redelivered event: %s", states)
+	}
+	// ...as does another event for the same content within the window
+	if states := execute(testUploadEvent("episode1.md")); !strings.HasSuffix(states, StateDuplicateEvent) {
+		t.Fatalf("Unexpected transitions for a repeated upload: %s", states)
+	}
+	if len(synthesizer.Requests()) != requests {
+		t.Fatalf("Expected no synthesis for duplicate events")
+	}
+
+	// Later, re-uploading the same content is handled again
+	clock.Sleep(duplicateEventWindow)
+	if states := execute(testUploadEvent("episode1.md")); !strings.HasSuffix(states, StateFeedGenerated) {
+		t.Fatalf("Unexpected transitions after the duplicate window: %s", states)
+	}
+}
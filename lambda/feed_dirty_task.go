@@ -0,0 +1,214 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	spartaCF "github.com/mweagle/Sparta/aws/cloudformation"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+// feedQuietPeriod is how long after the last finished episode the feed is
+// rebuilt. Episodes that finish within it share a single rebuild.
+const feedQuietPeriod = 1 * time.Minute
+
+// feedDirtyAttempts is how many times marking the feed dirty is retried
+// when other episodes finish at the same time
+const feedDirtyAttempts = 10
+
+// feedDirtyRetryDelay is the base delay before marking the feed dirty is
+// retried. Each retry waits a random time up to the attempt number times
+// the delay, so that a bulk upload's executions don't retry in lockstep.
+const feedDirtyRetryDelay = 200 * time.Millisecond
+
+// feedDirtyRecord tracks the finished episodes that aren't in the feed.xml
+// yet. Each finished episode increments Generation and the rebuild that
+// includes it sets RebuiltGeneration.
+type feedDirtyRecord struct {
+	Generation        int64
+	RebuiltGeneration int64
+	MarkedAt          string
+}
+
+func (record *feedDirtyRecord) isDirty() bool {
+	return record.Generation > record.RebuiltGeneration
+}
+
+func feedDirtyKeyPath() string {
+	return fmt.Sprintf("%s/%s/dirty.json", StateKeyPath, KeyComponentFeed)
+}
+
+// readFeedDirtyRecord returns the record and its ETag, or an empty record
+// if the feed was never marked dirty
+func readFeedDirtyRecord(blobStore BlobStore) (*feedDirtyRecord, string, error) {
+	record := &feedDirtyRecord{}
+	recordBytes, recordInfo, recordErr := blobStore.Get(feedDirtyKeyPath())
+	if errors.Is(recordErr, ErrBlobNotFound) {
+		return record, "", nil
+	}
+	if recordErr != nil {
+		return nil, "", recordErr
+	}
+	unmarshalErr := json.Unmarshal(recordBytes, record)
+	if unmarshalErr != nil {
+		return nil, "", unmarshalErr
+	}
+	return record, recordInfo.ETag, nil
+}
+
+// markFeedDirty records that an episode finished and returns the new
+// generation. The record is written conditionally, so that of the
+// executions that finish at once each increments the generation.
+func markFeedDirty(blobStore BlobStore,
+	clock Clock,
+	logger *logrus.Logger) (int64, error) {
+	for i := 0; i != feedDirtyAttempts; i++ {
+		if i != 0 {
+			clock.Sleep(time.Duration(rand.Int63n(int64(i) * int64(feedDirtyRetryDelay))))
+		}
+		record, recordETag, recordErr := readFeedDirtyRecord(blobStore)
+		if recordErr != nil {
+			return 0, recordErr
+		}
+		record.Generation++
+		record.MarkedAt = clock.Now().UTC().Format(time.RFC3339)
+		recordBytes, recordBytesErr := json.Marshal(record)
+		if recordBytesErr != nil {
+			return 0, recordBytesErr
+		}
+		_, putErr := blobStore.PutIfMatch(feedDirtyKeyPath(), recordBytes, "application/json", recordETag)
+		if putErr == nil {
+			logger.WithFields(logrus.Fields{
+				"generation": record.Generation,
+			}).Info("Marked feed dirty")
+			return record.Generation, nil
+		}
+		if !errors.Is(putErr, ErrBlobChanged) {
+			return 0, putErr
+		}
+	}
+	return 0, fmt.Errorf("Failed to mark %s dirty: its record is contended", feedKeyPath())
+}
+
+// rebuildDirtyFeed regenerates the feed.xml if it's dirty and returns
+// whether it did. With a generation, the rebuild is left to the execution
+// that marked a later one. Without one, as for the scheduled rebuild, a
+// feed that was marked dirty within the quiet period is left to the
+// execution that's waiting to rebuild it.
+func rebuildDirtyFeed(blobStore BlobStore,
+	generation int64,
+	now time.Time,
+	logger *logrus.Logger) (bool, error) {
+	record, recordETag, recordErr := readFeedDirtyRecord(blobStore)
+	if recordErr != nil {
+		return false, recordErr
+	}
+	logger.WithFields(logrus.Fields{
+		"generation": generation,
+		"record":     record,
+	}).Info("Checking dirty feed")
+	if !record.isDirty() {
+		return false, nil
+	}
+	if generation != 0 && generation != record.Generation {
+		return false, nil
+	}
+	if generation == 0 {
+		markedAt, markedAtErr := time.Parse(time.RFC3339, record.MarkedAt)
+		if markedAtErr == nil && now.Sub(markedAt) < feedQuietPeriod {
+			return false, nil
+		}
+	}
+	feedErr := generateFeed(blobStore, now, logger)
+	if feedErr != nil {
+		return false, feedErr
+	}
+
+	// If another episode finished while the feed was written, its
+	// execution rebuilds it again
+	record.RebuiltGeneration = record.Generation
+	recordBytes, recordBytesErr := json.Marshal(record)
+	if recordBytesErr != nil {
+		return false, recordBytesErr
+	}
+	_, putErr := blobStore.PutIfMatch(feedDirtyKeyPath(), recordBytes, "application/json", recordETag)
+	if putErr != nil && !errors.Is(putErr, ErrBlobChanged) {
+		return false, putErr
+	}
+	return true, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+/*
+  ___  _     _
+ |   \(_)_ _| |_ _  _
+ | |) | | '_|  _| || |
+ |___/|_|_|  \__|\_, |
+                 |__/
+*/
+////////////////////////////////////////////////////////////////////////////////
+// Handle a finished episode
+type handleMarkFeedDirtyTask struct {
+	s3BucketResourceName string
+	newBlobStore         blobStoreConstructor
+}
+
+func (lambda *handleMarkFeedDirtyTask) Name() string {
+	return HandleMarkFeedDirtyTaskName
+}
+
+func (lambda *handleMarkFeedDirtyTask) Handler() interface{} {
+	handler := func(ctx context.Context, input SpartaCastTask) (*SpartaCastTask, error) {
+		logInputEvent(ctx, input)
+
+		logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+		awsSession, _ := ctx.Value(sparta.ContextKeyAWSSession).(*session.Session)
+		if awsSession == nil {
+			return nil, fmt.Errorf("Failed to extract AWS Session")
+		}
+		clock := contextClock(ctx)
+		blobStore := lambda.newBlobStore(awsSession, input.Bucket)
+		generation, generationErr := markFeedDirty(blobStore, clock, logger)
+		if generationErr != nil {
+			return nil, failEpisodeEvent(blobStore, &input, generationErr, logger)
+		}
+		input.FeedGeneration = generation
+		input.RebuildAt = clock.Now().Add(feedQuietPeriod).UTC().Format(time.RFC3339)
+		return &input, nil
+	}
+	return handler
+}
+
+func (lambda *handleMarkFeedDirtyTask) Role() interface{} {
+	role := sparta.IAMRoleDefinition{}
+
+	role.Privileges = append(role.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions: []string{"s3:Get*",
+				"s3:Put*",
+			},
+			Resource: spartaCF.S3AllKeysArnForBucket(gocf.Ref(lambda.s3BucketResourceName)),
+		},
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"s3:ListBucket"},
+			Resource: gocf.GetAtt(lambda.s3BucketResourceName, "Arn"),
+		},
+	)
+	return role
+}
+
+// newHandleMarkFeedDirtyTask returns the handler that marks the feed dirty
+// when an episode finishes
+func newHandleMarkFeedDirtyTask(s3BucketResourceName string) sparta.AWSLambdaProvider {
+	return &handleMarkFeedDirtyTask{
+		s3BucketResourceName: s3BucketResourceName,
+		newBlobStore:         NewS3BlobStore,
+	}
+}
@@ -4,15 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/eduncan911/podcast"
 	"github.com/jmespath/go-jmespath"
 	sparta "github.com/mweagle/Sparta"
@@ -21,36 +20,53 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// feedWriteAttempts is how many times feed.xml is regenerated when other
+// executions write it concurrently
+const feedWriteAttempts = 5
+
 type feedMetadata struct {
 	feed    *Feed
 	entries []*Item
+	// feedETag is the ETag of the feed.xml that was current before the
+	// entries were listed, or empty if there wasn't one
+	feedETag string
+}
+
+func feedKeyPath() string {
+	return fmt.Sprintf("%s/%s/feed.xml",
+		PublicKeyPath,
+		KeyComponentFeed)
 }
 
-func readFeedMetadata(awsSession *session.Session,
-	bucket string,
+func readFeedMetadata(blobStore BlobStore,
 	logger *logrus.Logger) (*feedMetadata, error) {
 	var entryMap sync.Map
 	var entryErrorMap sync.Map
 
 	selfURL := func(keyname string) string {
-		return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s/feed/%s",
-			bucket,
-			*awsSession.Config.Region,
+		return blobStore.URL(fmt.Sprintf("%s/feed/%s",
 			PublicKeyPath,
-			keyname)
+			keyname))
 	}
 
 	feedMetadata := &feedMetadata{
 		entries: []*Item{},
 	}
+	// Note the current feed before listing, so that a feed written from
+	// a newer listing isn't overwritten
+	feedInfo, feedInfoErr := blobStore.Head(feedKeyPath())
+	if feedInfoErr == nil {
+		feedMetadata.feedETag = feedInfo.ETag
+	} else if !errors.Is(feedInfoErr, ErrBlobNotFound) {
+		return nil, feedInfoErr
+	}
 
 	var wg sync.WaitGroup
 	// Unmarshal the feed...
 	wg.Add(1)
-	go func(awsSession *session.Session) {
+	go func() {
 		feedItem := Feed{}
-		unmarshalErr := unmarshalSpartaCastConfigFromS3(awsSession,
-			bucket,
+		unmarshalErr := unmarshalSpartaCastConfigFromBlobStore(blobStore,
 			FeedConfigName,
 			&feedItem,
 			logger)
@@ -67,67 +83,52 @@ func readFeedMetadata(awsSession *session.Session,
 			"feedItem": feedMetadata.feed,
 		}).Debug("Unmarshalled feed")
 		wg.Done()
-	}(awsSession)
+	}()
 
 	// Read all the entries in the metadata key prefix and add them
-	s3Svc := s3.New(awsSession)
-	listObjectsInput := &s3.ListObjectsInput{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(fmt.Sprintf("%s/%s/",
-			PublicKeyPath,
-			KeyComponentMetadata)),
+	metadataBlobs, metadataBlobsErr := blobStore.List(fmt.Sprintf("%s/%s/",
+		PublicKeyPath,
+		KeyComponentMetadata))
+	if metadataBlobsErr != nil {
+		return nil, metadataBlobsErr
 	}
-	for {
-		listObjectsOutputResp, listObjectsOutputRespErr := s3Svc.ListObjects(listObjectsInput)
-		if listObjectsOutputRespErr != nil {
-			return nil, listObjectsOutputRespErr
-		}
-		if listObjectsOutputResp.Contents != nil {
-			for _, eachObject := range listObjectsOutputResp.Contents {
-				if *eachObject.Key != FeedConfigName &&
-					strings.HasSuffix(*eachObject.Key, ".json") {
-					wg.Add(1)
-					go func(awsSession *session.Session, obj *s3.Object) {
-						taskItem := SpartaCastTask{}
-						unmarshalErr := unmarshalFromS3Object(awsSession,
-							bucket,
-							*obj.Key,
-							&taskItem,
-							logger)
-						if unmarshalErr != nil {
-							entryErrorMap.LoadOrStore(*obj.Key, unmarshalErr)
-						} else {
-							logger.WithFields(logrus.Fields{
-								"keyName": *obj.Key,
-								"entry":   taskItem,
-							}).Error("Failed to add entry")
-							taskItem.Item.SelfLink = selfURL(*obj.Key)
-							entryMap.LoadOrStore(*obj.Key, &taskItem)
-						}
-						wg.Done()
-					}(awsSession, eachObject)
+	for _, eachBlob := range metadataBlobs {
+		if eachBlob.Key != FeedConfigName &&
+			strings.HasSuffix(eachBlob.Key, ".json") {
+			wg.Add(1)
+			go func(keyName string) {
+				taskItem := SpartaCastTask{}
+				unmarshalErr := unmarshalFromBlobStore(blobStore,
+					keyName,
+					&taskItem,
+					logger)
+				if unmarshalErr != nil {
+					entryErrorMap.LoadOrStore(keyName, unmarshalErr)
+				} else {
+					logger.WithFields(logrus.Fields{
+						"keyName": keyName,
+						"entry":   taskItem,
+					}).Error("Failed to add entry")
+					taskItem.Item.SelfLink = selfURL(keyName)
+					entryMap.LoadOrStore(keyName, &taskItem)
 				}
-			}
-		}
-
-		if *listObjectsOutputResp.IsTruncated == false {
-			break
+				wg.Done()
+			}(eachBlob.Key)
 		}
-		listObjectsInput.Marker = listObjectsOutputResp.Marker
 	}
 	wg.Wait()
 
 	// Unmarshal everything...
-	errors := []string{}
+	entryErrors := []string{}
 	entryErrorMap.Range(func(keyName interface{}, err interface{}) bool {
-		errors = append(errors,
+		entryErrors = append(entryErrors,
 			fmt.Sprintf("Keypath <%s> failed with error %v",
 				keyName,
 				err))
 		return true
 	})
-	if len(errors) != 0 {
-		return nil, fmt.Errorf("Failed to unmarshal: %#v", errors)
+	if len(entryErrors) != 0 {
+		return nil, fmt.Errorf("Failed to unmarshal: %#v", entryErrors)
 	}
 	//
 	entryMap.Range(func(keyName interface{}, task interface{}) bool {
@@ -175,6 +176,7 @@ func newEntry(entry *Item) (*podcast.Item, error) {
 		return nil, entryPubDateErr
 	}
 	item := podcast.Item{
+		GUID:        entry.GUID,
 		Title:       entry.Title,
 		Link:        entry.SelfLink,
 		Description: entry.Description,
@@ -187,21 +189,28 @@ func newEntry(entry *Item) (*podcast.Item, error) {
 	item.IImage = &podcast.IImage{
 		HREF: entry.Image,
 	}
+	summary := entry.Summary
+	if summary == "" {
+		summary = entry.Description
+	}
 	item.ISummary = &podcast.ISummary{
-		Text: entry.Description,
+		Text: summary,
 	}
 	item.Link = entry.Link
 
 	return &item, nil
 }
 
-func createFeed(awsSession *session.Session,
+// createFeed writes the feed.xml. Scheduled entries that aren't published
+// as of now are left out. It returns ErrBlobChanged if another execution
+// wrote the feed.xml since the metadata was read.
+func createFeed(blobStore BlobStore,
 	metadata *feedMetadata,
-	bucketName string,
+	now time.Time,
 	logger *logrus.Logger) error {
 	pubDate, pubDateErr := time.Parse(time.RFC3339, metadata.feed.PubDate)
 	if pubDateErr != nil {
-		pubDate = time.Now()
+		pubDate = now
 	}
 
 	pc := podcast.New(
@@ -219,6 +228,14 @@ func createFeed(awsSession *session.Session,
 
 	// Do the same for each entry
 	for _, eachEntry := range metadata.entries {
+		publishTime, publishTimeErr := eachEntry.publishTime()
+		if publishTimeErr == nil && publishTime.After(now) {
+			logger.WithFields(logrus.Fields{
+				"title":     eachEntry.Title,
+				"publishAt": publishTime,
+			}).Info("Skipping scheduled entry")
+			continue
+		}
 		// create an Item
 		pcItem, pcItemErr := newEntry(eachEntry)
 		if pcItemErr != nil {
@@ -243,25 +260,45 @@ func createFeed(awsSession *session.Session,
 	}
 
 	// Ship it...
-	s3PutObjectInput := &s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key: aws.String(fmt.Sprintf("%s/%s/feed.xml",
-			PublicKeyPath,
-			KeyComponentFeed)),
-		Body:        bytes.NewReader(byteSink.Bytes()),
-		ContentType: aws.String("application/rss+xml"),
-	}
-	s3Svc := s3.New(awsSession)
-	s3PutObjectResp, s3PutObjectRespErr := s3Svc.PutObject(s3PutObjectInput)
-	if s3PutObjectRespErr != nil {
-		return s3PutObjectRespErr
+	putResp, putRespErr := blobStore.PutIfMatch(feedKeyPath(),
+		byteSink.Bytes(),
+		"application/rss+xml",
+		metadata.feedETag)
+	if putRespErr != nil {
+		return putRespErr
 	}
 	logger.WithFields(logrus.Fields{
-		"feed": *s3PutObjectResp,
+		"feed": *putResp,
 	}).Info("Feed created")
 	return nil
 }
 
+// generateFeed reads the feed metadata and writes the feed.xml. When
+// several executions generate the feed at once, the writers holding a
+// stale listing lose the conditional write and read the metadata again,
+// so the last feed written includes every manifest.
+func generateFeed(blobStore BlobStore,
+	now time.Time,
+	logger *logrus.Logger) error {
+	for i := 0; i != feedWriteAttempts; i++ {
+		metadata, metadataErr := readFeedMetadata(blobStore, logger)
+		if metadataErr != nil {
+			return metadataErr
+		}
+		createErr := createFeed(blobStore, metadata, now, logger)
+		if !errors.Is(createErr, ErrBlobChanged) {
+			return createErr
+		}
+		logger.WithFields(logrus.Fields{
+			"attempt":  i + 1,
+			"feedETag": metadata.feedETag,
+		}).Warn("Feed was written concurrently, regenerating")
+	}
+	return fmt.Errorf("Failed to write %s after %d concurrent updates",
+		feedKeyPath(),
+		feedWriteAttempts)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 /*
   ___           _
@@ -273,6 +310,7 @@ func createFeed(awsSession *session.Session,
 // Handle the S3 state change function
 type handleFeedTask struct {
 	s3BucketResourceName string
+	newBlobStore         blobStoreConstructor
 }
 
 func (lambda *handleFeedTask) Name() string {
@@ -282,16 +320,16 @@ func (lambda *handleFeedTask) Name() string {
 func (lambda *handleFeedTask) Handler() interface{} {
 	// How to get the bucket unless it's in the message?
 	// Thinking...
-	handler := func(ctx context.Context, input json.RawMessage) error {
+	handler := func(ctx context.Context, input json.RawMessage) (*SpartaCastTask, error) {
 		////////////////////////////////////////////////////////////////////////
 		// Setup some props
 		logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
 		if logger == nil {
-			return fmt.Errorf("Failed to extract Logger instance")
+			return nil, fmt.Errorf("Failed to extract Logger instance")
 		}
 		awsSession, _ := ctx.Value(sparta.ContextKeyAWSSession).(*session.Session)
 		if awsSession == nil {
-			return fmt.Errorf("Failed to extract AWS Session")
+			return nil, fmt.Errorf("Failed to extract AWS Session")
 		}
 		////////////////////////////////////////////////////////////////////////
 
@@ -309,7 +347,7 @@ func (lambda *handleFeedTask) Handler() interface{} {
 		var data interface{}
 		unmarshalErr := json.Unmarshal(input, &data)
 		if unmarshalErr != nil {
-			return unmarshalErr
+			return nil, unmarshalErr
 		}
 		// Ok, so this is either a SpartaTask or a CloudWatchEvent...
 		// We'll use JMESPath to get the bucket s.t. we can do the
@@ -330,11 +368,22 @@ func (lambda *handleFeedTask) Handler() interface{} {
 
 		// Great, so we have the bucket and we just need to create the feed. So let's go ahead
 		// and make that...
-		feedMetadata, feedMetadataErr := readFeedMetadata(awsSession, bucketName, logger)
-		if feedMetadataErr != nil {
-			return feedMetadataErr
+		blobStore := lambda.newBlobStore(awsSession, bucketName)
+		now := contextClock(ctx).Now()
+		task.Bucket = bucketName
+		task.FeedRebuildDeferred = false
+
+		// A finished episode, or the scheduled rule, only rebuilds a dirty
+		// feed. Uploading the feed.md or deleting episodes always does.
+		if task.FeedGeneration != 0 || ctEvent.Detail.EventName == EventNameRebuildFeed {
+			rebuilt, rebuiltErr := rebuildDirtyFeed(blobStore, task.FeedGeneration, now, logger)
+			if rebuiltErr != nil {
+				return nil, rebuiltErr
+			}
+			task.FeedRebuildDeferred = !rebuilt
+			return &task, nil
 		}
-		return createFeed(awsSession, feedMetadata, bucketName, logger)
+		return &task, generateFeed(blobStore, now, logger)
 	}
 	return handler
 }
@@ -363,5 +412,6 @@ func (lambda *handleFeedTask) Role() interface{} {
 func newHandleFeedTask(s3BucketResourceName string) sparta.AWSLambdaProvider {
 	return &handleFeedTask{
 		s3BucketResourceName: s3BucketResourceName,
+		newBlobStore:         NewS3BlobStore,
 	}
 }
@@ -0,0 +1,169 @@
+package lambda
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sparta "github.com/mweagle/Sparta"
+)
+
+func TestConcurrentFeedWrites(t *testing.T) {
+	blobStore, cleanup := testLocalBlobStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	feedBytes, feedBytesErr := ioutil.ReadFile(testFile("feed.md"))
+	if feedBytesErr != nil {
+		t.Fatalf("Failed to read feed: %s", feedBytesErr)
+	}
+	blobStore.Put(FeedConfigName, feedBytes, "")
+	putManifest := func(key string, guid string) {
+		manifestBytes, _ := json.Marshal(&SpartaCastTask{
+			Key: key,
+			Item: &Item{
+				Title:               key,
+				Description:         "Episode " + key,
+				GUID:                guid,
+				PubDate:             "2020-01-02T03:04:05Z",
+				EnclosureLink:       blobStore.URL("public/feed/" + key + ".full.mp3"),
+				EnclosureByteLength: 1024,
+			},
+		})
+		blobStore.Put(manifestKeyPath(key), manifestBytes, "application/json")
+	}
+	putManifest("episode1.md", "episode-guid-1")
+
+	// A slow writer lists the manifests...
+	staleMetadata, staleMetadataErr := readFeedMetadata(blobStore, logger)
+	if staleMetadataErr != nil {
+		t.Fatalf("Failed to read feed metadata: %s", staleMetadataErr)
+	}
+	// ...while another episode finishes and its feed is written
+	putManifest("episode2.md", "episode-guid-2")
+	generateErr := generateFeed(blobStore, time.Now(), logger)
+	if generateErr != nil {
+		t.Fatalf("Failed to generate feed: %s", generateErr)
+	}
+
+	// The stale listing doesn't replace the newer feed
+	createErr := createFeed(blobStore, staleMetadata, time.Now(), logger)
+	if !errors.Is(createErr, ErrBlobChanged) {
+		t.Fatalf("Expected ErrBlobChanged for a stale feed, got: %v", createErr)
+	}
+	feedXML, _, _ := blobStore.Get(feedKeyPath())
+	for _, eachGUID := range []string{"episode-guid-1", "episode-guid-2"} {
+		if !strings.Contains(string(feedXML), eachGUID) {
+			t.Fatalf("Expected the feed to include %s:\n%s", eachGUID, feedXML)
+		}
+	}
+}
+
+func TestDebouncedFeedRebuild(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	rebuild := func(generation int64, now time.Time) bool {
+		rebuilt, rebuiltErr := rebuildDirtyFeed(blobStore, generation, now, logger)
+		if rebuiltErr != nil {
+			t.Fatalf("Failed to rebuild feed: %s", rebuiltErr)
+		}
+		return rebuilt
+	}
+	// Two episodes finish close together...
+	start := time.Now().Truncate(time.Second)
+	firstGeneration, firstErr := markFeedDirty(blobStore, NewFakeClock(start), logger)
+	secondGeneration, secondErr := markFeedDirty(blobStore, NewFakeClock(start.Add(10*time.Second)), logger)
+	if firstErr != nil || secondErr != nil {
+		t.Fatalf("Failed to mark feed dirty: %v, %v", firstErr, secondErr)
+	}
+
+	// ...so the first defers to the second
+	if rebuild(firstGeneration, start.Add(feedQuietPeriod)) {
+		t.Fatalf("Expected the first episode to defer the rebuild")
+	}
+	// The scheduled rebuild leaves it to the waiting execution too
+	if rebuild(0, start.Add(20*time.Second)) {
+		t.Fatalf("Expected the scheduled rebuild to wait for the quiet period")
+	}
+	_, feedInfoErr := blobStore.Head(feedKeyPath())
+	if !errors.Is(feedInfoErr, ErrBlobNotFound) {
+		t.Fatalf("Expected no feed.xml before the rebuild, got: %v", feedInfoErr)
+	}
+	if !rebuild(secondGeneration, start.Add(10*time.Second+feedQuietPeriod)) {
+		t.Fatalf("Expected the last episode to rebuild the feed")
+	}
+	_, feedInfoErr = blobStore.Head(feedKeyPath())
+	if feedInfoErr != nil {
+		t.Fatalf("Failed to find feed.xml: %s", feedInfoErr)
+	}
+
+	// A clean feed isn't rebuilt by the scheduled rule...
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{}, logger)
+	executor.Clock = NewFakeClock(start.Add(time.Hour))
+	scheduledRebuild := func() *SpartaCastTask {
+		output, outputErr := executor.Invoke(HandleFeedTaskName, testEvent(EventNameRebuildFeed, "", ""))
+		if outputErr != nil {
+			t.Fatalf("Failed to invoke %s: %s", HandleFeedTaskName, outputErr)
+		}
+		task := &SpartaCastTask{}
+		unmarshalErr := json.Unmarshal(output, task)
+		if unmarshalErr != nil {
+			t.Fatalf("Failed to unmarshal output: %s", unmarshalErr)
+		}
+		return task
+	}
+	if !scheduledRebuild().FeedRebuildDeferred {
+		t.Fatalf("Expected the scheduled rebuild to skip a clean feed")
+	}
+	// ...but it picks up one whose execution failed
+	_, thirdErr := markFeedDirty(blobStore, NewFakeClock(start.Add(time.Minute)), logger)
+	if thirdErr != nil {
+		t.Fatalf("Failed to mark feed dirty: %s", thirdErr)
+	}
+	if scheduledRebuild().FeedRebuildDeferred {
+		t.Fatalf("Expected the scheduled rebuild to rebuild a dirty feed")
+	}
+	if strings.HasPrefix(feedDirtyKeyPath(), PublicKeyPath+"/") {
+		t.Fatalf("Expected the dirty record to be private: %s", feedDirtyKeyPath())
+	}
+}
+
+func TestConcurrentMarkFeedDirty(t *testing.T) {
+	blobStore, cleanup := testLocalBlobStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("warn")
+
+	// A bulk upload's executions mark the feed dirty at once, and each
+	// gets its own generation
+	const executions = 8
+	clock := NewFakeClock(time.Now())
+	generations := make(chan int64, executions)
+	var wg sync.WaitGroup
+	for i := 0; i != executions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			generation, generationErr := markFeedDirty(blobStore, clock, logger)
+			if generationErr != nil {
+				t.Errorf("Failed to mark feed dirty: %s", generationErr)
+			}
+			generations <- generation
+		}()
+	}
+	wg.Wait()
+	close(generations)
+	seen := make(map[int64]bool)
+	for eachGeneration := range generations {
+		seen[eachGeneration] = true
+	}
+	record, _, recordErr := readFeedDirtyRecord(blobStore)
+	if recordErr != nil || record.Generation != executions || len(seen) != executions {
+		t.Fatalf("Expected %d distinct generations, got %v (%v)", executions, seen, recordErr)
+	}
+}
@@ -3,8 +3,8 @@ package lambda
 import (
 	"fmt"
 	"io"
-	"net/url"
 	"strings"
+	"time"
 
 	"github.com/mweagle/SpartaCast/markson"
 	"github.com/sirupsen/logrus"
@@ -15,12 +15,32 @@ const (
 	// public
 	PublicKeyPath = "public"
 
+	// StateKeyPath is the root of the private records
+	// the Step function keeps between executions
+	StateKeyPath = "state"
+
 	// KeyComponentFeed is the component for the mp3 output
 	KeyComponentFeed = "feed"
 
 	// KeyComponentMetadata is the component for the metadata JSON output
 	KeyComponentMetadata = "metadata"
 
+	// KeyComponentDeleted is the component for the tombstones of deleted
+	// episodes
+	KeyComponentDeleted = "deleted"
+
+	// KeyComponentEvents is the component for the record of the last event
+	// that synthesized each episode
+	KeyComponentEvents = "events"
+
+	// KeyComponentParts is the component for the synthesis parts of
+	// episodes with too many to pass between states
+	KeyComponentParts = "parts"
+
+	// KeyComponentItems is the component for the Items of episodes that
+	// are too large to pass between states
+	KeyComponentItems = "items"
+
 	// FeedConfigName is the name of the feed
 	FeedConfigName = "feed.md"
 
@@ -38,82 +58,165 @@ func manifestKeyPath(baseKeyName string) string {
 		baseKeyName)
 }
 
+func tombstoneKeyPath(baseKeyName string) string {
+	return fmt.Sprintf("%s/%s/%s.json",
+		StateKeyPath,
+		KeyComponentDeleted,
+		baseKeyName)
+}
+
+func partsKeyPath(baseKeyName string) string {
+	return fmt.Sprintf("%s/%s/%s.json",
+		StateKeyPath,
+		KeyComponentParts,
+		baseKeyName)
+}
+
+func itemKeyPath(baseKeyName string) string {
+	return fmt.Sprintf("%s/%s/%s.json",
+		StateKeyPath,
+		KeyComponentItems,
+		baseKeyName)
+}
+
 // ParseSpartaConfigSpec returns an EpisodeSpec input
 // and returns the data
 func ParseSpartaConfigSpec(input io.Reader,
 	configEntry interface{},
-	logger *logrus.Logger) error {
+	logger *logrus.Logger,
+	options ...markson.Option) error {
 
 	return markson.UnmarshalMarkson(input,
 		KeyProperties,
 		configEntry,
-		logger)
+		logger,
+		options...)
+}
+
+// MarshalSpartaConfigSpec returns the canonical Markdown representation
+// of a Feed or Item. It's the inverse of ParseSpartaConfigSpec and can be
+// used to scaffold or normalize source files.
+func MarshalSpartaConfigSpec(configEntry interface{}) ([]byte, error) {
+	return markson.Marshal(configEntry, KeyProperties)
 }
 
-// Feed represents the feed information from a Markdown file.
+// Feed represents the feed information from a Markdown file. The markson
+// tags name the Properties table keys and H1 sections, the JSON tags
+// the manifest representation.
 type Feed struct {
-	Title          string `json:"title,omitempty"`
-	AuthorName     string `json:"authorname"`
-	AuthorEmail    string `json:"authoremail"`
-	Image          string `json:"image,omitempty"`
-	Link           string `json:"link,omitempty"`
-	Description    string `json:"description,omitempty"`
-	Category       string `json:"category,omitempty"`
-	Subcategory    string `json:"subcategory,omitempty"`
-	Cloud          string `json:"cloud,omitempty"`
-	Copyright      string `json:"copyright,omitempty"`
-	Docs           string `json:"docs,omitempty"`
-	Generator      string `json:"generator,omitempty"`
-	Language       string `json:"language,omitempty"`
-	LastBuildDate  string `json:"lastBuildDate,omitempty"`
-	ManagingEditor string `json:"managingEditor,omitempty"`
-	PubDate        string `json:"pubDate,omitempty"`
-	Rating         string `json:"rating,omitempty"`
-	SkipHours      string `json:"skipHours,omitempty"`
-	SkipDays       string `json:"skipDays,omitempty"`
-	SubTitle       string `json:"subtitle"`
-	TTL            string `json:"ttl,omitempty"`
-	WebMaster      string `json:"webMaster,omitempty"`
-	IAuthor        string `json:"itunes:author,omitempty"`
-	IExplicit      string `json:"itunes:explicit,omitempty"`
-	IComplete      string `json:"itunes:complete,omitempty"`
+	Title          string `json:"title,omitempty" markson:"title"`
+	AuthorName     string `json:"authorname" markson:"authorname"`
+	AuthorEmail    string `json:"authoremail" markson:"authoremail"`
+	Image          string `json:"image,omitempty" markson:"image"`
+	Link           string `json:"link,omitempty" markson:"link"`
+	Description    string `json:"description,omitempty" markson:"description,section"`
+	Category       string `json:"category,omitempty" markson:"category"`
+	Subcategory    string `json:"subcategory,omitempty" markson:"subcategory"`
+	Cloud          string `json:"cloud,omitempty" markson:"cloud"`
+	Copyright      string `json:"copyright,omitempty" markson:"copyright"`
+	Docs           string `json:"docs,omitempty" markson:"docs"`
+	Generator      string `json:"generator,omitempty" markson:"generator"`
+	Language       string `json:"language,omitempty" markson:"language"`
+	LastBuildDate  string `json:"lastBuildDate,omitempty" markson:"lastBuildDate"`
+	ManagingEditor string `json:"managingEditor,omitempty" markson:"managingEditor"`
+	PubDate        string `json:"pubDate,omitempty" markson:"pubDate"`
+	Rating         string `json:"rating,omitempty" markson:"rating"`
+	SkipHours      string `json:"skipHours,omitempty" markson:"skipHours"`
+	SkipDays       string `json:"skipDays,omitempty" markson:"skipDays"`
+	SubTitle       string `json:"subtitle" markson:"subtitle"`
+	TTL            string `json:"ttl,omitempty" markson:"ttl"`
+	WebMaster      string `json:"webMaster,omitempty" markson:"webMaster"`
+	IAuthor        string `json:"itunes:author,omitempty" markson:"itunes:author"`
+	IExplicit      string `json:"itunes:explicit,omitempty" markson:"itunes:explicit"`
+	IComplete      string `json:"itunes:complete,omitempty" markson:"itunes:complete"`
 }
 
-// Item represents an item
+// Item represents an item. Fields tagged with markson:"-" are computed
+// during synthesis and cannot be set from the episode source.
 type Item struct {
-	SelfLink            string `json:"selfLink"`
-	Image               string `json:"image,omitempty"`
-	GUID                string `json:"guid"`
-	Title               string `json:"title"`
-	Link                string `json:"link"`
-	EnclosureLink       string `json:"enclosureLink"`
-	EnclosureByteLength int64  `json:"enclosureByteLength"`
-	Description         string `json:"description"`
-	AuthorName          string `json:"authorname"`
-	AuthorEmail         string `json:"authoremail"`
-	Category            string `json:"category"`
-	Comments            string `json:"comments"`
-	Source              string `json:"source"`
-	PubDate             string `json:"pubDate"`
-	SubTitle            string `json:"subtitle"`
-	IExplicit           string `json:"itunes:explicit"`
-	IIsClosedCaptioned  string `json:"itunes:isClosedCaptioned"`
-	IOrder              string `json:"itunes:order"`
-	PollyVoiceID        string `json:"polly:voiceID"`
-	PollyEngineType     string `json:"polly:engineType"`
-	PollyLanguageCode   string `json:"polly:languageCode"`
-	Episode             string `json:"episode"`
+	SelfLink            string    `json:"selfLink" markson:"-"`
+	Image               string    `json:"image,omitempty" markson:"image"`
+	GUID                string    `json:"guid" markson:"guid"`
+	Title               string    `json:"title" markson:"title"`
+	Summary             string    `json:"summary,omitempty" markson:"summary,section"`
+	Link                string    `json:"link" markson:"link"`
+	EnclosureLink       string    `json:"enclosureLink" markson:"-"`
+	EnclosureByteLength int64     `json:"enclosureByteLength" markson:"-"`
+	Description         string    `json:"description" markson:"description,section"`
+	AuthorName          string    `json:"authorname" markson:"authorname"`
+	AuthorEmail         string    `json:"authoremail" markson:"authoremail"`
+	Category            string    `json:"category" markson:"category"`
+	Comments            string    `json:"comments" markson:"comments"`
+	Source              string    `json:"source" markson:"source"`
+	PubDate             string    `json:"pubDate" markson:"pubDate"`
+	Updated             string    `json:"updated,omitempty" markson:"-"`
+	PublishAt           string    `json:"publishAt,omitempty" markson:"publishAt"`
+	SubTitle            string    `json:"subtitle" markson:"subtitle"`
+	IExplicit           string    `json:"itunes:explicit" markson:"itunes:explicit"`
+	IIsClosedCaptioned  string    `json:"itunes:isClosedCaptioned" markson:"itunes:isClosedCaptioned"`
+	IOrder              string    `json:"itunes:order" markson:"itunes:order"`
+	PollyVoiceID        string    `json:"polly:voiceID" markson:"polly:voiceID"`
+	PollyEngineType     string    `json:"polly:engineType" markson:"polly:engineType,oneof=standard|neural"`
+	PollyLanguageCode   string    `json:"polly:languageCode" markson:"polly:languageCode"`
+	Speakers            []Speaker `json:"speakers,omitempty" markson:"speakers"`
+	Episode             string    `json:"episode" markson:"episode,section,markdown"`
+	// EpisodeLine is the source line that the Episode Markdown starts on
+	EpisodeLine int `json:"-" markson:"-"`
 }
 
-func keyPathFromS3URI(s3URI string, bucketName string) (string, error) {
+// dateLayouts are the accepted formats of an episode's pubDate and
+// publishAt properties. Dates without a zone are UTC. Zone abbreviations
+// other than UTC and GMT are ambiguous, and time.Parse treats an unknown
+// one as a zero offset, so they're rejected.
+var dateLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.RFC822,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"January 2, 2006",
+	"Jan 2, 2006",
+	"2 January 2006",
+	"2 Jan 2006",
+}
 
-	parsedURI, parsedURIErr := url.Parse(s3URI)
-	if parsedURIErr != nil {
-		return "", parsedURIErr
-	}
-	strippedPath := strings.TrimPrefix(parsedURI.Path,
-		fmt.Sprintf("/%s/", bucketName))
+// zoneAbbreviationLayouts are the dateLayouts with a zone abbreviation
+var zoneAbbreviationLayouts = map[string]bool{
+	time.RFC1123: true,
+	time.RFC822:  true,
+}
 
-	return strippedPath, nil
+// parseDateProperty parses a date property in any of the dateLayouts and
+// returns it in RFC3339 format
+func parseDateProperty(propertyName string, value string) (string, error) {
+	trimmedValue := strings.TrimSpace(value)
+	for _, eachLayout := range dateLayouts {
+		parsedDate, parsedDateErr := time.Parse(eachLayout, trimmedValue)
+		if parsedDateErr != nil {
+			continue
+		}
+		if zoneAbbreviationLayouts[eachLayout] {
+			zoneName, _ := parsedDate.Zone()
+			if zoneName != "UTC" && zoneName != "GMT" {
+				return "", fmt.Errorf("Unsupported %s time zone: %s. Use UTC, GMT or a numeric "+
+					"offset such as Sun, 01 Mar 2020 10:00:00 -0800", propertyName, zoneName)
+			}
+		}
+		return parsedDate.Format(time.RFC3339), nil
+	}
+	return "", fmt.Errorf("Unsupported %s format: %s. Use a date such as 2020-03-01, "+
+		"2020-03-01T18:00:00Z or Sun, 01 Mar 2020 18:00:00 +0000", propertyName, value)
+}
 
+// publishTime returns when the item may appear in the feed. That's its
+// publishAt property if it's set, otherwise its pubDate.
+func (item *Item) publishTime() (time.Time, error) {
+	if item.PublishAt != "" {
+		return time.Parse(time.RFC3339, item.PublishAt)
+	}
+	return time.Parse(time.RFC3339, item.PubDate)
 }
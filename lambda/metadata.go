@@ -1,28 +1,171 @@
 package lambda
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
-	"io/ioutil"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/polly"
-	"github.com/aws/aws-sdk-go/service/s3"
 	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaCast/markson"
 	"github.com/sirupsen/logrus"
 )
 
+// SynthesisPart is one chunk of an episode that's synthesized in its own
+// Polly task, either because the episode is too long for a single task or
+// because it's a dialogue turn. ByteOffset and ByteLength locate the part's
+// audio frames in the concatenated enclosure.
+type SynthesisPart struct {
+	SynthesisTask *polly.SynthesisTask
+	Speaker       string `json:",omitempty"`
+	ByteOffset    int64
+	ByteLength    int64
+}
+
 // SpartaCastTask is the struct that is passed between
 // the PollyTaskCheck, Wait, and Choice states. The
 // Choice state will go to the FeedState if the Successful
-// property is true, otherwise it'll go back to the WaitState
+// property is true, otherwise it'll go back to the WaitState.
+// Parts is only set for episodes that are synthesized in more
+// than one task, in which case SynthesisTask is their aggregate
+// status.
 type SpartaCastTask struct {
 	Bucket        string
 	Key           string
 	SynthesisTask *polly.SynthesisTask
+	Parts         []*SynthesisPart `json:",omitempty"`
+	// PartsKey is the blob that holds the Parts while they're too large to
+	// pass between states. Step Functions limits state input and output to
+	// 256KB.
+	PartsKey string `json:",omitempty"`
+	Item     *Item
+	// ItemKey is the blob that holds the Item while it's too large to pass
+	// between states
+	ItemKey      string `json:",omitempty"`
+	WaitDuration int64
+	// PublishAt is when the waitForPublish state regenerates the feed
+	PublishAt string `json:",omitempty"`
+	// CopySource is the key that a copied, or renamed, episode was copied
+	// from
+	CopySource string `json:",omitempty"`
+	// ContentHash is the speechContentHash of the episode's synthesis
+	// requests
+	ContentHash string `json:",omitempty"`
+	// EventID is the CloudTrail event that claimed the episode. Its claim
+	// is released if the execution fails.
+	EventID string `json:",omitempty"`
+	// SynthesisSkipped is true if the speech content is unchanged and the
+	// existing audio is reused. The CheckSpeechContentChanged state
+	// requires it, so it's always marshalled.
+	SynthesisSkipped bool
+	// FeedConfigMissing is true if feed.md was deleted, in which case the
+	// CheckFeedConfig state ends the execution without a feed. It's always
+	// marshalled.
+	FeedConfigMissing bool
+	// DuplicateEvent is true if the event was already handled, in which
+	// case the CheckDuplicateEvent state ends the execution
+	DuplicateEvent bool
+	// FeedGeneration is the generation that the finished episode marked
+	// the feed dirty with
+	FeedGeneration int64 `json:",omitempty"`
+	// RebuildAt is when the waitForQuietPeriod state continues to the
+	// feed rebuild
+	RebuildAt string `json:",omitempty"`
+	// FeedRebuildDeferred is true if the feed is left for another
+	// execution to rebuild. The CheckFeedRebuilt state requires it, so it's
+	// always marshalled.
+	FeedRebuildDeferred bool
+}
+
+// episodeManifest is the public metadata of an episode. It's the
+// SpartaCastTask without the fields that only steer the execution, and
+// reads back into one.
+type episodeManifest struct {
+	Bucket        string
+	Key           string
+	SynthesisTask *polly.SynthesisTask
+	Parts         []*SynthesisPart `json:",omitempty"`
 	Item          *Item
-	WaitDuration  int64
+	ContentHash   string `json:",omitempty"`
+}
+
+// manifest returns the episode manifest of the task
+func (task *SpartaCastTask) manifest() *episodeManifest {
+	return &episodeManifest{
+		Bucket:        task.Bucket,
+		Key:           task.Key,
+		SynthesisTask: task.SynthesisTask,
+		Parts:         task.Parts,
+		Item:          task.Item,
+		ContentHash:   task.ContentHash,
+	}
+}
+
+// maxStatePartsBytes is the largest Parts list that's passed between
+// states. Larger ones are stored in the blob store.
+const maxStatePartsBytes = 128 * 1024
+
+// maxStateItemBytes is the largest Item that's passed between states. With
+// maxStatePartsBytes, it leaves room for the rest of the task within the
+// Step Functions limit.
+const maxStateItemBytes = 64 * 1024
+
+// storeState moves the input's Parts and Item to the blob store if they're
+// too large to pass between states
+func storeState(input *SpartaCastTask, blobStore BlobStore) error {
+	partsBytes, partsBytesErr := json.Marshal(input.Parts)
+	if partsBytesErr != nil {
+		return partsBytesErr
+	}
+	if len(partsBytes) > maxStatePartsBytes {
+		_, putErr := blobStore.Put(partsKeyPath(input.Key), partsBytes, "application/json")
+		if putErr != nil {
+			return putErr
+		}
+		input.PartsKey = partsKeyPath(input.Key)
+		input.Parts = nil
+	}
+	itemBytes, itemBytesErr := json.Marshal(input.Item)
+	if itemBytesErr != nil {
+		return itemBytesErr
+	}
+	if len(itemBytes) > maxStateItemBytes {
+		_, putErr := blobStore.Put(itemKeyPath(input.Key), itemBytes, "application/json")
+		if putErr != nil {
+			return putErr
+		}
+		input.ItemKey = itemKeyPath(input.Key)
+		input.Item = nil
+	}
+	return nil
+}
+
+// loadState restores the input's Parts and Item if storeState moved them
+// to the blob store
+func loadState(input *SpartaCastTask, blobStore BlobStore) error {
+	if input.PartsKey != "" {
+		partsBytes, _, partsBytesErr := blobStore.Get(input.PartsKey)
+		if partsBytesErr != nil {
+			return partsBytesErr
+		}
+		unmarshalErr := json.Unmarshal(partsBytes, &input.Parts)
+		if unmarshalErr != nil {
+			return unmarshalErr
+		}
+		input.PartsKey = ""
+	}
+	if input.ItemKey != "" {
+		itemBytes, _, itemBytesErr := blobStore.Get(input.ItemKey)
+		if itemBytesErr != nil {
+			return itemBytesErr
+		}
+		unmarshalErr := json.Unmarshal(itemBytes, &input.Item)
+		if unmarshalErr != nil {
+			return unmarshalErr
+		}
+		input.ItemKey = ""
+	}
+	return nil
 }
 
 func logInputEvent(ctx context.Context, input interface{}) {
@@ -33,55 +176,45 @@ func logInputEvent(ctx context.Context, input interface{}) {
 	}).Debug("Input Event")
 }
 
-func unmarshalFromS3Object(awsSession *session.Session,
-	bucket string,
+func unmarshalFromBlobStore(blobStore BlobStore,
 	key string,
 	target interface{},
 	logger *logrus.Logger) error {
 
-	// Get the episode, put it back, tell polly to synth it...
-	s3Svc := s3.New(awsSession)
-	s3GetObjectParams := &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	}
-	s3GetObjectResp, s3GetObjectRespErr := s3Svc.GetObject(s3GetObjectParams)
-	if s3GetObjectRespErr != nil {
-		return s3GetObjectRespErr
-	}
-
-	allBytes, allBytesErr := ioutil.ReadAll(s3GetObjectResp.Body)
+	allBytes, _, allBytesErr := blobStore.Get(key)
 	if allBytesErr != nil {
 		return allBytesErr
 	}
 	return json.Unmarshal(allBytes, target)
 }
 
-func unmarshalSpartaCastConfigFromS3(awsSession *session.Session,
-	bucket string,
+func unmarshalSpartaCastConfigFromBlobStore(blobStore BlobStore,
 	key string,
 	target interface{},
-	logger *logrus.Logger) error {
+	logger *logrus.Logger,
+	options ...markson.Option) error {
 
 	// Get the episode, put it back, tell polly to synth it...
-	s3Svc := s3.New(awsSession)
-	s3GetObjectParams := &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
+	allBytes, _, allBytesErr := blobStore.Get(key)
+	if allBytesErr != nil {
+		return allBytesErr
 	}
-	s3GetObjectResp, s3GetObjectRespErr := s3Svc.GetObject(s3GetObjectParams)
-	if s3GetObjectRespErr != nil {
-		return s3GetObjectRespErr
+	// Parse the object into something useful. Name the source
+	// s.t. errors include the key and line...
+	parseOptions := append([]markson.Option{markson.Source(key)}, options...)
+	parseErr := ParseSpartaConfigSpec(bytes.NewReader(allBytes),
+		target,
+		logger,
+		parseOptions...)
+	// Note where the Episode section starts, so that errors in its
+	// speech text are positioned in the source too
+	if item, isItem := target.(*Item); isItem && parseErr == nil {
+		item.EpisodeLine = sourceLineOffset(string(allBytes), item.Episode) + 1
 	}
-	// Parse the object into something useful...
-	parseErr := ParseSpartaConfigSpec(s3GetObjectResp.Body,
-		&target,
-		logger)
 	logger.WithFields(logrus.Fields{
 		"targetItem": target,
-		"bucket":     bucket,
 		"key":        key,
 		"err":        parseErr,
-	}).Debug("Unmarshal from S3 result")
+	}).Debug("Unmarshal from BlobStore result")
 	return parseErr
 }
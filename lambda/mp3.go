@@ -0,0 +1,117 @@
+package lambda
+
+import (
+	"bytes"
+	"fmt"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// MP3 concatenation
+////////////////////////////////////////////////////////////////////////////////
+
+// Polly produces MPEG Layer III audio. Each synthesis part is a standalone
+// file that may have an ID3 tag and a Xing/Info header frame, which
+// describes that part's length. Concatenating parts byte for byte would
+// leave those in the middle of the enclosure, so instead only the audio
+// frames of each part are copied.
+
+var mp3Layer3Bitrates = map[bool][16]int{
+	// MPEG 1
+	true: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	// MPEG 2 and 2.5
+	false: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+var mp3SampleRates = map[byte][3]int{
+	3: {44100, 48000, 32000}, // MPEG 1
+	2: {22050, 24000, 16000}, // MPEG 2
+	0: {11025, 12000, 8000},  // MPEG 2.5
+}
+
+// mp3FrameLength returns the length of the Layer III frame whose header
+// starts data, or 0 if data doesn't start with a valid frame header
+func mp3FrameLength(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1]&0xE0 != 0xE0 {
+		return 0
+	}
+	version := (data[1] >> 3) & 0x03
+	layer := (data[1] >> 1) & 0x03
+	bitrateIndex := data[2] >> 4
+	sampleRateIndex := (data[2] >> 2) & 0x03
+	padding := int((data[2] >> 1) & 0x01)
+
+	sampleRates, versionExists := mp3SampleRates[version]
+	if !versionExists || layer != 0x01 || sampleRateIndex == 0x03 {
+		return 0
+	}
+	isMPEG1 := version == 3
+	bitrate := mp3Layer3Bitrates[isMPEG1][bitrateIndex] * 1000
+	if bitrate == 0 {
+		return 0
+	}
+	// Samples per frame / 8
+	coefficient := 144
+	if !isMPEG1 {
+		coefficient = 72
+	}
+	return coefficient*bitrate/sampleRates[sampleRateIndex] + padding
+}
+
+// id3v2Length returns the length of the ID3v2 tag at the start of data
+func id3v2Length(data []byte) int {
+	if len(data) < 10 || !bytes.HasPrefix(data, []byte("ID3")) {
+		return 0
+	}
+	// Sync safe integer, 7 bits per byte
+	size := int(data[6]&0x7F)<<21 |
+		int(data[7]&0x7F)<<14 |
+		int(data[8]&0x7F)<<7 |
+		int(data[9]&0x7F)
+	length := 10 + size
+	if data[5]&0x10 != 0 {
+		// Footer
+		length += 10
+	}
+	return length
+}
+
+// isMP3InfoFrame returns true if frame is a Xing, Info or VBRI header
+// frame, which holds metadata rather than audio
+func isMP3InfoFrame(frame []byte) bool {
+	header := frame
+	if len(header) > 64 {
+		header = header[:64]
+	}
+	return bytes.Contains(header, []byte("Xing")) ||
+		bytes.Contains(header, []byte("Info")) ||
+		bytes.Contains(header, []byte("VBRI"))
+}
+
+// mp3AudioFrames returns the complete audio frames in data, without any
+// ID3 tags, header frame, or trailing partial frame
+func mp3AudioFrames(data []byte) ([]byte, error) {
+	frames := bytes.Buffer{}
+	offset := id3v2Length(data)
+	isFirstFrame := true
+	for offset < len(data) {
+		frameLength := mp3FrameLength(data[offset:])
+		if frameLength == 0 {
+			// Not a frame, so resync at the next byte
+			offset++
+			continue
+		}
+		if offset+frameLength > len(data) {
+			break
+		}
+		frame := data[offset : offset+frameLength]
+		if !(isFirstFrame && isMP3InfoFrame(frame)) {
+			frames.Write(frame)
+		}
+		isFirstFrame = false
+		offset += frameLength
+	}
+	if frames.Len() == 0 {
+		return nil, fmt.Errorf("No MPEG audio frames found")
+	}
+	return frames.Bytes(), nil
+}
@@ -0,0 +1,72 @@
+package lambda
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testMP3Frame returns an MPEG 2 Layer III frame at 48kbps and 24kHz,
+// which is 144 bytes long, filled with fill
+func testMP3Frame(fill byte) []byte {
+	frame := bytes.Repeat([]byte{fill}, 144)
+	frame[0] = 0xFF
+	frame[1] = 0xF3
+	frame[2] = 0x64
+	frame[3] = 0xC4
+	return frame
+}
+
+func testMP3Part(frames ...[]byte) []byte {
+	part := bytes.Buffer{}
+	// ID3v2 tag with a 5 byte body
+	part.Write([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, 5})
+	part.Write([]byte("01234"))
+	// Info header frame
+	infoFrame := testMP3Frame(0)
+	copy(infoFrame[21:], "Info")
+	part.Write(infoFrame)
+	for _, eachFrame := range frames {
+		part.Write(eachFrame)
+	}
+	// Partial trailing frame
+	part.Write(testMP3Frame(9)[:40])
+	return part.Bytes()
+}
+
+func TestMP3FrameLength(t *testing.T) {
+	if frameLength := mp3FrameLength(testMP3Frame(1)); frameLength != 144 {
+		t.Fatalf("Expected 144 byte frame, got: %d", frameLength)
+	}
+	// MPEG 1 Layer III, 128kbps, 44.1kHz, padded
+	if frameLength := mp3FrameLength([]byte{0xFF, 0xFB, 0x92, 0x64}); frameLength != 418 {
+		t.Fatalf("Expected 418 byte frame, got: %d", frameLength)
+	}
+	if frameLength := mp3FrameLength([]byte("TAG!")); frameLength != 0 {
+		t.Fatalf("Expected invalid frame, got: %d", frameLength)
+	}
+}
+
+func TestMP3AudioFrames(t *testing.T) {
+	firstPart := testMP3Part(testMP3Frame(1), testMP3Frame(2))
+	secondPart := testMP3Part(testMP3Frame(3))
+
+	expected := bytes.Join([][]byte{testMP3Frame(1), testMP3Frame(2), testMP3Frame(3)}, nil)
+	enclosure := bytes.Buffer{}
+	for _, eachPart := range [][]byte{firstPart, secondPart} {
+		audioFrames, audioFramesErr := mp3AudioFrames(eachPart)
+		if audioFramesErr != nil {
+			t.Fatalf("Failed to read frames: %s", audioFramesErr)
+		}
+		if len(audioFrames)%144 != 0 {
+			t.Fatalf("Expected whole frames, got %d bytes", len(audioFrames))
+		}
+		enclosure.Write(audioFrames)
+	}
+	if !bytes.Equal(enclosure.Bytes(), expected) {
+		t.Fatalf("Unexpected enclosure of %d bytes, expected %d", enclosure.Len(), len(expected))
+	}
+	_, noFramesErr := mp3AudioFrames([]byte("not an mp3"))
+	if noFramesErr == nil {
+		t.Fatalf("Expected an error for data without frames")
+	}
+}
@@ -4,13 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/polly"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/google/uuid"
 	sparta "github.com/mweagle/Sparta"
 	spartaCF "github.com/mweagle/Sparta/aws/cloudformation"
@@ -20,47 +20,56 @@ import (
 )
 
 type pollyParallelTask func() error
-type pollyParallelTaskConstructor func(input *SpartaCastTask,
-	awsSession *session.Session,
-	logger *logrus.Logger) pollyParallelTask
 
+// newDeleteObsoleteOutputTask returns the task that deletes the output the
+// existing manifest refers to and the input doesn't. The existing manifest
+// is read right away, so create the task before the manifest is replaced
+// and run it once the new one is written.
 func newDeleteObsoleteOutputTask(input *SpartaCastTask,
-	awsSession *session.Session,
+	blobStore BlobStore,
 	logger *logrus.Logger) pollyParallelTask {
 
-	return func() error {
-		s3Svc := s3.New(awsSession)
+	// It's done...get the old item if it exists and delete it...
+	manifestKey := manifestKeyPath(input.Key)
 
-		// It's done...get the old item if it exists and delete it...
-		manifestKey := manifestKeyPath(input.Key)
+	existingSpartaCastTask := SpartaCastTask{}
+	unmarshalErr := unmarshalFromBlobStore(blobStore,
+		manifestKey,
+		&existingSpartaCastTask,
+		logger)
+	logger.WithFields(logrus.Fields{
+		"inputKey":   input.Key,
+		"error":      unmarshalErr,
+		"legacyItem": existingSpartaCastTask,
+	}).Debug("Purging obsoleted entry")
 
-		existingSpartaCastTask := SpartaCastTask{}
-		unmarshalErr := unmarshalFromS3Object(awsSession,
-			input.Bucket,
-			manifestKey,
-			&existingSpartaCastTask,
-			logger)
-		logger.WithFields(logrus.Fields{
-			"inputKey":   input.Key,
-			"error":      unmarshalErr,
-			"legacyItem": existingSpartaCastTask,
-		}).Debug("Purging obsoleted entry")
-
-		if unmarshalErr == nil &&
-			existingSpartaCastTask.SynthesisTask.OutputUri != nil &&
-			*existingSpartaCastTask.SynthesisTask.OutputUri != "" {
-			keyPath, keyPathErr := keyPathFromS3URI(*existingSpartaCastTask.SynthesisTask.OutputUri,
-				input.Bucket)
+	return func() error {
+		if unmarshalErr != nil || existingSpartaCastTask.SynthesisTask == nil {
+			return nil
+		}
+		// That's the enclosure and, for long episodes, each part
+		obsoleteOutputURIs := []*string{existingSpartaCastTask.SynthesisTask.OutputUri}
+		for _, eachPart := range existingSpartaCastTask.Parts {
+			obsoleteOutputURIs = append(obsoleteOutputURIs, eachPart.SynthesisTask.OutputUri)
+		}
+		// Deterministic task IDs can reuse the same output, which isn't
+		// obsolete
+		currentOutputURIs := map[string]bool{
+			aws.StringValue(input.SynthesisTask.OutputUri): true,
+		}
+		for _, eachPart := range input.Parts {
+			currentOutputURIs[aws.StringValue(eachPart.SynthesisTask.OutputUri)] = true
+		}
+		for _, eachURI := range obsoleteOutputURIs {
+			if eachURI == nil || *eachURI == "" || currentOutputURIs[*eachURI] {
+				continue
+			}
+			keyPath, keyPathErr := blobStore.KeyFromURL(*eachURI)
 			if keyPathErr == nil {
-				deleteInputParams := &s3.DeleteObjectInput{
-					Bucket: aws.String(input.Bucket),
-					Key:    aws.String(keyPath),
-				}
-				s3DeleteObjResp, s3DeleteObjRespErr := s3Svc.DeleteObject(deleteInputParams)
+				deleteErr := blobStore.Delete(keyPath)
 				logger.WithFields(logrus.Fields{
-					"request":   deleteInputParams,
-					"s3Resp":    s3DeleteObjResp,
-					"s3RespErr": s3DeleteObjRespErr,
+					"key":       keyPath,
+					"deleteErr": deleteErr,
 				}).Debug("Results of newDeleteObsoleteOutputTask")
 			}
 		}
@@ -69,106 +78,322 @@ func newDeleteObsoleteOutputTask(input *SpartaCastTask,
 }
 
 func newSetOutputMediaTypeTask(input *SpartaCastTask,
-	awsSession *session.Session,
+	blobStore BlobStore,
 	logger *logrus.Logger) pollyParallelTask {
 	return func() error {
-
-		s3Svc := s3.New(awsSession)
-		keyPath, keyPathErr := keyPathFromS3URI(*input.SynthesisTask.OutputUri,
-			input.Bucket)
+		keyPath, keyPathErr := blobStore.KeyFromURL(*input.SynthesisTask.OutputUri)
 		if keyPathErr != nil {
 			return keyPathErr
 		}
-		s3HeadObjectParams := &s3.HeadObjectInput{
-			Bucket: aws.String(input.Bucket),
-			Key:    aws.String(keyPath),
-		}
-		s3HeadResp, s3HeadRespErr := s3Svc.HeadObject(s3HeadObjectParams)
+		copyErr := blobStore.Copy(keyPath, keyPath, ContentTypeMP3)
 		logger.WithFields(logrus.Fields{
-			"s3HeadResp":         s3HeadResp.Metadata,
-			"s3HeadRespErr":      s3HeadRespErr,
-			"s3HeadObjectParams": s3HeadObjectParams,
-		}).Debug("S3 HeadObject")
+			"key":     keyPath,
+			"copyErr": copyErr,
+		}).Debug("Results of newSetOutputMediaTypeTask")
+		return copyErr
+	}
+}
 
-		if s3HeadRespErr != nil {
-			return s3HeadRespErr
-		}
-		if s3HeadResp.Metadata == nil {
-			s3HeadResp.Metadata = make(map[string]*string)
-		}
+// existingManifest returns the manifest of the episode at key, or nil if
+// it hasn't been published
+func existingManifest(blobStore BlobStore,
+	key string,
+	logger *logrus.Logger) *SpartaCastTask {
+	existingSpartaCastTask := SpartaCastTask{}
+	unmarshalErr := unmarshalFromBlobStore(blobStore,
+		manifestKeyPath(key),
+		&existingSpartaCastTask,
+		logger)
+	if unmarshalErr != nil || existingSpartaCastTask.Item == nil {
+		return nil
+	}
+	return &existingSpartaCastTask
+}
 
-		s3HeadResp.Metadata["Content-Type"] = aws.String(ContentTypeMP3)
-		copySource := fmt.Sprintf("%s/%s", input.Bucket, keyPath)
-		s3CopyObjectInput := &s3.CopyObjectInput{
-			Bucket:            aws.String(input.Bucket),
-			CopySource:        aws.String(copySource),
-			Key:               aws.String(keyPath),
-			ContentType:       aws.String(ContentTypeMP3),
-			Metadata:          s3HeadResp.Metadata,
-			MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
-		}
-		s3CopyObjectResp, s3CopyObjectRespErr := s3Svc.CopyObject(s3CopyObjectInput)
-		logger.WithFields(logrus.Fields{
-			"metadata":            s3HeadResp.Metadata,
-			"s3CopyObjectResp":    s3CopyObjectResp,
-			"s3CopyObjectRespErr": s3CopyObjectRespErr,
-		}).Debug("Results of newSetOutputMediaTypeTask")
-		return s3CopyObjectRespErr
+// renamedManifest returns the manifest of the episode that the input was
+// renamed from, or nil if it wasn't. A rename is a copy and a delete, so
+// the source is gone and its manifest is either still in place or, once
+// the delete branch has run, in its tombstone. A copy whose source still
+// exists is a new episode. Any other error checking the source is
+// returned, rather than giving the episode a new identity.
+func renamedManifest(input *SpartaCastTask,
+	blobStore BlobStore,
+	logger *logrus.Logger) (*SpartaCastTask, error) {
+	if input.CopySource == "" || input.CopySource == input.Key {
+		return nil, nil
+	}
+	_, headErr := blobStore.Head(input.CopySource)
+	if headErr == nil {
+		return nil, nil
+	}
+	if !errors.Is(headErr, ErrBlobNotFound) {
+		return nil, headErr
+	}
+	sourceManifest := existingManifest(blobStore, input.CopySource, logger)
+	if sourceManifest != nil {
+		return sourceManifest, nil
+	}
+	tombstone := SpartaCastTask{}
+	unmarshalErr := unmarshalFromBlobStore(blobStore,
+		tombstoneKeyPath(input.CopySource),
+		&tombstone,
+		logger)
+	if unmarshalErr != nil || tombstone.Item == nil {
+		return nil, nil
 	}
+	return &tombstone, nil
+}
+
+// episodeGUID returns the GUID of the episode. That's the guid property if
+// the source sets one, otherwise the GUID in the existing manifest, so that
+// published items keep their identity, otherwise a name-based UUID of the
+// bucket and source key.
+func episodeGUID(input *SpartaCastTask, existing *SpartaCastTask) string {
+	if input.Item.GUID != "" {
+		return input.Item.GUID
+	}
+	if existing != nil && existing.Item.GUID != "" {
+		return existing.Item.GUID
+	}
+	episodeURI := fmt.Sprintf("s3://%s/%s", input.Bucket, input.Key)
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(episodeURI)).String()
+}
+
+// episodePubDate returns the publish date of the episode. That's the
+// pubDate property if the source sets one, then the publishAt property of a
+// scheduled episode, then the date in the existing manifest, so that edits
+// don't move an episode to the top of the feed, otherwise now.
+func episodePubDate(input *SpartaCastTask, existing *SpartaCastTask, now time.Time) string {
+	if input.Item.PubDate != "" {
+		return input.Item.PubDate
+	}
+	if input.Item.PublishAt != "" {
+		return input.Item.PublishAt
+	}
+	if existing != nil && existing.Item.PubDate != "" {
+		return existing.Item.PubDate
+	}
+	return now.Format(time.RFC3339)
+}
+
+// setPublishAt sets the time that the waitForPublish state regenerates the
+// feed, which is once the episode is published
+func setPublishAt(input *SpartaCastTask) error {
+	publishTime, publishTimeErr := input.Item.publishTime()
+	if publishTimeErr != nil {
+		return publishTimeErr
+	}
+	input.PublishAt = publishTime.UTC().Format(time.RFC3339)
+	return nil
 }
 
 func newCreateMetadataTask(input *SpartaCastTask,
-	awsSession *session.Session,
+	blobStore BlobStore,
+	now time.Time,
 	logger *logrus.Logger) pollyParallelTask {
 
 	return func() error {
 		// Get the metadata for the item s.t. we can include the enclosure length
-		keyPath, keyPathErr := keyPathFromS3URI(*input.SynthesisTask.OutputUri,
-			input.Bucket)
+		keyPath, keyPathErr := blobStore.KeyFromURL(*input.SynthesisTask.OutputUri)
 		if keyPathErr != nil {
 			return keyPathErr
 		}
-		s3Svc := s3.New(awsSession)
-		s3HeadObjectInput := &s3.HeadObjectInput{
-			Bucket: aws.String(input.Bucket),
-			Key:    aws.String(keyPath),
-		}
-		s3HeadObjectResp, s3HeadObjectRespErr := s3Svc.HeadObject(s3HeadObjectInput)
-		if s3HeadObjectRespErr != nil {
-			return s3HeadObjectRespErr
+		enclosureInfo, enclosureInfoErr := blobStore.Head(keyPath)
+		if enclosureInfoErr != nil {
+			return enclosureInfoErr
 		}
-		manifestKey := fmt.Sprintf("%s/%s/%s.json",
-			PublicKeyPath,
-			KeyComponentMetadata,
-			input.Key)
+		manifestKey := manifestKeyPath(input.Key)
 
 		// Super...write this summary back to the root of the bucket s.t.
 		// we can use an Athena query to fetch everything...
-		itemUUID, itemUUIDErr := uuid.NewRandom()
-		if itemUUIDErr != nil {
-			return itemUUIDErr
+		existing := existingManifest(blobStore, input.Key, logger)
+		if existing == nil {
+			renamed, renamedErr := renamedManifest(input, blobStore, logger)
+			if renamedErr != nil {
+				return renamedErr
+			}
+			existing = renamed
+		}
+		input.Item.PubDate = episodePubDate(input, existing, now)
+		// Only an edit, including a rename, has an updated date
+		input.Item.Updated = ""
+		if existing != nil {
+			input.Item.Updated = now.Format(time.RFC3339)
 		}
-		input.Item.PubDate = time.Now().Format(time.RFC3339)
 		input.Item.EnclosureLink = *input.SynthesisTask.OutputUri
-		input.Item.EnclosureByteLength = *s3HeadObjectResp.ContentLength
-		input.Item.GUID = itemUUID.String()
-		jsonBytes, jsonBytesErr := json.Marshal(&input)
+		input.Item.EnclosureByteLength = enclosureInfo.Size
+		input.Item.GUID = episodeGUID(input, existing)
+		jsonBytes, jsonBytesErr := json.Marshal(input.manifest())
 		if jsonBytesErr != nil {
 			return jsonBytesErr
 		}
-		putObjectInput := &s3.PutObjectInput{
-			Bucket: aws.String(input.Bucket),
-			Key:    aws.String(manifestKey),
-			Body:   bytes.NewReader(jsonBytes),
-		}
-		putObjectResp, putObjectRespErr := s3Svc.PutObject(putObjectInput)
+		putResp, putRespErr := blobStore.Put(manifestKey, jsonBytes, "application/json")
 		logger.WithFields(logrus.Fields{
-			"putObjectResp":    putObjectResp,
-			"putObjectRespErr": putObjectRespErr,
+			"putResp":    putResp,
+			"putRespErr": putRespErr,
 		}).Info("Results of newCreateMetadataTask")
 
-		return putObjectRespErr
+		return putRespErr
+	}
+}
+
+// pollSynthesisParts refreshes the status of each incomplete part and sets
+// the input's SynthesisTask to their aggregate status. That's the first
+// failed part, otherwise the first incomplete part, otherwise a completed
+// task whose OutputUri is set once the parts are concatenated.
+func pollSynthesisParts(input *SpartaCastTask,
+	synthesizer SpeechSynthesizer,
+	logger *logrus.Logger) error {
+
+	var failedTask *polly.SynthesisTask
+	var pendingTask *polly.SynthesisTask
+	requestCharacters := int64(0)
+	for _, eachPart := range input.Parts {
+		if aws.StringValue(eachPart.SynthesisTask.TaskStatus) != polly.TaskStatusCompleted {
+			synthesisTask, synthesisTaskErr := synthesizer.PollSynthesis(eachPart.SynthesisTask)
+			if synthesisTaskErr != nil {
+				return synthesisTaskErr
+			}
+			eachPart.SynthesisTask = synthesisTask
+		}
+		requestCharacters += aws.Int64Value(eachPart.SynthesisTask.RequestCharacters)
+		switch aws.StringValue(eachPart.SynthesisTask.TaskStatus) {
+		case polly.TaskStatusCompleted:
+			// NOP
+		case polly.TaskStatusFailed:
+			if failedTask == nil {
+				failedTask = eachPart.SynthesisTask
+			}
+		default:
+			if pendingTask == nil {
+				pendingTask = eachPart.SynthesisTask
+			}
+		}
+	}
+	aggregateTask := *input.Parts[0].SynthesisTask
+	if failedTask != nil {
+		aggregateTask = *failedTask
+	} else if pendingTask != nil {
+		aggregateTask = *pendingTask
+	}
+	aggregateTask.RequestCharacters = aws.Int64(requestCharacters)
+	input.SynthesisTask = &aggregateTask
+	logger.WithFields(logrus.Fields{
+		"parts":      len(input.Parts),
+		"taskStatus": aws.StringValue(aggregateTask.TaskStatus),
+	}).Debug("Updated synthesis parts")
+	return nil
+}
+
+// concatenateSynthesisParts writes the audio frames of each part, in order,
+// to a single enclosure and points the input's SynthesisTask at it
+func concatenateSynthesisParts(input *SpartaCastTask,
+	parts []*SynthesisPart,
+	synthesizer SpeechSynthesizer,
+	blobStore BlobStore,
+	logger *logrus.Logger) error {
+
+	enclosure := bytes.Buffer{}
+	for _, eachPart := range parts {
+		partBytes, partBytesErr := synthesizer.FetchSynthesis(eachPart.SynthesisTask)
+		if partBytesErr != nil {
+			return partBytesErr
+		}
+		audioFrames, audioFramesErr := mp3AudioFrames(partBytes)
+		if audioFramesErr != nil {
+			return fmt.Errorf("Failed to read synthesis part %s: %s",
+				aws.StringValue(eachPart.SynthesisTask.TaskId),
+				audioFramesErr)
+		}
+		eachPart.ByteOffset = int64(enclosure.Len())
+		eachPart.ByteLength = int64(len(audioFrames))
+		enclosure.Write(audioFrames)
+	}
+
+	// The enclosure is named for the first part's task, so it's just as
+	// unique, and lives alongside the parts
+	enclosureKeyPath := fmt.Sprintf("%s/%s/%s.%s.full.mp3",
+		PublicKeyPath,
+		KeyComponentFeed,
+		input.Key,
+		aws.StringValue(parts[0].SynthesisTask.TaskId))
+	putResp, putRespErr := blobStore.Put(enclosureKeyPath,
+		enclosure.Bytes(),
+		ContentTypeMP3)
+	logger.WithFields(logrus.Fields{
+		"key":        enclosureKeyPath,
+		"parts":      len(parts),
+		"byteLength": enclosure.Len(),
+		"putResp":    putResp,
+		"putRespErr": putRespErr,
+	}).Info("Concatenated synthesis parts")
+	if putRespErr != nil {
+		return putRespErr
 	}
+	input.SynthesisTask.OutputUri = aws.String(blobStore.URL(enclosureKeyPath))
+	return nil
+}
+
+// pollSynthesisTask refreshes the status of the input's synthesis task, or
+// of each of its parts
+func pollSynthesisTask(input *SpartaCastTask,
+	synthesizer SpeechSynthesizer,
+	logger *logrus.Logger) error {
+
+	if len(input.Parts) != 0 {
+		return pollSynthesisParts(input, synthesizer, logger)
+	}
+	synthesisTask, synthesisTaskErr := synthesizer.PollSynthesis(input.SynthesisTask)
+	if synthesisTaskErr != nil {
+		return synthesisTaskErr
+	}
+	// Update it...
+	input.SynthesisTask = synthesisTask
+	logger.WithFields(logrus.Fields{
+		"input": input,
+	}).Debug("Updated Task Status")
+	return nil
+}
+
+// finalizeSynthesis writes the enclosure and the manifest of a completed
+// synthesis task. Long episodes need to be stitched together before the
+// enclosure is finalized. If copyOutput is true, the synthesizer's output
+// isn't in the blob store, so even a single part is copied into it. The
+// manifest is dated now.
+func finalizeSynthesis(input *SpartaCastTask,
+	synthesizer SpeechSynthesizer,
+	blobStore BlobStore,
+	copyOutput bool,
+	now time.Time,
+	logger *logrus.Logger) error {
+
+	parts := input.Parts
+	if len(parts) == 0 && copyOutput {
+		parts = []*SynthesisPart{{SynthesisTask: input.SynthesisTask}}
+	}
+	if len(parts) != 0 {
+		concatErr := concatenateSynthesisParts(input, parts, synthesizer, blobStore, logger)
+		if concatErr != nil {
+			return concatErr
+		}
+	}
+	// Run the tasks. The obsolete output is only deleted once the new
+	// manifest no longer refers to it, so that a failed write doesn't
+	// leave the episode without audio.
+	deleteObsoleteOutputTask := newDeleteObsoleteOutputTask(input, blobStore, logger)
+	parallelTasks := []pollyParallelTask{
+		newSetOutputMediaTypeTask(input, blobStore, logger),
+		newCreateMetadataTask(input, blobStore, now, logger),
+	}
+	var taskGroup errgroup.Group
+	for _, eachTask := range parallelTasks {
+		taskGroup.Go(eachTask)
+	}
+	taskGroupErr := taskGroup.Wait()
+	if taskGroupErr != nil {
+		return taskGroupErr
+	}
+	return deleteObsoleteOutputTask()
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -183,6 +408,11 @@ func newCreateMetadataTask(input *SpartaCastTask,
 // Handle the S3 state change function
 type handlePollyTask struct {
 	s3BucketResourceName string
+	newSynthesizer       speechSynthesizerConstructor
+	newBlobStore         blobStoreConstructor
+	// copyOutput copies the synthesizer's output into the blob store,
+	// for synthesizers that don't write to the bucket
+	copyOutput bool
 }
 
 func (lambda *handlePollyTask) Name() string {
@@ -206,23 +436,22 @@ func (lambda *handlePollyTask) Handler() interface{} {
 		// Preconditions
 		////////////////////////////////////////////////////////////////////////
 
-		getSpeechSynthesisTaskInput := &polly.GetSpeechSynthesisTaskInput{
-			TaskId: input.SynthesisTask.TaskId,
+		synthesizer := lambda.newSynthesizer(awsSession)
+		blobStore := lambda.newBlobStore(awsSession, input.Bucket)
+		loadErr := loadState(&input, blobStore)
+		if loadErr != nil {
+			return nil, failEpisodeEvent(blobStore, &input, loadErr, logger)
 		}
-		pollySvc := polly.New(awsSession)
-		getTaskResp, getTaskRespErr := pollySvc.GetSpeechSynthesisTask(getSpeechSynthesisTaskInput)
-		if getTaskRespErr != nil {
-			return nil, getTaskRespErr
+		pollErr := pollSynthesisTask(&input, synthesizer, logger)
+		if pollErr != nil {
+			return nil, failEpisodeEvent(blobStore, &input, pollErr, logger)
 		}
-		// Update it...
-		input.SynthesisTask = getTaskResp.SynthesisTask
-		logger.WithFields(logrus.Fields{
-			"input": input,
-		}).Debug("Updated Task Status")
-
 		switch *input.SynthesisTask.TaskStatus {
 		case polly.TaskStatusFailed:
-			return nil, fmt.Errorf("Failed to synthesize speech (TaskID: %s)", *input.SynthesisTask.TaskId)
+			return nil, failEpisodeEvent(blobStore,
+				&input,
+				fmt.Errorf("Failed to synthesize speech (TaskID: %s)", *input.SynthesisTask.TaskId),
+				logger)
 		case polly.TaskStatusInProgress,
 			polly.TaskStatusScheduled:
 			input.WaitDuration = input.WaitDuration * 2
@@ -232,22 +461,28 @@ func (lambda *handlePollyTask) Handler() interface{} {
 			if input.WaitDuration > 60 {
 				input.WaitDuration = 60
 			}
+			storeErr := storeState(&input, blobStore)
+			if storeErr != nil {
+				return nil, failEpisodeEvent(blobStore, &input, storeErr, logger)
+			}
 			return &input, nil
 		}
-		// Run the tasks...
-		parallelTasks := []pollyParallelTaskConstructor{
-			newDeleteObsoleteOutputTask,
-			newSetOutputMediaTypeTask,
-			newCreateMetadataTask,
+		finalizeErr := finalizeSynthesis(&input,
+			synthesizer,
+			blobStore,
+			lambda.copyOutput,
+			contextClock(ctx).Now(),
+			logger)
+		if finalizeErr != nil {
+			return nil, failEpisodeEvent(blobStore, &input, finalizeErr, logger)
 		}
-		var taskGroup errgroup.Group
-		for _, eachTask := range parallelTasks {
-			goFunc := eachTask(&input, awsSession, logger)
-			taskGroup.Go(goFunc)
+		publishAtErr := setPublishAt(&input)
+		if publishAtErr != nil {
+			return nil, failEpisodeEvent(blobStore, &input, publishAtErr, logger)
 		}
-		taskErr := taskGroup.Wait()
-		if taskErr != nil {
-			return nil, taskErr
+		storeErr := storeState(&input, blobStore)
+		if storeErr != nil {
+			return nil, failEpisodeEvent(blobStore, &input, storeErr, logger)
 		}
 		return &input, nil
 	}
@@ -259,12 +494,17 @@ func (lambda *handlePollyTask) Role() interface{} {
 
 	role.Privileges = append(role.Privileges,
 		sparta.IAMRolePrivilege{
-			Actions: []string{"s3:Put*",
+			Actions: []string{"s3:Get*",
+				"s3:Put*",
 				"s3:Head*",
 				"s3:DeleteObject",
 				"s3:Copy*"},
 			Resource: spartaCF.S3AllKeysArnForBucket(gocf.Ref(lambda.s3BucketResourceName)),
 		},
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"s3:ListBucket"},
+			Resource: gocf.GetAtt(lambda.s3BucketResourceName, "Arn"),
+		},
 		sparta.IAMRolePrivilege{
 			Actions:  []string{"polly:*"},
 			Resource: "*",
@@ -277,5 +517,7 @@ func (lambda *handlePollyTask) Role() interface{} {
 func newHandlePollyTask(s3BucketResourceName string) sparta.AWSLambdaProvider {
 	return &handlePollyTask{
 		s3BucketResourceName: s3BucketResourceName,
+		newSynthesizer:       NewPollySynthesizer,
+		newBlobStore:         NewS3BlobStore,
 	}
 }
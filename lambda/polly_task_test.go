@@ -0,0 +1,339 @@
+package lambda
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	sparta "github.com/mweagle/Sparta"
+)
+
+func testManifest(t *testing.T, blobStore BlobStore, key string) *SpartaCastTask {
+	manifestBytes, _, manifestErr := blobStore.Get(manifestKeyPath(key))
+	if manifestErr != nil {
+		t.Fatalf("Failed to read manifest for %s: %s", key, manifestErr)
+	}
+	manifest := SpartaCastTask{}
+	unmarshalErr := json.Unmarshal(manifestBytes, &manifest)
+	if unmarshalErr != nil {
+		t.Fatalf("Failed to parse manifest for %s: %s", key, unmarshalErr)
+	}
+	return &manifest
+}
+
+func TestEpisodeGUID(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	clock := NewFakeClock(time.Now())
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{}, logger)
+	executor.Clock = clock
+	execute := func() string {
+		_, executeErr := executor.Execute(testUploadEvent("episode1.md"))
+		if executeErr != nil {
+			t.Fatalf("Failed to execute: %s", executeErr)
+		}
+		return testManifest(t, blobStore, "episode1.md").Item.GUID
+	}
+	// The GUID is derived from the bucket and key...
+	firstGUID := execute()
+	if firstGUID == "" {
+		t.Fatalf("Expected a GUID")
+	}
+	// ...and doesn't change when the episode is edited
+	episodeBytes, _, _ := blobStore.Get("episode1.md")
+	editedEpisode := strings.Replace(string(episodeBytes), "PollyCast", "SpartaCast", 1)
+	blobStore.Put("episode1.md", []byte(editedEpisode), "")
+	if secondGUID := execute(); secondGUID != firstGUID {
+		t.Fatalf("GUID changed after re-synthesis: %s != %s", firstGUID, secondGUID)
+	}
+	feedBytes, _, feedErr := blobStore.Get("public/feed/feed.xml")
+	if feedErr != nil || !strings.Contains(string(feedBytes), firstGUID) {
+		t.Fatalf("Expected the feed to include GUID %s (%v)", firstGUID, feedErr)
+	}
+
+	// An existing GUID, such as a random one from an earlier release,
+	// is kept
+	manifest := testManifest(t, blobStore, "episode1.md")
+	manifest.Item.GUID = "2b1e5d04-3c2b-4b5e-9d0e-7f3f6a1b8c9d"
+	manifestBytes, _ := json.Marshal(manifest)
+	blobStore.Put(manifestKeyPath("episode1.md"), manifestBytes, "application/json")
+	clock.Sleep(duplicateEventWindow)
+	if keptGUID := execute(); keptGUID != manifest.Item.GUID {
+		t.Fatalf("Expected existing GUID %s, got %s", manifest.Item.GUID, keptGUID)
+	}
+
+	// An explicit guid property takes precedence
+	input := &SpartaCastTask{
+		Bucket: "spartacast-eventbucket",
+		Key:    "episode1.md",
+		Item: &Item{
+			GUID: "tag:example.com,2020:episode1",
+		},
+	}
+	if explicitGUID := episodeGUID(input, testManifest(t, blobStore, "episode1.md")); explicitGUID != input.Item.GUID {
+		t.Fatalf("Expected explicit GUID %s, got %s", input.Item.GUID, explicitGUID)
+	}
+}
+
+func TestParsePubDate(t *testing.T) {
+	for eachInput, eachExpected := range map[string]string{
+		"2020-03-01":                      "2020-03-01T00:00:00Z",
+		" 2020-03-01 18:22 ":              "2020-03-01T18:22:00Z",
+		"2020-03-01T18:22:15Z":            "2020-03-01T18:22:15Z",
+		"2020-03-01T18:22:15-08:00":       "2020-03-01T18:22:15-08:00",
+		"Sun, 01 Mar 2020 18:22:15 +0000": "2020-03-01T18:22:15Z",
+		"March 1, 2020":                   "2020-03-01T00:00:00Z",
+		"1 Mar 2020":                      "2020-03-01T00:00:00Z",
+		"Sun, 01 Mar 2020 18:22:15 GMT":   "2020-03-01T18:22:15Z",
+		"Sun, 01 Mar 2020 18:22:15 -0800": "2020-03-01T18:22:15-08:00",
+	} {
+		pubDate, pubDateErr := parseDateProperty("pubDate", eachInput)
+		if pubDateErr != nil {
+			t.Fatalf("Failed to parse %q: %s", eachInput, pubDateErr)
+		}
+		if pubDate != eachExpected {
+			t.Fatalf("Unexpected pubDate for %q: %s != %s", eachInput, pubDate, eachExpected)
+		}
+	}
+	_, pubDateErr := parseDateProperty("pubDate", "last tuesday")
+	if pubDateErr == nil {
+		t.Fatalf("Expected an unsupported pubDate to fail")
+	}
+	// An abbreviation other than UTC or GMT would otherwise be parsed
+	// with a zero offset
+	_, pubDateErr = parseDateProperty("pubDate", "Sun, 01 Mar 2020 18:22:15 PST")
+	if pubDateErr == nil || !strings.Contains(pubDateErr.Error(), "PST") {
+		t.Fatalf("Expected an ambiguous time zone to fail, got: %v", pubDateErr)
+	}
+}
+
+func TestEpisodePubDate(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	clock := NewFakeClock(time.Now())
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{}, logger)
+	executor.Clock = clock
+	execute := func() *Item {
+		_, executeErr := executor.Execute(testUploadEvent("episode1.md"))
+		if executeErr != nil {
+			t.Fatalf("Failed to execute: %s", executeErr)
+		}
+		return testManifest(t, blobStore, "episode1.md").Item
+	}
+	// The first publish isn't an edit, so it has no updated date
+	firstItem := execute()
+	if firstItem.PubDate == "" || firstItem.Updated != "" {
+		t.Fatalf("Expected a pubDate without updated: %#v", firstItem)
+	}
+
+	// Re-synthesis keeps the first publish date and records the edit
+	manifest := testManifest(t, blobStore, "episode1.md")
+	manifest.Item.PubDate = "2019-06-01T12:00:00Z"
+	manifestBytes, _ := json.Marshal(manifest)
+	blobStore.Put(manifestKeyPath("episode1.md"), manifestBytes, "application/json")
+	clock.Sleep(duplicateEventWindow)
+	editedItem := execute()
+	if editedItem.PubDate != manifest.Item.PubDate {
+		t.Fatalf("Expected pubDate %s to be kept, got %s", manifest.Item.PubDate, editedItem.PubDate)
+	}
+	if editedItem.Updated == "" || editedItem.Updated == editedItem.PubDate {
+		t.Fatalf("Expected an updated timestamp for the edit")
+	}
+
+	// A pubDate property overrides it
+	episodeBytes, _, _ := blobStore.Get("episode1.md")
+	explicitEpisode := strings.Replace(string(episodeBytes),
+		"| Title ",
+		"| pubDate | March 1, 2020 |\n| Title ",
+		1)
+	blobStore.Put("episode1.md", []byte(explicitEpisode), "")
+	if explicitItem := execute(); explicitItem.PubDate != "2020-03-01T00:00:00Z" {
+		t.Fatalf("Expected the pubDate property, got %s", explicitItem.PubDate)
+	}
+
+	// ...and must be a date
+	invalidEpisode := strings.Replace(explicitEpisode, "March 1, 2020", "someday", 1)
+	blobStore.Put("episode1.md", []byte(invalidEpisode), "")
+	_, executeErr := executor.Execute(testUploadEvent("episode1.md"))
+	if executeErr == nil || !strings.Contains(executeErr.Error(), "pubDate") {
+		t.Fatalf("Expected an invalid pubDate to fail, got: %v", executeErr)
+	}
+}
+
+func TestScheduledEpisode(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	start := time.Now()
+	publishAt := start.Add(48 * time.Hour).UTC().Truncate(time.Second)
+	episodeBytes, _, _ := blobStore.Get("episode1.md")
+	scheduledEpisode := strings.Replace(string(episodeBytes),
+		"| Title ",
+		"| publishAt | "+publishAt.Format(time.RFC3339)+" |\n| Title ",
+		1)
+	blobStore.Put("episode1.md", []byte(scheduledEpisode), "")
+
+	clock := NewFakeClock(start)
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{}, logger)
+	executor.Clock = clock
+	transitions, executeErr := executor.Execute(testUploadEvent("episode1.md"))
+	if executeErr != nil {
+		t.Fatalf("Failed to execute: %s", executeErr)
+	}
+	if !strings.Contains(transitionStates(transitions), StateWaitForPublish+" -> "+HandleMarkFeedDirtyTaskName) {
+		t.Fatalf("Unexpected transitions: %s", transitionStates(transitions))
+	}
+	if clock.Now().Before(publishAt) {
+		t.Fatalf("Expected to wait until %s, waited until %s", publishAt, clock.Now())
+	}
+	item := testManifest(t, blobStore, "episode1.md").Item
+	if item.PubDate != publishAt.Format(time.RFC3339) {
+		t.Fatalf("Expected the pubDate to default to publishAt, got %s", item.PubDate)
+	}
+
+	// The episode is only in the feed once it's published
+	for _, eachNow := range []time.Time{start, publishAt} {
+		createErr := generateFeed(blobStore, eachNow, logger)
+		if createErr != nil {
+			t.Fatalf("Failed to create feed: %s", createErr)
+		}
+		feedBytes, _, _ := blobStore.Get("public/feed/feed.xml")
+		published := strings.Contains(string(feedBytes), item.GUID)
+		if published != !eachNow.Before(publishAt) {
+			t.Fatalf("Unexpected feed at %s, published: %t", eachNow, published)
+		}
+	}
+}
+
+func TestManifestClock(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	// The manifest is dated by the executor's clock rather than the
+	// wall clock
+	start := time.Date(2020, 3, 1, 18, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{}, logger)
+	executor.Clock = clock
+	_, executeErr := executor.Execute(testUploadEvent("episode1.md"))
+	if executeErr != nil {
+		t.Fatalf("Failed to execute: %s", executeErr)
+	}
+	item := testManifest(t, blobStore, "episode1.md").Item
+	pubDate, pubDateErr := time.Parse(time.RFC3339, item.PubDate)
+	if pubDateErr != nil || pubDate.Before(start) || pubDate.After(clock.Now()) {
+		t.Fatalf("Expected the pubDate to be between %s and %s, got %s", start, clock.Now(), item.PubDate)
+	}
+	if item.Updated != "" {
+		t.Fatalf("Expected the first version to have no updated date, got %s", item.Updated)
+	}
+}
+
+func TestManifestOmitsExecutionState(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	// Both the synthesized and the unchanged episode write the manifest
+	clock := NewFakeClock(time.Now())
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{}, logger)
+	executor.Clock = clock
+	for i := 0; i != 2; i++ {
+		_, executeErr := executor.Execute(testUploadEvent("episode1.md"))
+		if executeErr != nil {
+			t.Fatalf("Failed to execute: %s", executeErr)
+		}
+		manifestBytes, _, manifestErr := blobStore.Get(manifestKeyPath("episode1.md"))
+		if manifestErr != nil {
+			t.Fatalf("Failed to read manifest: %s", manifestErr)
+		}
+		manifest := map[string]interface{}{}
+		unmarshalErr := json.Unmarshal(manifestBytes, &manifest)
+		if unmarshalErr != nil {
+			t.Fatalf("Failed to parse manifest: %s", unmarshalErr)
+		}
+		for _, eachField := range []string{"EventID",
+			"SynthesisSkipped",
+			"DuplicateEvent",
+			"FeedConfigMissing",
+			"FeedRebuildDeferred",
+			"FeedGeneration",
+			"RebuildAt",
+			"PublishAt",
+			"WaitDuration"} {
+			if _, fieldExists := manifest[eachField]; fieldExists {
+				t.Fatalf("Expected no %s in the manifest: %s", eachField, manifestBytes)
+			}
+		}
+		if manifest["ContentHash"] == "" || manifest["Item"] == nil {
+			t.Fatalf("Expected the episode in the manifest: %s", manifestBytes)
+		}
+		clock.Sleep(duplicateEventWindow)
+	}
+}
+
+// failingManifestStore fails to write manifests while fail is set
+type failingManifestStore struct {
+	BlobStore
+	fail bool
+}
+
+func (fms *failingManifestStore) Put(key string, body []byte, contentType string) (*BlobInfo, error) {
+	if fms.fail && strings.HasPrefix(key, PublicKeyPath+"/"+KeyComponentMetadata+"/") {
+		return nil, errors.New("Failed to write manifest")
+	}
+	return fms.BlobStore.Put(key, body, contentType)
+}
+
+func TestObsoleteOutputDeletedAfterManifest(t *testing.T) {
+	localStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	blobStore := &failingManifestStore{BlobStore: localStore}
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{}, logger)
+	executor.Clock = NewFakeClock(time.Now())
+	_, executeErr := executor.Execute(testUploadEvent("episode1.md"))
+	if executeErr != nil {
+		t.Fatalf("Failed to execute: %s", executeErr)
+	}
+	originalEnclosure, _ := blobStore.KeyFromURL(testManifest(t, blobStore, "episode1.md").Item.EnclosureLink)
+
+	// The edited episode's manifest can't be written, so its current
+	// audio is kept
+	episodeBytes, _, _ := blobStore.Get("episode1.md")
+	blobStore.Put("episode1.md", []byte(strings.Replace(string(episodeBytes), "PollyCast", "PollyCast again", 1)), "")
+	blobStore.fail = true
+	_, executeErr = executor.Execute(testUploadEvent("episode1.md"))
+	if executeErr == nil {
+		t.Fatalf("Expected the manifest write to fail")
+	}
+	_, headErr := blobStore.Head(originalEnclosure)
+	if headErr != nil {
+		t.Fatalf("Expected %s to be kept: %s", originalEnclosure, headErr)
+	}
+
+	// Once the manifest is written, the previous audio is obsolete
+	blobStore.fail = false
+	_, executeErr = executor.Execute(testUploadEvent("episode1.md"))
+	if executeErr != nil {
+		t.Fatalf("Failed to execute: %s", executeErr)
+	}
+	enclosure, _ := blobStore.KeyFromURL(testManifest(t, blobStore, "episode1.md").Item.EnclosureLink)
+	_, headErr = blobStore.Head(enclosure)
+	if enclosure == originalEnclosure || headErr != nil {
+		t.Fatalf("Expected new audio at %s: %v", enclosure, headErr)
+	}
+	_, headErr = blobStore.Head(originalEnclosure)
+	if !errors.Is(headErr, ErrBlobNotFound) {
+		t.Fatalf("Expected %s to be deleted: %v", originalEnclosure, headErr)
+	}
+}
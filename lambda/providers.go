@@ -1,6 +1,7 @@
 package lambda
 
 import (
+	"github.com/aws/aws-sdk-go/aws/session"
 	sparta "github.com/mweagle/Sparta"
 )
 
@@ -12,6 +13,12 @@ const (
 	HandlePollyTaskName = "HandlePollyTask"
 	// HandleFeedTaskName is the name of the handler that responds to PutObject
 	HandleFeedTaskName = "HandleFeedTask"
+	// HandleDeleteTaskName is the name of the handler that responds to
+	// DeleteObject and DeleteObjects
+	HandleDeleteTaskName = "HandleDeleteTask"
+	// HandleMarkFeedDirtyTaskName is the name of the handler that marks the
+	// feed dirty when an episode finishes
+	HandleMarkFeedDirtyTaskName = "HandleMarkFeedDirtyTask"
 )
 
 // Providers returns a map of function name to provider
@@ -21,6 +28,46 @@ func Providers(s3BucketResourceName string) map[string]sparta.AWSLambdaProvider
 		newHandleEpisodeS3EventTask(s3BucketResourceName),
 		newHandlePollyTask(s3BucketResourceName),
 		newHandleFeedTask(s3BucketResourceName),
+		newHandleDeleteTask(s3BucketResourceName),
+		newHandleMarkFeedDirtyTask(s3BucketResourceName),
+	}
+	providers := make(map[string]sparta.AWSLambdaProvider)
+	for _, eachEntry := range providerList {
+		providers[eachEntry.Name()] = eachEntry
+	}
+	return providers
+}
+
+// localProviders returns the providers keyed by function name, with their
+// S3 and Polly access replaced by the blob store and synthesizer
+func localProviders(blobStore BlobStore,
+	synthesizer SpeechSynthesizer) map[string]sparta.AWSLambdaProvider {
+
+	newBlobStore := func(awsSession *session.Session, bucket string) BlobStore {
+		return blobStore
+	}
+	newSynthesizer := func(awsSession *session.Session) SpeechSynthesizer {
+		return synthesizer
+	}
+	providerList := []sparta.AWSLambdaProvider{
+		&handleEpisodeS3StateChangeTask{
+			newSynthesizer: newSynthesizer,
+			newBlobStore:   newBlobStore,
+		},
+		&handlePollyTask{
+			newSynthesizer: newSynthesizer,
+			newBlobStore:   newBlobStore,
+			copyOutput:     true,
+		},
+		&handleFeedTask{
+			newBlobStore: newBlobStore,
+		},
+		&handleDeleteTask{
+			newBlobStore: newBlobStore,
+		},
+		&handleMarkFeedDirtyTask{
+			newBlobStore: newBlobStore,
+		},
 	}
 	providers := make(map[string]sparta.AWSLambdaProvider)
 	for _, eachEntry := range providerList {
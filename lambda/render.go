@@ -0,0 +1,219 @@
+package lambda
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/polly"
+	"github.com/sirupsen/logrus"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Local rendering
+////////////////////////////////////////////////////////////////////////////////
+
+// RenderOptions are the options for Render
+type RenderOptions struct {
+	// SourceDir holds the feed.md and episode sources
+	SourceDir string
+	// OutputDir is the public scope of the bucket, which receives the
+	// feed, metadata and enclosures
+	OutputDir string
+	// Synthesizer synthesizes each episode
+	Synthesizer SpeechSynthesizer
+	// Bucket is the bucket that a Polly synthesizer writes to
+	Bucket string
+	// PollInterval is the time between synthesis task polls
+	PollInterval time.Duration
+}
+
+// renderBlobStore is the bucket for a local render. The public scope is
+// the output directory and every other key is in the source directory.
+type renderBlobStore struct {
+	source BlobStore
+	public BlobStore
+}
+
+func (rbs *renderBlobStore) route(key string) (BlobStore, string) {
+	publicPrefix := PublicKeyPath + "/"
+	if strings.HasPrefix(key, publicPrefix) {
+		return rbs.public, strings.TrimPrefix(key, publicPrefix)
+	}
+	return rbs.source, key
+}
+
+func (rbs *renderBlobStore) Get(key string) ([]byte, *BlobInfo, error) {
+	blobStore, blobKey := rbs.route(key)
+	body, blobInfo, blobErr := blobStore.Get(blobKey)
+	if blobInfo != nil {
+		blobInfo.Key = key
+	}
+	return body, blobInfo, blobErr
+}
+
+func (rbs *renderBlobStore) Put(key string, body []byte, contentType string) (*BlobInfo, error) {
+	blobStore, blobKey := rbs.route(key)
+	blobInfo, blobErr := blobStore.Put(blobKey, body, contentType)
+	if blobInfo != nil {
+		blobInfo.Key = key
+	}
+	return blobInfo, blobErr
+}
+
+func (rbs *renderBlobStore) PutIfMatch(key string, body []byte, contentType string, etag string) (*BlobInfo, error) {
+	blobStore, blobKey := rbs.route(key)
+	blobInfo, blobErr := blobStore.PutIfMatch(blobKey, body, contentType, etag)
+	if blobInfo != nil {
+		blobInfo.Key = key
+	}
+	return blobInfo, blobErr
+}
+
+func (rbs *renderBlobStore) Head(key string) (*BlobInfo, error) {
+	blobStore, blobKey := rbs.route(key)
+	blobInfo, blobErr := blobStore.Head(blobKey)
+	if blobInfo != nil {
+		blobInfo.Key = key
+	}
+	return blobInfo, blobErr
+}
+
+func (rbs *renderBlobStore) Copy(sourceKey string, destKey string, contentType string) error {
+	if sourceKey == destKey {
+		blobStore, blobKey := rbs.route(sourceKey)
+		return blobStore.Copy(blobKey, blobKey, contentType)
+	}
+	body, _, bodyErr := rbs.Get(sourceKey)
+	if bodyErr != nil {
+		return bodyErr
+	}
+	_, putErr := rbs.Put(destKey, body, contentType)
+	return putErr
+}
+
+func (rbs *renderBlobStore) Delete(key string) error {
+	blobStore, blobKey := rbs.route(key)
+	return blobStore.Delete(blobKey)
+}
+
+func (rbs *renderBlobStore) List(prefix string) ([]*BlobInfo, error) {
+	blobStore, blobPrefix := rbs.route(prefix)
+	blobs, blobsErr := blobStore.List(blobPrefix)
+	if blobsErr != nil {
+		return nil, blobsErr
+	}
+	if blobStore == rbs.public {
+		for _, eachBlob := range blobs {
+			eachBlob.Key = path.Join(PublicKeyPath, eachBlob.Key)
+		}
+	}
+	return blobs, nil
+}
+
+func (rbs *renderBlobStore) URL(key string) string {
+	blobStore, blobKey := rbs.route(key)
+	return blobStore.URL(blobKey)
+}
+
+func (rbs *renderBlobStore) KeyFromURL(blobURL string) (string, error) {
+	publicKey, publicKeyErr := rbs.public.KeyFromURL(blobURL)
+	if publicKeyErr == nil {
+		return path.Join(PublicKeyPath, publicKey), nil
+	}
+	return rbs.source.KeyFromURL(blobURL)
+}
+
+// renderEpisode synthesizes the episode and writes its enclosure and
+// manifest, like the state machine does for an uploaded episode
+func renderEpisode(blobStore BlobStore,
+	options *RenderOptions,
+	key string,
+	logger *logrus.Logger) error {
+
+	task, taskErr := newEpisodeTask(blobStore,
+		options.Synthesizer,
+		options.Bucket,
+		key,
+		time.Now(),
+		logger)
+	if taskErr != nil {
+		return taskErr
+	}
+	// The existing output is up to date
+	if task.SynthesisSkipped {
+		return nil
+	}
+	for {
+		pollErr := pollSynthesisTask(task, options.Synthesizer, logger)
+		if pollErr != nil {
+			return pollErr
+		}
+		taskStatus := aws.StringValue(task.SynthesisTask.TaskStatus)
+		if taskStatus == polly.TaskStatusCompleted {
+			break
+		}
+		if taskStatus == polly.TaskStatusFailed {
+			return fmt.Errorf("Failed to synthesize %s (TaskID: %s): %s",
+				key,
+				aws.StringValue(task.SynthesisTask.TaskId),
+				aws.StringValue(task.SynthesisTask.TaskStatusReason))
+		}
+		time.Sleep(options.PollInterval)
+	}
+	return finalizeSynthesis(task, options.Synthesizer, blobStore, true, time.Now(), logger)
+}
+
+// Render runs the whole pipeline locally. It synthesizes every episode in
+// the source directory and writes the enclosures, the metadata and the
+// feed.xml to the output directory, in the same layout as the bucket's
+// public scope.
+func Render(options *RenderOptions, logger *logrus.Logger) error {
+	sourceStore, sourceStoreErr := NewLocalBlobStore(options.SourceDir)
+	if sourceStoreErr != nil {
+		return sourceStoreErr
+	}
+	publicStore, publicStoreErr := NewLocalBlobStore(options.OutputDir)
+	if publicStoreErr != nil {
+		return publicStoreErr
+	}
+	blobStore := &renderBlobStore{
+		source: sourceStore,
+		public: publicStore,
+	}
+
+	// Episodes are the Markdown files next to the feed.md
+	sourceBlobs, sourceBlobsErr := sourceStore.List("")
+	if sourceBlobsErr != nil {
+		return sourceBlobsErr
+	}
+	episodeKeys := []string{}
+	for _, eachBlob := range sourceBlobs {
+		if eachBlob.Key != FeedConfigName &&
+			!strings.Contains(eachBlob.Key, "/") &&
+			strings.HasSuffix(eachBlob.Key, ".md") {
+			episodeKeys = append(episodeKeys, eachBlob.Key)
+		}
+	}
+	for _, eachKey := range episodeKeys {
+		logger.WithFields(logrus.Fields{
+			"key": eachKey,
+		}).Info("Rendering episode")
+		renderErr := renderEpisode(blobStore, options, eachKey, logger)
+		if renderErr != nil {
+			return renderErr
+		}
+	}
+
+	feedErr := generateFeed(blobStore, time.Now(), logger)
+	if feedErr != nil {
+		return feedErr
+	}
+	logger.WithFields(logrus.Fields{
+		"episodes": len(episodeKeys),
+		"feed":     blobStore.URL(feedKeyPath()),
+	}).Info("Rendered feed")
+	return nil
+}
@@ -0,0 +1,59 @@
+package lambda
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sparta "github.com/mweagle/Sparta"
+)
+
+func TestRender(t *testing.T) {
+	outputDir, outputDirErr := ioutil.TempDir("", "spartacast")
+	if outputDirErr != nil {
+		t.Fatalf("Failed to create output directory: %s", outputDirErr)
+	}
+	defer os.RemoveAll(outputDir)
+	logger, _ := sparta.NewLogger("info")
+
+	// Rendering again replaces the previous output
+	for i := 0; i != 2; i++ {
+		renderErr := Render(&RenderOptions{
+			SourceDir:   filepath.Join("..", "media"),
+			OutputDir:   outputDir,
+			Synthesizer: &FakeSynthesizer{},
+		}, logger)
+		if renderErr != nil {
+			t.Fatalf("Failed to render: %s", renderErr)
+		}
+	}
+	_, feedErr := os.Stat(filepath.Join(outputDir, "feed", "feed.xml"))
+	if feedErr != nil {
+		t.Fatalf("Failed to find feed.xml: %s", feedErr)
+	}
+	publicStore, _ := NewLocalBlobStore(outputDir)
+	for _, eachEpisode := range []string{"episode1.md", "episode2.md"} {
+		manifestBytes, _, manifestErr := publicStore.Get(filepath.ToSlash(filepath.Join(KeyComponentMetadata, eachEpisode+".json")))
+		if manifestErr != nil {
+			t.Fatalf("Failed to read manifest for %s: %s", eachEpisode, manifestErr)
+		}
+		manifest := SpartaCastTask{}
+		unmarshalErr := json.Unmarshal(manifestBytes, &manifest)
+		if unmarshalErr != nil {
+			t.Fatalf("Failed to parse manifest for %s: %s", eachEpisode, unmarshalErr)
+		}
+		enclosureKey, enclosureKeyErr := publicStore.KeyFromURL(manifest.Item.EnclosureLink)
+		if enclosureKeyErr != nil {
+			t.Fatalf("Enclosure %s isn't in the output: %s", manifest.Item.EnclosureLink, enclosureKeyErr)
+		}
+		enclosureInfo, enclosureInfoErr := publicStore.Head(enclosureKey)
+		if enclosureInfoErr != nil {
+			t.Fatalf("Failed to find enclosure for %s: %s", eachEpisode, enclosureInfoErr)
+		}
+		if enclosureInfo.Size == 0 || enclosureInfo.Size != manifest.Item.EnclosureByteLength {
+			t.Fatalf("Unexpected enclosure size for %s: %d", eachEpisode, enclosureInfo.Size)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package lambda
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/polly"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Speech synthesis
+////////////////////////////////////////////////////////////////////////////////
+
+// SynthesisRequest is the text of one synthesis part and the voice to read
+// it with. The output is written with the KeyPrefix in the Bucket, or
+// wherever the synthesizer keeps its output.
+type SynthesisRequest struct {
+	Bucket       string
+	KeyPrefix    string
+	Text         string
+	TextType     string
+	VoiceID      string
+	Engine       string
+	LanguageCode string
+	SampleRate   string
+}
+
+// SpeechSynthesizer is a text-to-speech backend. Synthesis is asynchronous:
+// StartSynthesis returns a task that's polled until its TaskStatus is
+// completed or failed, and the MP3 audio of a completed task is then
+// fetched. Tasks are Polly SynthesisTask values, whatever the backend, so
+// that they can be passed along the state machine.
+type SpeechSynthesizer interface {
+	StartSynthesis(request *SynthesisRequest) (*polly.SynthesisTask, error)
+	PollSynthesis(task *polly.SynthesisTask) (*polly.SynthesisTask, error)
+	FetchSynthesis(task *polly.SynthesisTask) ([]byte, error)
+}
+
+// speechSynthesizerConstructor returns the SpeechSynthesizer that a
+// handler uses
+type speechSynthesizerConstructor func(awsSession *session.Session) SpeechSynthesizer
+
+// pollySynthesizer synthesizes speech with Polly, which writes its output
+// to S3
+type pollySynthesizer struct {
+	pollySvc *polly.Polly
+	s3Svc    *s3.S3
+}
+
+// NewPollySynthesizer returns a SpeechSynthesizer backed by Polly
+func NewPollySynthesizer(awsSession *session.Session) SpeechSynthesizer {
+	return &pollySynthesizer{
+		pollySvc: polly.New(awsSession),
+		s3Svc:    s3.New(awsSession),
+	}
+}
+
+func (ps *pollySynthesizer) StartSynthesis(request *SynthesisRequest) (*polly.SynthesisTask, error) {
+	pollyInput := &polly.StartSpeechSynthesisTaskInput{
+		OutputFormat:       aws.String(polly.OutputFormatMp3),
+		OutputS3BucketName: aws.String(request.Bucket),
+		OutputS3KeyPrefix:  aws.String(request.KeyPrefix),
+		VoiceId:            aws.String(request.VoiceID),
+		Engine:             aws.String(request.Engine),
+		LanguageCode:       aws.String(request.LanguageCode),
+		Text:               aws.String(request.Text),
+		TextType:           aws.String(request.TextType),
+	}
+	if request.SampleRate != "" {
+		pollyInput.SampleRate = aws.String(request.SampleRate)
+	}
+	pollyResp, pollyRespErr := ps.pollySvc.StartSpeechSynthesisTask(pollyInput)
+	if pollyRespErr != nil {
+		return nil, pollyRespErr
+	}
+	return pollyResp.SynthesisTask, nil
+}
+
+func (ps *pollySynthesizer) PollSynthesis(task *polly.SynthesisTask) (*polly.SynthesisTask, error) {
+	getTaskResp, getTaskRespErr := ps.pollySvc.GetSpeechSynthesisTask(&polly.GetSpeechSynthesisTaskInput{
+		TaskId: task.TaskId,
+	})
+	if getTaskRespErr != nil {
+		return nil, getTaskRespErr
+	}
+	return getTaskResp.SynthesisTask, nil
+}
+
+func (ps *pollySynthesizer) FetchSynthesis(task *polly.SynthesisTask) ([]byte, error) {
+	bucket, keyPath, keyPathErr := s3BucketKeyFromURI(aws.StringValue(task.OutputUri))
+	if keyPathErr != nil {
+		return nil, keyPathErr
+	}
+	s3GetObjectResp, s3GetObjectRespErr := ps.s3Svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(keyPath),
+	})
+	if s3GetObjectRespErr != nil {
+		return nil, s3GetObjectRespErr
+	}
+	defer s3GetObjectResp.Body.Close()
+	return ioutil.ReadAll(s3GetObjectResp.Body)
+}
+
+// s3BucketKeyFromURI returns the bucket and key of a path style S3 URI,
+// which is how Polly reports its OutputUri
+func s3BucketKeyFromURI(s3URI string) (string, string, error) {
+	parsedURI, parsedURIErr := url.Parse(s3URI)
+	if parsedURIErr != nil {
+		return "", "", parsedURIErr
+	}
+	pathParts := strings.SplitN(strings.TrimPrefix(parsedURI.Path, "/"), "/", 2)
+	if len(pathParts) != 2 || pathParts[0] == "" || pathParts[1] == "" {
+		return "", "", fmt.Errorf("Invalid S3 URI: %s", s3URI)
+	}
+	return pathParts[0], pathParts[1], nil
+}
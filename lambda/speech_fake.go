@@ -0,0 +1,122 @@
+package lambda
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/polly"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Fake speech synthesis
+////////////////////////////////////////////////////////////////////////////////
+
+// fakeMP3Frame is a silent MPEG 1 Layer III frame, 32 kbps, 44.1 kHz, mono
+var fakeMP3Frame = append([]byte{0xFF, 0xFB, 0x10, 0xC4}, make([]byte, 100)...)
+
+// fakeCharactersPerFrame is how many characters of text each frame of fake
+// audio stands for
+const fakeCharactersPerFrame = 16
+
+// FakeSynthesizer is a deterministic SpeechSynthesizer for tests. Tasks are
+// numbered in the order they're started and stay in progress for Polls
+// polls before they complete. A request whose text contains FailText fails.
+// The audio of a task is silence, with one MP3 frame per
+// fakeCharactersPerFrame characters of text.
+type FakeSynthesizer struct {
+	Polls    int
+	FailText string
+
+	mutex    sync.Mutex
+	requests []*SynthesisRequest
+	polls    map[string]int
+}
+
+// Requests returns the requests that have been started, in order
+func (fs *FakeSynthesizer) Requests() []*SynthesisRequest {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return append([]*SynthesisRequest{}, fs.requests...)
+}
+
+func (fs *FakeSynthesizer) StartSynthesis(request *SynthesisRequest) (*polly.SynthesisTask, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	requestCopy := *request
+	fs.requests = append(fs.requests, &requestCopy)
+	if fs.polls == nil {
+		fs.polls = make(map[string]int)
+	}
+	taskID := fmt.Sprintf("fake-%04d", len(fs.requests))
+	fs.polls[taskID] = 0
+	return fs.task(taskID), nil
+}
+
+func (fs *FakeSynthesizer) PollSynthesis(task *polly.SynthesisTask) (*polly.SynthesisTask, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	taskID := aws.StringValue(task.TaskId)
+	if _, taskExists := fs.polls[taskID]; !taskExists {
+		return nil, fmt.Errorf("Unknown synthesis task: %s", taskID)
+	}
+	fs.polls[taskID]++
+	return fs.task(taskID), nil
+}
+
+func (fs *FakeSynthesizer) FetchSynthesis(task *polly.SynthesisTask) ([]byte, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	taskID := aws.StringValue(task.TaskId)
+	if _, taskExists := fs.polls[taskID]; !taskExists {
+		return nil, fmt.Errorf("Unknown synthesis task: %s", taskID)
+	}
+	if aws.StringValue(fs.task(taskID).TaskStatus) != polly.TaskStatusCompleted {
+		return nil, fmt.Errorf("Synthesis task %s isn't completed", taskID)
+	}
+	request := fs.request(taskID)
+	frameCount := 1 + utf8.RuneCountInString(request.Text)/fakeCharactersPerFrame
+	return bytes.Repeat(fakeMP3Frame, frameCount), nil
+}
+
+func (fs *FakeSynthesizer) request(taskID string) *SynthesisRequest {
+	var index int
+	fmt.Sscanf(taskID, "fake-%d", &index)
+	return fs.requests[index-1]
+}
+
+// task returns the current state of the task. The caller must hold the
+// mutex.
+func (fs *FakeSynthesizer) task(taskID string) *polly.SynthesisTask {
+	request := fs.request(taskID)
+	task := &polly.SynthesisTask{
+		CreationTime:      aws.Time(time.Unix(0, 0).UTC()),
+		Engine:            aws.String(request.Engine),
+		LanguageCode:      aws.String(request.LanguageCode),
+		OutputFormat:      aws.String(polly.OutputFormatMp3),
+		OutputUri:         aws.String(fmt.Sprintf("fake://%s/%s.%s.mp3", request.Bucket, request.KeyPrefix, taskID)),
+		RequestCharacters: aws.Int64(int64(utf8.RuneCountInString(request.Text))),
+		TaskId:            aws.String(taskID),
+		TextType:          aws.String(request.TextType),
+		VoiceId:           aws.String(request.VoiceID),
+	}
+	switch {
+	case fs.FailText != "" && strings.Contains(request.Text, fs.FailText):
+		task.TaskStatus = aws.String(polly.TaskStatusFailed)
+		task.TaskStatusReason = aws.String("Fake synthesis failure")
+	case fs.polls[taskID] == 0:
+		task.TaskStatus = aws.String(polly.TaskStatusScheduled)
+	case fs.polls[taskID] <= fs.Polls:
+		task.TaskStatus = aws.String(polly.TaskStatusInProgress)
+	default:
+		task.TaskStatus = aws.String(polly.TaskStatusCompleted)
+	}
+	return task
+}
@@ -0,0 +1,165 @@
+package lambda
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/polly"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Local speech synthesis
+////////////////////////////////////////////////////////////////////////////////
+
+const (
+	// EspeakNGCommand synthesizes speech with espeak-ng and encodes it
+	// with ffmpeg
+	EspeakNGCommand = `espeak-ng -v "$SPEECH_LANGUAGE" --stdout | ` +
+		`ffmpeg -loglevel error -f wav -i - -ar "$SPEECH_SAMPLE_RATE" -f mp3 -`
+	// PiperCommand synthesizes speech with the piper voice model in
+	// $PIPER_MODEL and encodes it with ffmpeg
+	PiperCommand = `piper --model "$PIPER_MODEL" --output_raw | ` +
+		`ffmpeg -loglevel error -f s16le -ar 22050 -ac 1 -i - -ar "$SPEECH_SAMPLE_RATE" -f mp3 -`
+)
+
+// localDefaultSampleRate is the sample rate of a request that doesn't
+// specify one, which matches Polly's default for MP3
+const localDefaultSampleRate = "22050"
+
+// LocalSynthesizer is a SpeechSynthesizer that runs an offline engine, such
+// as espeak-ng or piper, so that episodes can be rendered without AWS.
+// Command is run with sh, with the text on stdin, and must write MP3 audio
+// to stdout. The voice, language and sample rate of the request are in the
+// SPEECH_VOICE, SPEECH_LANGUAGE and SPEECH_SAMPLE_RATE environment
+// variables. Local engines don't read SSML, so SSML requests are reduced to
+// their text.
+//
+// Synthesis happens in StartSynthesis, so the task it returns is already
+// completed or failed. The audio is written to OutputDir and the task's
+// OutputUri is a file:// URI.
+type LocalSynthesizer struct {
+	Command   string
+	OutputDir string
+}
+
+func (ls *LocalSynthesizer) StartSynthesis(request *SynthesisRequest) (*polly.SynthesisTask, error) {
+	text := request.Text
+	if request.TextType == polly.TextTypeSsml {
+		plainText, plainTextErr := ssmlPlainText(text)
+		if plainTextErr != nil {
+			return nil, plainTextErr
+		}
+		text = plainText
+	}
+	sampleRate := aws.StringValue(valOrDefault(request.SampleRate, localDefaultSampleRate))
+
+	// The same request always produces the same task, so that rendering
+	// an episode twice overwrites the previous output
+	taskHash := sha256.New()
+	for _, eachValue := range []string{ls.Command,
+		request.KeyPrefix,
+		request.VoiceID,
+		request.LanguageCode,
+		sampleRate,
+		text} {
+		io.WriteString(taskHash, eachValue)
+		taskHash.Write([]byte{0})
+	}
+	taskID := hex.EncodeToString(taskHash.Sum(nil))[:32]
+	outputPath, outputPathErr := filepath.Abs(filepath.Join(ls.OutputDir,
+		filepath.FromSlash(fmt.Sprintf("%s.%s.mp3", request.KeyPrefix, taskID))))
+	if outputPathErr != nil {
+		return nil, outputPathErr
+	}
+	task := &polly.SynthesisTask{
+		CreationTime:      aws.Time(time.Now()),
+		Engine:            aws.String(request.Engine),
+		LanguageCode:      aws.String(request.LanguageCode),
+		OutputFormat:      aws.String(polly.OutputFormatMp3),
+		OutputUri:         aws.String((&url.URL{Scheme: "file", Path: filepath.ToSlash(outputPath)}).String()),
+		RequestCharacters: aws.Int64(int64(len([]rune(text)))),
+		TaskId:            aws.String(taskID),
+		TaskStatus:        aws.String(polly.TaskStatusCompleted),
+		TextType:          aws.String(request.TextType),
+		VoiceId:           aws.String(request.VoiceID),
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", ls.Command)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(),
+		"SPEECH_VOICE="+request.VoiceID,
+		"SPEECH_LANGUAGE="+strings.ToLower(request.LanguageCode),
+		"SPEECH_SAMPLE_RATE="+sampleRate)
+	runErr := cmd.Run()
+	if runErr != nil {
+		// Like Polly, a synthesis failure is reported by the task
+		task.TaskStatus = aws.String(polly.TaskStatusFailed)
+		task.TaskStatusReason = aws.String(strings.TrimSpace(fmt.Sprintf("%s: %s",
+			runErr,
+			stderr.String())))
+		return task, nil
+	}
+	mkdirErr := os.MkdirAll(filepath.Dir(outputPath), 0755)
+	if mkdirErr != nil {
+		return nil, mkdirErr
+	}
+	writeErr := ioutil.WriteFile(outputPath, stdout.Bytes(), 0644)
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	return task, nil
+}
+
+func (ls *LocalSynthesizer) PollSynthesis(task *polly.SynthesisTask) (*polly.SynthesisTask, error) {
+	return task, nil
+}
+
+func (ls *LocalSynthesizer) FetchSynthesis(task *polly.SynthesisTask) ([]byte, error) {
+	outputURI, outputURIErr := url.Parse(aws.StringValue(task.OutputUri))
+	if outputURIErr != nil {
+		return nil, outputURIErr
+	}
+	if outputURI.Scheme != "file" {
+		return nil, fmt.Errorf("Unsupported local synthesis output: %s", outputURI)
+	}
+	return ioutil.ReadFile(filepath.FromSlash(outputURI.Path))
+}
+
+// ssmlPlainText returns the text of an SSML document, with a space
+// wherever a tag separated words
+func ssmlPlainText(ssml string) (string, error) {
+	text := strings.Builder{}
+	decoder := xml.NewDecoder(strings.NewReader(ssml))
+	for {
+		token, tokenErr := decoder.Token()
+		if tokenErr == io.EOF {
+			break
+		}
+		if tokenErr != nil {
+			return "", tokenErr
+		}
+		switch typedToken := token.(type) {
+		case xml.CharData:
+			text.Write(typedToken)
+		case xml.StartElement, xml.EndElement:
+			text.WriteString(" ")
+		}
+	}
+	return strings.Join(strings.Fields(text.String()), " "), nil
+}
@@ -0,0 +1,202 @@
+package lambda
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/polly"
+	sparta "github.com/mweagle/Sparta"
+)
+
+func TestS3BucketKeyFromURI(t *testing.T) {
+	bucket, keyPath, keyPathErr := s3BucketKeyFromURI("https://s3.us-west-2.amazonaws.com/my-bucket/public/feed/episode1.md.1234.mp3")
+	if keyPathErr != nil {
+		t.Fatalf("Failed to parse URI: %s", keyPathErr)
+	}
+	if bucket != "my-bucket" || keyPath != "public/feed/episode1.md.1234.mp3" {
+		t.Fatalf("Unexpected bucket and key: %s, %s", bucket, keyPath)
+	}
+	_, _, keyPathErr = s3BucketKeyFromURI("https://s3.us-west-2.amazonaws.com/my-bucket")
+	if keyPathErr == nil {
+		t.Fatalf("Expected an error for a URI without a key")
+	}
+}
+
+func TestSSMLPlainText(t *testing.T) {
+	plainText, plainTextErr := ssmlPlainText(`<speak><p>Hello<break time="1s"/>world.</p><p>Bye &amp; thanks.</p></speak>`)
+	if plainTextErr != nil {
+		t.Fatalf("Failed to reduce SSML: %s", plainTextErr)
+	}
+	if plainText != "Hello world. Bye & thanks." {
+		t.Fatalf("Unexpected text: %q", plainText)
+	}
+}
+
+func TestFakeSynthesizer(t *testing.T) {
+	synthesizer := &FakeSynthesizer{
+		Polls: 1,
+	}
+	task, taskErr := synthesizer.StartSynthesis(&SynthesisRequest{
+		Bucket:    "bucket",
+		KeyPrefix: "public/feed/episode1.md",
+		Text:      strings.Repeat("a", 40),
+	})
+	if taskErr != nil {
+		t.Fatalf("Failed to start synthesis: %s", taskErr)
+	}
+	expectedStatus := []string{polly.TaskStatusInProgress, polly.TaskStatusCompleted}
+	for _, eachStatus := range expectedStatus {
+		task, taskErr = synthesizer.PollSynthesis(task)
+		if taskErr != nil {
+			t.Fatalf("Failed to poll synthesis: %s", taskErr)
+		}
+		if aws.StringValue(task.TaskStatus) != eachStatus {
+			t.Fatalf("Expected status %s, got %s", eachStatus, aws.StringValue(task.TaskStatus))
+		}
+	}
+	audio, audioErr := synthesizer.FetchSynthesis(task)
+	if audioErr != nil {
+		t.Fatalf("Failed to fetch synthesis: %s", audioErr)
+	}
+	audioFrames, audioFramesErr := mp3AudioFrames(audio)
+	if audioFramesErr != nil {
+		t.Fatalf("Fake audio isn't MP3: %s", audioFramesErr)
+	}
+	if len(audioFrames) != 3*len(fakeMP3Frame) {
+		t.Fatalf("Expected 3 frames, got %d bytes", len(audioFrames))
+	}
+}
+
+func TestStartEpisodeSynthesis(t *testing.T) {
+	logger, _ := sparta.NewLogger("info")
+	synthesizer := &FakeSynthesizer{}
+	configEntry := &Item{
+		Speakers: []Speaker{
+			{Name: "Alice", PollyVoiceID: "Joanna"},
+			{Name: "Bob", PollyVoiceID: "Matthew", PollyEngineType: "standard"},
+		},
+		Episode: "**Alice:** Hi Bob.\n\n**Bob:** Hi Alice.",
+	}
+	synthesisParts, synthesisPartsErr := startEpisodeSynthesis(configEntry,
+		"bucket",
+		"episode1.md",
+		synthesizer,
+		logger)
+	if synthesisPartsErr != nil {
+		t.Fatalf("Failed to start synthesis: %s", synthesisPartsErr)
+	}
+	requests := synthesizer.Requests()
+	if len(synthesisParts) != 2 || len(requests) != 2 {
+		t.Fatalf("Expected 2 parts, got %d", len(synthesisParts))
+	}
+	if synthesisParts[1].Speaker != "Bob" ||
+		requests[1].VoiceID != "Matthew" ||
+		requests[1].Engine != "standard" ||
+		requests[1].SampleRate != dialogueSampleRate ||
+		requests[1].KeyPrefix != "public/feed/episode1.md" {
+		t.Fatalf("Unexpected request: %+v", requests[1])
+	}
+
+	// Poll until they're all done
+	input := &SpartaCastTask{
+		Parts: synthesisParts,
+	}
+	pollErr := pollSynthesisParts(input, synthesizer, logger)
+	if pollErr != nil {
+		t.Fatalf("Failed to poll synthesis: %s", pollErr)
+	}
+	if aws.StringValue(input.SynthesisTask.TaskStatus) != polly.TaskStatusCompleted {
+		t.Fatalf("Expected completed task, got %s", aws.StringValue(input.SynthesisTask.TaskStatus))
+	}
+	if aws.Int64Value(input.SynthesisTask.RequestCharacters) == 0 {
+		t.Fatalf("Expected billed characters to be summed")
+	}
+}
+
+func TestStartEpisodeSynthesisFailure(t *testing.T) {
+	logger, _ := sparta.NewLogger("info")
+	synthesizer := &FakeSynthesizer{
+		FailText: "Bob",
+	}
+	configEntry := &Item{
+		Speakers: []Speaker{
+			{Name: "Alice", PollyVoiceID: "Joanna"},
+			{Name: "Bob", PollyVoiceID: "Matthew"},
+		},
+		Episode: "**Alice:** Hello.\n\n**Bob:** Hi Bob.",
+	}
+	synthesisParts, synthesisPartsErr := startEpisodeSynthesis(configEntry,
+		"bucket",
+		"episode1.md",
+		synthesizer,
+		logger)
+	if synthesisPartsErr != nil {
+		t.Fatalf("Failed to start synthesis: %s", synthesisPartsErr)
+	}
+	input := &SpartaCastTask{
+		Parts: synthesisParts,
+	}
+	pollErr := pollSynthesisParts(input, synthesizer, logger)
+	if pollErr != nil {
+		t.Fatalf("Failed to poll synthesis: %s", pollErr)
+	}
+	if aws.StringValue(input.SynthesisTask.TaskStatus) != polly.TaskStatusFailed ||
+		aws.StringValue(input.SynthesisTask.TaskId) != "fake-0002" {
+		t.Fatalf("Expected the second part to fail, got %+v", input.SynthesisTask)
+	}
+}
+
+func TestLocalSynthesizer(t *testing.T) {
+	outputDir, outputDirErr := ioutil.TempDir("", "spartacast")
+	if outputDirErr != nil {
+		t.Fatalf("Failed to create output directory: %s", outputDirErr)
+	}
+	defer os.RemoveAll(outputDir)
+	synthesizer := &LocalSynthesizer{
+		Command:   `printf '%s|%s|' "$SPEECH_VOICE" "$SPEECH_SAMPLE_RATE"; cat`,
+		OutputDir: outputDir,
+	}
+	request := &SynthesisRequest{
+		KeyPrefix:    "public/feed/episode1.md",
+		Text:         "<speak><p>Hello world.</p></speak>",
+		TextType:     polly.TextTypeSsml,
+		VoiceID:      "Joanna",
+		LanguageCode: "en-US",
+	}
+	task, taskErr := synthesizer.StartSynthesis(request)
+	if taskErr != nil {
+		t.Fatalf("Failed to start synthesis: %s", taskErr)
+	}
+	if aws.StringValue(task.TaskStatus) != polly.TaskStatusCompleted {
+		t.Fatalf("Expected completed task, got %+v", task)
+	}
+	audio, audioErr := synthesizer.FetchSynthesis(task)
+	if audioErr != nil {
+		t.Fatalf("Failed to fetch synthesis: %s", audioErr)
+	}
+	if string(audio) != "Joanna|22050|Hello world." {
+		t.Fatalf("Unexpected output: %q", audio)
+	}
+
+	// The same request is the same task
+	repeatTask, repeatTaskErr := synthesizer.StartSynthesis(request)
+	if repeatTaskErr != nil {
+		t.Fatalf("Failed to start synthesis: %s", repeatTaskErr)
+	}
+	if aws.StringValue(repeatTask.TaskId) != aws.StringValue(task.TaskId) {
+		t.Fatalf("Expected a deterministic task ID")
+	}
+
+	synthesizer.Command = "echo broken >&2; exit 3"
+	failedTask, failedTaskErr := synthesizer.StartSynthesis(request)
+	if failedTaskErr != nil {
+		t.Fatalf("Failed to start synthesis: %s", failedTaskErr)
+	}
+	if aws.StringValue(failedTask.TaskStatus) != polly.TaskStatusFailed ||
+		!strings.Contains(aws.StringValue(failedTask.TaskStatusReason), "broken") {
+		t.Fatalf("Expected failed task, got %+v", failedTask)
+	}
+}
@@ -0,0 +1,249 @@
+package lambda
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/polly"
+	"gopkg.in/russross/blackfriday.v2"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Markdown to SSML
+////////////////////////////////////////////////////////////////////////////////
+
+var ssmlEscaper = strings.NewReplacer("&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&quot;",
+	"'", "&apos;")
+
+// ssmlTagPattern matches the opening or closing tags in raw HTML
+var ssmlTagPattern = regexp.MustCompile(`<\/?([A-Za-z][\w.:-]*)`)
+
+// isSSMLMarkup returns true if the raw HTML only has SSML tags, other than
+// <speak>, so that it can be passed through to the document
+func isSSMLMarkup(html string) bool {
+	tagMatches := ssmlTagPattern.FindAllStringSubmatch(html, -1)
+	if len(tagMatches) == 0 {
+		return false
+	}
+	for _, eachMatch := range tagMatches {
+		_, tagExists := ssmlTags[eachMatch[1]]
+		if !tagExists || eachMatch[1] == "speak" {
+			return false
+		}
+	}
+	return true
+}
+
+// ssmlRenderer is a blackfriday.Renderer that produces a Polly SSML
+// document from Markdown. Formatting is mapped to pauses and emphasis and
+// anything that can't be read aloud, like images and raw HTML, is dropped.
+// Raw HTML that's SSML markup, like a <break>, is passed through. Emphasis
+// is only rendered if the engine supports it.
+type ssmlRenderer struct {
+	engine string
+	// paragraphDepth is the number of open blocks that are read as a
+	// paragraph. Only the outermost opens a <p>, since they don't nest.
+	paragraphDepth int
+}
+
+// paragraph opens or closes a block that's read as a paragraph. A block
+// within another one, like a code block in a list item, is set off by a
+// break instead.
+func (sr *ssmlRenderer) paragraph(w io.Writer, node *blackfriday.Node, entering bool) {
+	if !entering {
+		sr.paragraphDepth--
+		if sr.paragraphDepth == 0 {
+			io.WriteString(w, "</p>")
+		}
+		return
+	}
+	if sr.paragraphDepth == 0 {
+		io.WriteString(w, "<p>")
+	} else if node.Prev != nil {
+		io.WriteString(w, `<break strength="medium"/>`)
+	}
+	sr.paragraphDepth++
+}
+
+func (sr *ssmlRenderer) emphasis(w io.Writer, level string, entering bool) {
+	if !ssmlTagSupported("emphasis", sr.engine) {
+		return
+	}
+	if !entering {
+		io.WriteString(w, "</emphasis>")
+	} else if level == "" {
+		io.WriteString(w, "<emphasis>")
+	} else {
+		io.WriteString(w, `<emphasis level="`+level+`">`)
+	}
+}
+
+func (sr *ssmlRenderer) RenderHeader(w io.Writer, ast *blackfriday.Node) {
+	io.WriteString(w, "<speak>")
+}
+
+func (sr *ssmlRenderer) RenderFooter(w io.Writer, ast *blackfriday.Node) {
+	io.WriteString(w, "</speak>")
+}
+
+func (sr *ssmlRenderer) RenderNode(w io.Writer,
+	node *blackfriday.Node,
+	entering bool) blackfriday.WalkStatus {
+
+	switch node.Type {
+	case blackfriday.Heading:
+		if entering {
+			io.WriteString(w, `<break strength="strong"/>`)
+			sr.emphasis(w, "", entering)
+		} else {
+			sr.emphasis(w, "", entering)
+			io.WriteString(w, `<break strength="medium"/>`)
+		}
+	case blackfriday.Paragraph, blackfriday.List:
+		sr.paragraph(w, node, entering)
+	case blackfriday.Item:
+		if entering && node.Prev != nil {
+			io.WriteString(w, `<break strength="medium"/>`)
+		}
+	case blackfriday.Strong:
+		sr.emphasis(w, "strong", entering)
+	case blackfriday.Emph:
+		sr.emphasis(w, "moderate", entering)
+	case blackfriday.TableRow:
+		if entering {
+			io.WriteString(w, "<s>")
+		} else {
+			io.WriteString(w, "</s>")
+		}
+	case blackfriday.TableCell:
+		if entering && node.Prev != nil {
+			io.WriteString(w, `<break strength="weak"/>`)
+		}
+	case blackfriday.CodeBlock:
+		sr.paragraph(w, node, true)
+		io.WriteString(w, ssmlEscaper.Replace(strings.TrimSpace(string(node.Literal))))
+		sr.paragraph(w, node, false)
+	case blackfriday.Text, blackfriday.Code:
+		io.WriteString(w, ssmlEscaper.Replace(string(node.Literal)))
+	case blackfriday.Softbreak:
+		io.WriteString(w, " ")
+	case blackfriday.Hardbreak:
+		io.WriteString(w, `<break strength="weak"/>`)
+	case blackfriday.HorizontalRule:
+		io.WriteString(w, `<break strength="x-strong"/>`)
+	case blackfriday.HTMLBlock, blackfriday.HTMLSpan:
+		if isSSMLMarkup(string(node.Literal)) {
+			w.Write(node.Literal)
+		}
+	case blackfriday.Image, blackfriday.Del:
+		// Nothing to read aloud
+		return blackfriday.SkipChildren
+	}
+	return blackfriday.GoToNext
+}
+
+// markdownToSSML converts Markdown to a <speak> document for the Polly
+// engine. Headings are emphasized and set off by pauses, strong text is
+// strongly emphasized, list items are separated by breaks and links are
+// read by their anchor text. Engines without <emphasis> support, like
+// neural, only get the pauses.
+func markdownToSSML(markdown string, engine string) string {
+	output := blackfriday.Run([]byte(markdown),
+		blackfriday.WithExtensions(blackfriday.CommonExtensions),
+		blackfriday.WithRenderer(&ssmlRenderer{engine: engine}))
+	return string(bytes.TrimSpace(output))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SSML detection
+////////////////////////////////////////////////////////////////////////////////
+
+// speechTextKind is how the episode speech text was classified
+type speechTextKind string
+
+const (
+	// speechTextPlain is text that Polly reads as is
+	speechTextPlain speechTextKind = "text"
+	// speechTextSSML is a <speak> document
+	speechTextSSML speechTextKind = "ssml"
+	// speechTextSSMLFragment is SSML markup without a <speak> root
+	// that's wrapped before synthesis
+	speechTextSSMLFragment speechTextKind = "ssmlFragment"
+)
+
+// pollyTextType returns the Polly TextType for the classified text
+func (kind speechTextKind) pollyTextType() string {
+	if kind == speechTextPlain {
+		return polly.TextTypeText
+	}
+	return polly.TextTypeSsml
+}
+
+// parseXMLDocument returns the local name of the root element of the XML
+// document in text, together with the total number of elements. It returns
+// an error if text isn't a well-formed document with a single root, along
+// with the root name if the document got that far.
+func parseXMLDocument(text string) (string, int, error) {
+	decoder := xml.NewDecoder(strings.NewReader(text))
+	rootName := ""
+	elementCount := 0
+	depth := 0
+	for {
+		token, tokenErr := decoder.Token()
+		if tokenErr == io.EOF {
+			break
+		}
+		if tokenErr != nil {
+			return rootName, 0, tokenErr
+		}
+		switch typedToken := token.(type) {
+		case xml.StartElement:
+			if depth == 0 && rootName != "" {
+				return rootName, 0, fmt.Errorf("multiple root elements: <%s>, <%s>",
+					rootName,
+					typedToken.Name.Local)
+			}
+			if depth == 0 {
+				rootName = typedToken.Name.Local
+			}
+			depth++
+			elementCount++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(bytes.TrimSpace(typedToken)) != 0 {
+				return rootName, 0, fmt.Errorf("text outside of the root element")
+			}
+		}
+	}
+	if rootName == "" {
+		return "", 0, fmt.Errorf("no root element")
+	}
+	return rootName, elementCount, nil
+}
+
+// classifySpeechText returns the text to synthesize and how it was
+// classified. A document with a <speak> root is SSML, even if it isn't
+// well-formed, so that the error surfaces rather than Polly reading the
+// markup aloud. Text that contains SSML tags, but no <speak> root, is
+// wrapped in one. Anything else is plain text.
+func classifySpeechText(text string) (string, speechTextKind) {
+	trimmedText := strings.TrimSpace(text)
+	rootName, _, _ := parseXMLDocument(trimmedText)
+	if rootName == "speak" {
+		return trimmedText, speechTextSSML
+	}
+	wrappedText := "<speak>" + trimmedText + "</speak>"
+	_, elementCount, wrappedErr := parseXMLDocument(wrappedText)
+	if wrappedErr == nil && elementCount > 1 {
+		return wrappedText, speechTextSSMLFragment
+	}
+	return text, speechTextPlain
+}
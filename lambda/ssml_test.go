@@ -0,0 +1,239 @@
+package lambda
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/polly"
+)
+
+func TestMarkdownToSSML(t *testing.T) {
+	testCases := []struct {
+		name     string
+		markdown string
+		expected string
+	}{
+		{
+			name:     "paragraph",
+			markdown: "Hello world",
+			expected: "<speak><p>Hello world</p></speak>",
+		},
+		{
+			name:     "heading",
+			markdown: "## Notes\n\nSome notes",
+			expected: `<speak><break strength="strong"/><emphasis>Notes</emphasis><break strength="medium"/><p>Some notes</p></speak>`,
+		},
+		{
+			name:     "strong",
+			markdown: "This is **amazing** news",
+			expected: `<speak><p>This is <emphasis level="strong">amazing</emphasis> news</p></speak>`,
+		},
+		{
+			name:     "list",
+			markdown: "- CloudTrail\n- EventBridge\n- Polly",
+			expected: `<speak><p>CloudTrail<break strength="medium"/>EventBridge<break strength="medium"/>Polly</p></speak>`,
+		},
+		{
+			name:     "list item paragraphs",
+			markdown: "- One\n\n    More on one\n\n- Two",
+			expected: `<speak><p>One<break strength="medium"/>More on one<break strength="medium"/>Two</p></speak>`,
+		},
+		{
+			name:     "list item code block",
+			markdown: "- Run\n\n  ```\n  make\n  ```\n- Done",
+			expected: `<speak><p>Run<break strength="medium"/>make<break strength="medium"/>Done</p></speak>`,
+		},
+		{
+			name:     "nested list",
+			markdown: "- One\n  - Inner\n- Two",
+			expected: `<speak><p>One<break strength="medium"/>Inner<break strength="medium"/>Two</p></speak>`,
+		},
+		{
+			name:     "link",
+			markdown: "Built with [Amazon Polly](https://aws.amazon.com/polly/)",
+			expected: "<speak><p>Built with Amazon Polly</p></speak>",
+		},
+		{
+			name:     "escaped",
+			markdown: "Q&A <i>",
+			expected: "<speak><p>Q&amp;A </p></speak>",
+		},
+		{
+			name:     "image",
+			markdown: "Look ![a gopher](gopher.png)",
+			expected: "<speak><p>Look </p></speak>",
+		},
+	}
+	for _, eachTestCase := range testCases {
+		t.Run(eachTestCase.name, func(t *testing.T) {
+			ssml := markdownToSSML(eachTestCase.markdown, polly.EngineStandard)
+			if ssml != eachTestCase.expected {
+				t.Fatalf("Unexpected SSML.\nExpected: %s\nActual:   %s",
+					eachTestCase.expected,
+					ssml)
+			}
+		})
+	}
+}
+
+func TestEpisodeSpeechText(t *testing.T) {
+	testCases := []struct {
+		name     string
+		markdown string
+		expected string
+	}{
+		{
+			name:     "fenced ssml",
+			markdown: "```html\n<speak>Hello</speak>\n```\n",
+			expected: "<speak>Hello</speak>\n",
+		},
+		{
+			name:     "sole fenced block",
+			markdown: "```\nHello <break time=\"1s\"/>\n```\n",
+			expected: "Hello <break time=\"1s\"/>\n",
+		},
+		{
+			name:     "fenced ssml after text",
+			markdown: "Listen.\n```ssml\n<speak>Hi</speak>\n```",
+			expected: "<speak>Hi</speak>\n",
+		},
+		{
+			name:     "fenced text after text",
+			markdown: "Listen.\n```\n**Bob:** Not a turn.\n```",
+			expected: "<speak><p>Listen.</p><p>**Bob:** Not a turn.</p></speak>",
+		},
+		{
+			name:     "fenced html without speak",
+			markdown: "Bold it.\n```html\n<b>Hi</b>\n```",
+			expected: "<speak><p>Bold it.</p><p>&lt;b&gt;Hi&lt;/b&gt;</p></speak>",
+		},
+		{
+			name:     "unfenced ssml",
+			markdown: "<speak>\n  Hello <break time=\"1s\"/> world\n</speak>\n",
+			expected: "<speak>\n  Hello <break time=\"1s\"/> world\n</speak>\n",
+		},
+		{
+			name:     "unfenced ssml fragment",
+			markdown: "Hello <break time=\"1s\"/> **world**",
+			expected: `<speak><p>Hello <break time="1s"/> <emphasis level="strong">world</emphasis></p></speak>`,
+		},
+		{
+			name:     "unfenced ssml block",
+			markdown: "<p>Hello <emphasis>world</emphasis></p>\n\nGoodbye",
+			expected: "<speak><p>Hello <emphasis>world</emphasis></p><p>Goodbye</p></speak>",
+		},
+		{
+			name:     "unfenced html",
+			markdown: "Hello <b>world</b>",
+			expected: "<speak><p>Hello world</p></speak>",
+		},
+	}
+	for _, eachTestCase := range testCases {
+		t.Run(eachTestCase.name, func(t *testing.T) {
+			speechText := episodeSpeechText(eachTestCase.markdown, polly.EngineStandard)
+			if speechText != eachTestCase.expected {
+				t.Fatalf("Unexpected speech text.\nExpected: %q\nActual:   %q",
+					eachTestCase.expected,
+					speechText)
+			}
+		})
+	}
+}
+
+func TestClassifySpeechText(t *testing.T) {
+	testCases := []struct {
+		name         string
+		text         string
+		expectedText string
+		expectedKind speechTextKind
+	}{
+		{
+			name:         "document",
+			text:         "<speak>Hello <break time=\"1s\"/> world</speak>",
+			expectedText: "<speak>Hello <break time=\"1s\"/> world</speak>",
+			expectedKind: speechTextSSML,
+		},
+		{
+			name:         "leading whitespace",
+			text:         "\n  <speak>\n    Hello\n  </speak>\n",
+			expectedText: "<speak>\n    Hello\n  </speak>",
+			expectedKind: speechTextSSML,
+		},
+		{
+			name:         "xml declaration",
+			text:         "<?xml version=\"1.0\"?>\n<speak>Hello</speak>",
+			expectedText: "<?xml version=\"1.0\"?>\n<speak>Hello</speak>",
+			expectedKind: speechTextSSML,
+		},
+		{
+			name:         "prefixed tags",
+			text:         "<speak><amazon:domain name=\"news\">Wow</amazon:domain></speak>",
+			expectedText: "<speak><amazon:domain name=\"news\">Wow</amazon:domain></speak>",
+			expectedKind: speechTextSSML,
+		},
+		{
+			name:         "malformed document",
+			text:         "<speak>Hello <break time=\"1s\"></speak>",
+			expectedText: "<speak>Hello <break time=\"1s\"></speak>",
+			expectedKind: speechTextSSML,
+		},
+		{
+			name:         "fragment",
+			text:         "Hello <break time=\"1s\"/> world",
+			expectedText: "<speak>Hello <break time=\"1s\"/> world</speak>",
+			expectedKind: speechTextSSMLFragment,
+		},
+		{
+			name:         "fragment with whitespace",
+			text:         "\n<p>Hello</p>\n<p>World</p>\n",
+			expectedText: "<speak><p>Hello</p>\n<p>World</p></speak>",
+			expectedKind: speechTextSSMLFragment,
+		},
+		{
+			name:         "speak prefixed tag",
+			text:         "<speaker>Bob",
+			expectedText: "<speaker>Bob",
+			expectedKind: speechTextPlain,
+		},
+		{
+			name:         "plain text",
+			text:         "Hello world",
+			expectedText: "Hello world",
+			expectedKind: speechTextPlain,
+		},
+		{
+			name:         "plain text with markup characters",
+			text:         "Q&A: is 1 < 2?",
+			expectedText: "Q&A: is 1 < 2?",
+			expectedKind: speechTextPlain,
+		},
+		{
+			name:         "converted markdown",
+			text:         markdownToSSML("# Notes\n\nHello", polly.EngineStandard),
+			expectedText: markdownToSSML("# Notes\n\nHello", polly.EngineStandard),
+			expectedKind: speechTextSSML,
+		},
+	}
+	for _, eachTestCase := range testCases {
+		t.Run(eachTestCase.name, func(t *testing.T) {
+			speechText, speechKind := classifySpeechText(eachTestCase.text)
+			if speechKind != eachTestCase.expectedKind {
+				t.Fatalf("Unexpected kind. Expected: %s, Actual: %s",
+					eachTestCase.expectedKind,
+					speechKind)
+			}
+			if speechText != eachTestCase.expectedText {
+				t.Fatalf("Unexpected text.\nExpected: %q\nActual:   %q",
+					eachTestCase.expectedText,
+					speechText)
+			}
+		})
+	}
+}
+
+func TestMarkdownToSSMLNeural(t *testing.T) {
+	ssml := markdownToSSML("## Notes\n\nThis is **amazing**", polly.EngineNeural)
+	expected := `<speak><break strength="strong"/>Notes<break strength="medium"/><p>This is amazing</p></speak>`
+	if ssml != expected {
+		t.Fatalf("Unexpected SSML.\nExpected: %s\nActual:   %s", expected, ssml)
+	}
+}
@@ -0,0 +1,414 @@
+package lambda
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/polly"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// SSML validation
+////////////////////////////////////////////////////////////////////////////////
+
+const (
+	ssmlNamespace = "http://www.w3.org/2001/10/synthesis"
+	xmlNamespace  = "http://www.w3.org/XML/1998/namespace"
+	// ssmlMaxBreak is the longest pause Polly supports
+	ssmlMaxBreak = 10 * time.Second
+)
+
+// ssmlEngines is the set of Polly engines that support an SSML feature
+type ssmlEngines map[string]bool
+
+var (
+	ssmlAllEngines   = ssmlEngines{polly.EngineStandard: true, polly.EngineNeural: true}
+	ssmlStandardOnly = ssmlEngines{polly.EngineStandard: true}
+	ssmlNeuralOnly   = ssmlEngines{polly.EngineNeural: true}
+)
+
+// ssmlAttributeSpec describes a supported attribute. If values is non-nil,
+// the attribute is restricted to its keys, each with its own engines.
+type ssmlAttributeSpec struct {
+	engines ssmlEngines
+	values  map[string]ssmlEngines
+}
+
+type ssmlTagSpec struct {
+	engines    ssmlEngines
+	attributes map[string]ssmlAttributeSpec
+}
+
+// ssmlTags are the SSML tags that Polly supports. See
+// https://docs.aws.amazon.com/polly/latest/dg/supportedtags.html
+var ssmlTags = map[string]ssmlTagSpec{
+	"speak": {
+		engines: ssmlAllEngines,
+		attributes: map[string]ssmlAttributeSpec{
+			"xml:lang": {engines: ssmlAllEngines},
+		},
+	},
+	"break": {
+		engines: ssmlAllEngines,
+		attributes: map[string]ssmlAttributeSpec{
+			"time": {engines: ssmlAllEngines},
+			"strength": {
+				engines: ssmlAllEngines,
+				values: map[string]ssmlEngines{
+					"none":     ssmlAllEngines,
+					"x-weak":   ssmlAllEngines,
+					"weak":     ssmlAllEngines,
+					"medium":   ssmlAllEngines,
+					"strong":   ssmlAllEngines,
+					"x-strong": ssmlAllEngines,
+				},
+			},
+		},
+	},
+	"emphasis": {
+		engines: ssmlStandardOnly,
+		attributes: map[string]ssmlAttributeSpec{
+			"level": {
+				engines: ssmlStandardOnly,
+				values: map[string]ssmlEngines{
+					"strong":   ssmlStandardOnly,
+					"moderate": ssmlStandardOnly,
+					"reduced":  ssmlStandardOnly,
+				},
+			},
+		},
+	},
+	"lang": {
+		engines: ssmlAllEngines,
+		attributes: map[string]ssmlAttributeSpec{
+			"xml:lang": {engines: ssmlAllEngines},
+		},
+	},
+	"mark": {
+		engines: ssmlAllEngines,
+		attributes: map[string]ssmlAttributeSpec{
+			"name": {engines: ssmlAllEngines},
+		},
+	},
+	"p": {engines: ssmlAllEngines},
+	"phoneme": {
+		engines: ssmlAllEngines,
+		attributes: map[string]ssmlAttributeSpec{
+			"alphabet": {
+				engines: ssmlAllEngines,
+				values: map[string]ssmlEngines{
+					"ipa":     ssmlAllEngines,
+					"x-sampa": ssmlAllEngines,
+				},
+			},
+			"ph": {engines: ssmlAllEngines},
+		},
+	},
+	"prosody": {
+		engines: ssmlAllEngines,
+		attributes: map[string]ssmlAttributeSpec{
+			"rate":                {engines: ssmlAllEngines},
+			"volume":              {engines: ssmlAllEngines},
+			"pitch":               {engines: ssmlStandardOnly},
+			"amazon:max-duration": {engines: ssmlStandardOnly},
+		},
+	},
+	"s": {engines: ssmlAllEngines},
+	"say-as": {
+		engines: ssmlAllEngines,
+		attributes: map[string]ssmlAttributeSpec{
+			"interpret-as": {engines: ssmlAllEngines},
+			"format":       {engines: ssmlAllEngines},
+		},
+	},
+	"sub": {
+		engines: ssmlAllEngines,
+		attributes: map[string]ssmlAttributeSpec{
+			"alias": {engines: ssmlAllEngines},
+		},
+	},
+	"w": {
+		engines: ssmlAllEngines,
+		attributes: map[string]ssmlAttributeSpec{
+			"role": {engines: ssmlAllEngines},
+		},
+	},
+	"amazon:auto-breaths": {
+		engines: ssmlStandardOnly,
+		attributes: map[string]ssmlAttributeSpec{
+			"volume":    {engines: ssmlStandardOnly},
+			"frequency": {engines: ssmlStandardOnly},
+			"duration":  {engines: ssmlStandardOnly},
+		},
+	},
+	"amazon:breath": {
+		engines: ssmlStandardOnly,
+		attributes: map[string]ssmlAttributeSpec{
+			"volume":   {engines: ssmlStandardOnly},
+			"duration": {engines: ssmlStandardOnly},
+		},
+	},
+	"amazon:domain": {
+		engines: ssmlNeuralOnly,
+		attributes: map[string]ssmlAttributeSpec{
+			"name": {
+				engines: ssmlNeuralOnly,
+				values: map[string]ssmlEngines{
+					"news":           ssmlNeuralOnly,
+					"conversational": ssmlNeuralOnly,
+				},
+			},
+		},
+	},
+	"amazon:effect": {
+		engines: ssmlAllEngines,
+		attributes: map[string]ssmlAttributeSpec{
+			"name": {
+				engines: ssmlAllEngines,
+				values: map[string]ssmlEngines{
+					"drc":       ssmlAllEngines,
+					"whispered": ssmlStandardOnly,
+				},
+			},
+			"phonation": {
+				engines: ssmlStandardOnly,
+				values: map[string]ssmlEngines{
+					"soft": ssmlStandardOnly,
+				},
+			},
+			"vocal-tract-length": {engines: ssmlStandardOnly},
+		},
+	},
+}
+
+// sourceLineOffset returns the number of lines in source before text, or 0
+// if text isn't in source, such as SSML converted from Markdown
+func sourceLineOffset(source string, text string) int {
+	textIndex := strings.Index(source, text)
+	if text == "" || textIndex < 0 {
+		return 0
+	}
+	return strings.Count(source[:textIndex], "\n")
+}
+
+// ssmlTagSupported returns true if the engine supports tagName
+func ssmlTagSupported(tagName string, engine string) bool {
+	tagSpec, tagSpecExists := ssmlTags[tagName]
+	return tagSpecExists && tagSpec.engines[engine]
+}
+
+// ssmlIssue is a single validation failure
+type ssmlIssue struct {
+	Line    int
+	Tag     string
+	Message string
+}
+
+// ssmlValidationError lists every issue found in an SSML document. If the
+// Source key and the Line that the SSML starts on are set, issues are
+// positioned in the source like markson errors. Otherwise they're
+// positioned within the SSML.
+type ssmlValidationError struct {
+	Engine string
+	Source string
+	Line   int
+	Issues []ssmlIssue
+}
+
+// position returns the "source:line" prefix of the issue
+func (sve *ssmlValidationError) position(issue ssmlIssue) string {
+	if sve.Source == "" || sve.Line <= 0 {
+		return fmt.Sprintf("ssml:%d", issue.Line)
+	}
+	return fmt.Sprintf("%s:%d", sve.Source, sve.Line+issue.Line-1)
+}
+
+func (sve *ssmlValidationError) Error() string {
+	messages := make([]string, 0, len(sve.Issues))
+	for _, eachIssue := range sve.Issues {
+		message := fmt.Sprintf("%s: %s", sve.position(eachIssue), eachIssue.Message)
+		if eachIssue.Tag != "" {
+			message = fmt.Sprintf("%s: <%s>: %s",
+				sve.position(eachIssue),
+				eachIssue.Tag,
+				eachIssue.Message)
+		}
+		messages = append(messages, message)
+	}
+	return fmt.Sprintf("Invalid SSML for the %s engine:\n%s",
+		sve.Engine,
+		strings.Join(messages, "\n"))
+}
+
+// ssmlName returns the prefixed name of an SSML tag or attribute
+func ssmlName(name xml.Name) string {
+	switch name.Space {
+	case "", ssmlNamespace:
+		return name.Local
+	case xmlNamespace:
+		return "xml:" + name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// parseSSMLDuration parses an SSML time value, like "2s" or "500ms"
+func parseSSMLDuration(value string) (time.Duration, error) {
+	if !strings.HasSuffix(value, "s") {
+		return 0, fmt.Errorf("%q must be in seconds (s) or milliseconds (ms)", value)
+	}
+	duration, durationErr := time.ParseDuration(value)
+	if durationErr != nil || duration < 0 {
+		return 0, fmt.Errorf("%q is not a valid time", value)
+	}
+	return duration, nil
+}
+
+// parseSSMLNumber parses a number with the given suffix, like "+6dB"
+func parseSSMLNumber(value string, suffix string) (float64, bool) {
+	if !strings.HasSuffix(value, suffix) {
+		return 0, false
+	}
+	number, numberErr := strconv.ParseFloat(strings.TrimSuffix(value, suffix), 64)
+	return number, numberErr == nil
+}
+
+// validateSSMLValue checks the value of attributes that have a range
+func validateSSMLValue(tagName string, attrName string, value string) error {
+	switch tagName + "/" + attrName {
+	case "break/time":
+		duration, durationErr := parseSSMLDuration(value)
+		if durationErr != nil {
+			return durationErr
+		}
+		if duration > ssmlMaxBreak {
+			return fmt.Errorf("time %q exceeds the maximum of %s", value, ssmlMaxBreak)
+		}
+	case "prosody/amazon:max-duration":
+		_, durationErr := parseSSMLDuration(value)
+		return durationErr
+	case "prosody/rate":
+		switch value {
+		case "x-slow", "slow", "medium", "fast", "x-fast":
+			return nil
+		}
+		rate, rateOk := parseSSMLNumber(value, "%")
+		if !rateOk || rate < 20 || rate > 200 {
+			return fmt.Errorf("rate %q must be a named rate or between 20%% and 200%%", value)
+		}
+	case "prosody/volume":
+		switch value {
+		case "default", "silent", "x-soft", "soft", "medium", "loud", "x-loud":
+			return nil
+		}
+		volume, volumeOk := parseSSMLNumber(value, "dB")
+		if !volumeOk || volume > 6 {
+			return fmt.Errorf("volume %q must be a named volume or at most +6dB", value)
+		}
+	case "prosody/pitch":
+		switch value {
+		case "default", "x-low", "low", "medium", "high", "x-high":
+			return nil
+		}
+		_, pitchOk := parseSSMLNumber(value, "%")
+		if !pitchOk || (!strings.HasPrefix(value, "+") && !strings.HasPrefix(value, "-")) {
+			return fmt.Errorf("pitch %q must be a named pitch or a relative percentage", value)
+		}
+	}
+	return nil
+}
+
+// validateSSML checks that ssml is a well-formed <speak> document that
+// only uses the tags, attributes and values that the Polly engine supports.
+// It returns an *ssmlValidationError that lists each issue.
+func validateSSML(ssml string, engine string) error {
+	validationErr := &ssmlValidationError{
+		Engine: engine,
+	}
+	addIssue := func(line int, tagName string, format string, args ...interface{}) {
+		validationErr.Issues = append(validationErr.Issues, ssmlIssue{
+			Line:    line,
+			Tag:     tagName,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	decoder := xml.NewDecoder(strings.NewReader(ssml))
+	depth := 0
+	for {
+		token, tokenErr := decoder.Token()
+		if tokenErr == io.EOF {
+			break
+		}
+		if tokenErr != nil {
+			line, _ := decoder.InputPos()
+			if syntaxErr, isSyntaxErr := tokenErr.(*xml.SyntaxError); isSyntaxErr {
+				line = syntaxErr.Line
+				tokenErr = fmt.Errorf("%s", syntaxErr.Msg)
+			}
+			addIssue(line, "", "malformed SSML: %s", tokenErr)
+			break
+		}
+		startElement, isStartElement := token.(xml.StartElement)
+		if !isStartElement {
+			if _, isEndElement := token.(xml.EndElement); isEndElement {
+				depth--
+			}
+			continue
+		}
+		depth++
+		line, _ := decoder.InputPos()
+		tagName := ssmlName(startElement.Name)
+		if depth == 1 && tagName != "speak" {
+			addIssue(line, tagName, "the root element must be <speak>")
+		}
+		tagSpec, tagSpecExists := ssmlTags[tagName]
+		if !tagSpecExists {
+			addIssue(line, tagName, "unsupported tag")
+			continue
+		}
+		if !tagSpec.engines[engine] {
+			addIssue(line, tagName, "not supported by the %s engine", engine)
+			continue
+		}
+		for _, eachAttr := range startElement.Attr {
+			attrName := ssmlName(eachAttr.Name)
+			if eachAttr.Name.Space == "xmlns" || attrName == "xmlns" {
+				continue
+			}
+			attrSpec, attrSpecExists := tagSpec.attributes[attrName]
+			if !attrSpecExists {
+				addIssue(line, tagName, "unsupported attribute %s", attrName)
+				continue
+			}
+			if !attrSpec.engines[engine] {
+				addIssue(line, tagName, "attribute %s is not supported by the %s engine",
+					attrName,
+					engine)
+				continue
+			}
+			if attrSpec.values != nil {
+				valueEngines, valueExists := attrSpec.values[eachAttr.Value]
+				if !valueExists {
+					addIssue(line, tagName, "unsupported value %s=%q", attrName, eachAttr.Value)
+				} else if !valueEngines[engine] {
+					addIssue(line, tagName, "%s=%q is not supported by the %s engine",
+						attrName,
+						eachAttr.Value,
+						engine)
+				}
+				continue
+			}
+			valueErr := validateSSMLValue(tagName, attrName, eachAttr.Value)
+			if valueErr != nil {
+				addIssue(line, tagName, "%s", valueErr)
+			}
+		}
+	}
+	if len(validationErr.Issues) != 0 {
+		return validationErr
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package lambda
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/polly"
+	"github.com/sirupsen/logrus"
+)
+
+const testEpisodeSSML = `<speak>
+  This is the first Sparta PollyCast. Generate podcasts using Markdown and AWS
+  Polly.
+  <amazon:domain name="news">Can you believe it!</amazon:domain>
+  <break time="2s" />
+  <amazon:effect name="whispered">
+    And it's all done with AWS Lambda and Step Functions
+  </amazon:effect>
+</speak>`
+
+func TestValidateSSML(t *testing.T) {
+	testCases := []struct {
+		name   string
+		ssml   string
+		engine string
+		// issues are the expected "line <tag>" prefixes, if any
+		issues []string
+	}{
+		{
+			name:   "episode neural",
+			ssml:   testEpisodeSSML,
+			engine: polly.EngineNeural,
+			issues: []string{`ssml:6: <amazon:effect>: name="whispered"`},
+		},
+		{
+			name:   "episode standard",
+			ssml:   testEpisodeSSML,
+			engine: polly.EngineStandard,
+			issues: []string{"ssml:4: <amazon:domain>: not supported"},
+		},
+		{
+			name:   "emphasis neural",
+			ssml:   `<speak><emphasis level="strong">Wow</emphasis></speak>`,
+			engine: polly.EngineNeural,
+			issues: []string{"ssml:1: <emphasis>: not supported"},
+		},
+		{
+			name:   "break limit",
+			ssml:   "<speak>\n<break time=\"11s\"/>\n<break time=\"500ms\"/></speak>",
+			engine: polly.EngineNeural,
+			issues: []string{"ssml:2: <break>: time"},
+		},
+		{
+			name:   "prosody ranges",
+			ssml:   "<speak>\n<prosody rate=\"300%\">Fast</prosody>\n<prosody volume=\"+10dB\">Loud</prosody>\n<prosody rate=\"x-slow\" volume=\"-3dB\">Ok</prosody></speak>",
+			engine: polly.EngineNeural,
+			issues: []string{"ssml:2: <prosody>: rate", "ssml:3: <prosody>: volume"},
+		},
+		{
+			name:   "prosody pitch neural",
+			ssml:   `<speak><prosody pitch="+10%">High</prosody></speak>`,
+			engine: polly.EngineNeural,
+			issues: []string{"ssml:1: <prosody>: attribute pitch"},
+		},
+		{
+			name:   "unsupported tag",
+			ssml:   "<speak>\n<audio src=\"x.mp3\"/></speak>",
+			engine: polly.EngineStandard,
+			issues: []string{"ssml:2: <audio>: unsupported tag"},
+		},
+		{
+			name:   "malformed",
+			ssml:   "<speak>\nHello\n<break time=\"1s\">\n</speak>",
+			engine: polly.EngineStandard,
+			issues: []string{"ssml:4: malformed SSML"},
+		},
+		{
+			name:   "namespace",
+			ssml:   `<speak xmlns="http://www.w3.org/2001/10/synthesis" xml:lang="en-US"><lang xml:lang="fr-FR">Bonjour</lang></speak>`,
+			engine: polly.EngineNeural,
+		},
+		{
+			name:   "converted markdown neural",
+			ssml:   markdownToSSML("# Notes\n\nThis is **amazing**\n\n- One\n- Two", polly.EngineNeural),
+			engine: polly.EngineNeural,
+		},
+		{
+			name:   "converted markdown standard",
+			ssml:   markdownToSSML("# Notes\n\nThis is **amazing**\n\n- One\n- Two", polly.EngineStandard),
+			engine: polly.EngineStandard,
+		},
+	}
+	for _, eachTestCase := range testCases {
+		t.Run(eachTestCase.name, func(t *testing.T) {
+			validateErr := validateSSML(eachTestCase.ssml, eachTestCase.engine)
+			if len(eachTestCase.issues) == 0 {
+				if validateErr != nil {
+					t.Fatalf("Unexpected error: %s", validateErr)
+				}
+				return
+			}
+			validationErr, isValidationErr := validateErr.(*ssmlValidationError)
+			if !isValidationErr {
+				t.Fatalf("Expected *ssmlValidationError, got: %#v", validateErr)
+			}
+			if len(validationErr.Issues) != len(eachTestCase.issues) {
+				t.Fatalf("Expected %d issues, got:\n%s", len(eachTestCase.issues), validateErr)
+			}
+			errorLines := strings.Split(validateErr.Error(), "\n")[1:]
+			for i, eachPrefix := range eachTestCase.issues {
+				if !strings.HasPrefix(errorLines[i], eachPrefix) {
+					t.Fatalf("Expected issue %d to start with %q, got: %s",
+						i,
+						eachPrefix,
+						errorLines[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateMediaEpisodes(t *testing.T) {
+	for _, eachFile := range []string{"episode1.md", "episode2.md"} {
+		data, dataErr := ioutil.ReadFile(testFile(eachFile))
+		if dataErr != nil {
+			t.Fatalf("Failed to read %s: %s", eachFile, dataErr)
+		}
+		configEntry := Item{}
+		specErr := ParseSpartaConfigSpec(bytes.NewReader(data), &configEntry, logrus.New())
+		if specErr != nil {
+			t.Fatalf("Failed to parse %s: %s", eachFile, specErr)
+		}
+		speechText, speechKind := classifySpeechText(episodeSpeechText(configEntry.Episode,
+			configEntry.PollyEngineType))
+		if speechKind != speechTextSSML {
+			t.Fatalf("Expected %s to be SSML, got: %s", eachFile, speechKind)
+		}
+		validateErr := validateSSML(speechText, configEntry.PollyEngineType)
+		if validateErr != nil {
+			t.Fatalf("Invalid SSML in %s: %s", eachFile, validateErr)
+		}
+	}
+}
+
+func TestValidateEpisodeSSMLPosition(t *testing.T) {
+	blobStore, cleanup := testLocalBlobStore(t)
+	defer cleanup()
+	logger := logrus.New()
+
+	episodes := map[string]string{
+		// The <emphasis> tag is on line 12
+		"episode9.md:12: <emphasis>": strings.Join([]string{
+			"# Properties",
+			"",
+			"| EpisodeProp      | EpisodeValue |",
+			"| ---------------- | ------------ |",
+			"| Title            | Position     |",
+			"| polly:engineType | neural       |",
+			"",
+			"# Episode",
+			"",
+			"```html",
+			"<speak>",
+			"  <emphasis>Hello</emphasis>",
+			"</speak>",
+			"```",
+		}, "\n"),
+		// The second turn's <emphasis> tag is on line 20
+		"episode9.md:20: <emphasis>": strings.Join([]string{
+			"# Properties",
+			"",
+			"| EpisodeProp      | EpisodeValue |",
+			"| ---------------- | ------------ |",
+			"| Title            | Position     |",
+			"| polly:engineType | neural       |",
+			"",
+			"# Speakers",
+			"",
+			"| Speaker | Voice   | Engine |",
+			"| ------- | ------- | ------ |",
+			"| Ann     | Joanna  | neural |",
+			"| Bob     | Matthew | neural |",
+			"",
+			"# Episode",
+			"",
+			"**Ann:** Hello <break time=\"1s\"/> there.",
+			"**Bob:** Listen.",
+			"```html",
+			"<speak><emphasis>Hi</emphasis> Ann.</speak>",
+			"```",
+		}, "\n"),
+	}
+	for eachPosition, eachEpisode := range episodes {
+		blobStore.Put("episode9.md", []byte(eachEpisode), "")
+		_, taskErr := newEpisodeTask(blobStore,
+			&FakeSynthesizer{},
+			"spartacast-eventbucket",
+			"episode9.md",
+			time.Now(),
+			logger)
+		if taskErr == nil || !strings.Contains(taskErr.Error(), "\n"+eachPosition) {
+			t.Fatalf("Expected an issue at %s, got: %v", eachPosition, taskErr)
+		}
+	}
+}
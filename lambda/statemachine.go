@@ -0,0 +1,537 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/sirupsen/logrus"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// State machine
+////////////////////////////////////////////////////////////////////////////////
+
+// The states of the SpartaCast state machine that aren't Lambda functions,
+// and the paths and values that its Choice and Wait states evaluate. They're
+// shared by the Step Functions definition in main.go and the LocalExecutor.
+const (
+	// StateBranchOnUploadType is the Choice state that starts the machine
+	StateBranchOnUploadType = "BranchOnUploadType"
+	// StateCheckFeedConfig is the Choice state after the delete task
+	StateCheckFeedConfig = "CheckFeedConfig"
+	// StateFeedConfigDeleted is the Succeed state of a delete that left
+	// no feed.md to build the feed from
+	StateFeedConfigDeleted = "Feed Config Deleted"
+	// StateCheckDuplicateEvent is the Choice state that ends the execution
+	// of a duplicate event
+	StateCheckDuplicateEvent = "CheckDuplicateEvent"
+	// StateDuplicateEvent is the Succeed state of a duplicate event
+	StateDuplicateEvent = "Duplicate Event"
+	// StateCheckSpeechContentChanged is the Choice state that skips
+	// synthesis if the episode's speech content is unchanged
+	StateCheckSpeechContentChanged = "CheckSpeechContentChanged"
+	// StateWaitForPolly is the Wait state between synthesis task polls
+	StateWaitForPolly = "waitForPolly"
+	// StateCheckPollyTaskStatus is the Choice state after the wait
+	StateCheckPollyTaskStatus = "CheckPollyTaskStatus"
+	// StateWaitForPublish is the Wait state that holds a scheduled episode
+	// until it's published
+	StateWaitForPublish = "waitForPublish"
+	// StateWaitForQuietPeriod is the Wait state that coalesces the feed
+	// rebuilds of episodes that finish together
+	StateWaitForQuietPeriod = "waitForQuietPeriod"
+	// StateCheckFeedRebuilt is the Choice state after the feed task
+	StateCheckFeedRebuilt = "CheckFeedRebuilt"
+	// StateFeedRebuildDeferred is the Succeed state of an execution that
+	// left the feed for a later one to rebuild
+	StateFeedRebuildDeferred = "Feed Rebuild Deferred"
+	// StateFeedGenerated is the Succeed state
+	StateFeedGenerated = "Feed Generated!"
+
+	// UploadKeyPath is the uploaded key in the CloudTrail event
+	UploadKeyPath = "$.detail.requestParameters.key"
+	// EventNamePath is the S3 API call in the CloudTrail event
+	EventNamePath = "$.detail.eventName"
+	// EventNameDeleteObject is the API call that deletes a key
+	EventNameDeleteObject = "DeleteObject"
+	// EventNameDeleteObjects is the API call that deletes several keys
+	EventNameDeleteObjects = "DeleteObjects"
+	// EventNameRebuildFeed is the event of the scheduled rule that
+	// invokes the feed task to rebuild a feed left dirty
+	EventNameRebuildFeed = "RebuildFeed"
+	// WaitDurationPath is the wait, in seconds, before the next poll
+	WaitDurationPath = "$.WaitDuration"
+	// PublishAtPath is the timestamp that the episode is published
+	PublishAtPath = "$.PublishAt"
+	// RebuildAtPath is the timestamp that the dirty feed is rebuilt
+	RebuildAtPath = "$.RebuildAt"
+	// FeedRebuildDeferredPath is true if the feed task didn't rebuild
+	// the feed
+	FeedRebuildDeferredPath = "$.FeedRebuildDeferred"
+	// FeedConfigMissingPath is true if feed.md doesn't exist
+	FeedConfigMissingPath = "$.FeedConfigMissing"
+	// DuplicateEventPath is true if the event was already handled
+	DuplicateEventPath = "$.DuplicateEvent"
+	// SynthesisSkippedPath is true if the episode wasn't synthesized again
+	SynthesisSkippedPath = "$.SynthesisSkipped"
+	// TaskStatusPath is the status of the synthesis task
+	TaskStatusPath = "$.SynthesisTask.TaskStatus"
+	// TaskStatusCompleted is the status of a completed synthesis task
+	TaskStatusCompleted = "completed"
+)
+
+// StateType is the kind of a StateDefinition
+type StateType int
+
+const (
+	// StateTypeLambda calls the Lambda function of the same name
+	StateTypeLambda StateType = iota
+	// StateTypeChoice goes to the Next of the first matching ChoiceRule,
+	// or to the Default
+	StateTypeChoice
+	// StateTypeWaitSeconds waits for the number of seconds at the Path
+	StateTypeWaitSeconds
+	// StateTypeWaitUntil waits until the RFC3339 timestamp at the Path
+	StateTypeWaitUntil
+	// StateTypeSucceed ends the execution
+	StateTypeSucceed
+)
+
+// ChoiceRule is a branch of a Choice state. It matches if the Variable
+// equals any of the StringEquals values, or doesn't if Not is set. A
+// BooleanEquals rule matches if the Variable is true.
+type ChoiceRule struct {
+	Variable      string
+	StringEquals  []string
+	Not           bool
+	BooleanEquals bool
+	Next          string
+}
+
+func (rule *ChoiceRule) matches(data interface{}) bool {
+	value := jsonPathValue(data, rule.Variable)
+	if rule.BooleanEquals {
+		return value == true
+	}
+	matched := false
+	for _, eachValue := range rule.StringEquals {
+		if value == eachValue {
+			matched = true
+		}
+	}
+	return matched != rule.Not
+}
+
+// StateDefinition is a state of the StateGraph
+type StateDefinition struct {
+	Type StateType
+	// Next is the state after a Lambda or Wait state
+	Next string
+	// Path is the seconds or timestamp of a Wait state
+	Path string
+	// Choices and Default are the branches of a Choice state
+	Choices []*ChoiceRule
+	Default string
+}
+
+// StateGraph is the SpartaCast state machine. main.go provisions it with
+// Step Functions and the LocalExecutor runs it in process.
+type StateGraph struct {
+	StartAt string
+	States  map[string]*StateDefinition
+}
+
+// NewStateGraph returns the SpartaCast state machine
+func NewStateGraph() *StateGraph {
+	return &StateGraph{
+		StartAt: StateBranchOnUploadType,
+		States: map[string]*StateDefinition{
+			// Start with a choice on whether the input is a delete,
+			// feed.md or an episode.md entry
+			StateBranchOnUploadType: {
+				Type: StateTypeChoice,
+				Choices: []*ChoiceRule{
+					{
+						Variable:     EventNamePath,
+						StringEquals: []string{EventNameDeleteObject, EventNameDeleteObjects},
+						Next:         HandleDeleteTaskName,
+					},
+					{
+						Variable:     UploadKeyPath,
+						StringEquals: []string{FeedConfigName},
+						Not:          true,
+						Next:         HandleEpisodeS3StateChangeTask,
+					},
+				},
+				Default: HandleFeedTaskName,
+			},
+			// Deleting episodes removes their output and then regenerates
+			// the feed, unless feed.md itself is gone
+			HandleDeleteTaskName: {
+				Type: StateTypeLambda,
+				Next: StateCheckFeedConfig,
+			},
+			StateCheckFeedConfig: {
+				Type: StateTypeChoice,
+				Choices: []*ChoiceRule{
+					{
+						Variable:      FeedConfigMissingPath,
+						BooleanEquals: true,
+						Next:          StateFeedConfigDeleted,
+					},
+				},
+				Default: HandleFeedTaskName,
+			},
+			HandleEpisodeS3StateChangeTask: {
+				Type: StateTypeLambda,
+				Next: StateCheckDuplicateEvent,
+			},
+			// A redelivered event, or one for an object that was just
+			// handled, ends the execution before any synthesis
+			StateCheckDuplicateEvent: {
+				Type: StateTypeChoice,
+				Choices: []*ChoiceRule{
+					{
+						Variable:      DuplicateEventPath,
+						BooleanEquals: true,
+						Next:          StateDuplicateEvent,
+					},
+				},
+				Default: StateCheckSpeechContentChanged,
+			},
+			// Episodes whose speech content is unchanged reuse their audio
+			// and go straight to the feed
+			StateCheckSpeechContentChanged: {
+				Type: StateTypeChoice,
+				Choices: []*ChoiceRule{
+					{
+						Variable:      SynthesisSkippedPath,
+						BooleanEquals: true,
+						Next:          StateWaitForPublish,
+					},
+				},
+				Default: HandlePollyTaskName,
+			},
+			HandlePollyTaskName: {
+				Type: StateTypeLambda,
+				Next: StateWaitForPolly,
+			},
+			StateWaitForPolly: {
+				Type: StateTypeWaitSeconds,
+				Path: WaitDurationPath,
+				Next: StateCheckPollyTaskStatus,
+			},
+			StateCheckPollyTaskStatus: {
+				Type: StateTypeChoice,
+				Choices: []*ChoiceRule{
+					{
+						Variable:     TaskStatusPath,
+						StringEquals: []string{TaskStatusCompleted},
+						Not:          true,
+						Next:         HandlePollyTaskName,
+					},
+				},
+				Default: StateWaitForPublish,
+			},
+			// Hold a scheduled episode until its publishAt time. Published
+			// episodes continue immediately.
+			StateWaitForPublish: {
+				Type: StateTypeWaitUntil,
+				Path: PublishAtPath,
+				Next: HandleMarkFeedDirtyTaskName,
+			},
+			// The finished episode marks the feed dirty and waits for the
+			// quiet period, so that only the last of a bulk upload
+			// rebuilds the feed
+			HandleMarkFeedDirtyTaskName: {
+				Type: StateTypeLambda,
+				Next: StateWaitForQuietPeriod,
+			},
+			StateWaitForQuietPeriod: {
+				Type: StateTypeWaitUntil,
+				Path: RebuildAtPath,
+				Next: HandleFeedTaskName,
+			},
+			HandleFeedTaskName: {
+				Type: StateTypeLambda,
+				Next: StateCheckFeedRebuilt,
+			},
+			// Rebuilds of a dirty feed that were left to another execution
+			// end separately
+			StateCheckFeedRebuilt: {
+				Type: StateTypeChoice,
+				Choices: []*ChoiceRule{
+					{
+						Variable:      FeedRebuildDeferredPath,
+						BooleanEquals: true,
+						Next:          StateFeedRebuildDeferred,
+					},
+				},
+				Default: StateFeedGenerated,
+			},
+			StateFeedConfigDeleted: {
+				Type: StateTypeSucceed,
+			},
+			StateDuplicateEvent: {
+				Type: StateTypeSucceed,
+			},
+			StateFeedRebuildDeferred: {
+				Type: StateTypeSucceed,
+			},
+			StateFeedGenerated: {
+				Type: StateTypeSucceed,
+			},
+		},
+	}
+}
+
+// Clock is the time source of the LocalExecutor's Wait state
+type Clock interface {
+	Now() time.Time
+	Sleep(duration time.Duration)
+}
+
+type systemClock struct{}
+
+func (sc systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (sc systemClock) Sleep(duration time.Duration) {
+	time.Sleep(duration)
+}
+
+type contextKey int
+
+const (
+	// contextKeyClock is the Clock that handlers read the time from
+	contextKeyClock contextKey = iota
+)
+
+// contextClock returns the Clock in the context, or the system clock
+func contextClock(ctx context.Context) Clock {
+	clock, _ := ctx.Value(contextKeyClock).(Clock)
+	if clock == nil {
+		return systemClock{}
+	}
+	return clock
+}
+
+// FakeClock is a Clock that doesn't sleep. Sleeping advances its time.
+type FakeClock struct {
+	mutex   sync.Mutex
+	current time.Time
+	slept   time.Duration
+}
+
+// NewFakeClock returns a FakeClock that starts at the given time
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{
+		current: start,
+	}
+}
+
+// Now returns the clock's time
+func (fc *FakeClock) Now() time.Time {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return fc.current
+}
+
+// Sleep advances the clock's time
+func (fc *FakeClock) Sleep(duration time.Duration) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.current = fc.current.Add(duration)
+	fc.slept += duration
+}
+
+// Slept returns the total time slept
+func (fc *FakeClock) Slept() time.Duration {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return fc.slept
+}
+
+// LocalTransition is a state that the LocalExecutor ran, with its input
+// and output
+type LocalTransition struct {
+	State  string
+	Input  json.RawMessage
+	Output json.RawMessage
+}
+
+// LocalExecutor runs the StateGraph in process. Lambda states call the Go
+// handlers, with the same JSON marshalling as a Lambda invocation, Choice
+// states evaluate their rules and Wait states sleep on the Clock.
+type LocalExecutor struct {
+	Graph          *StateGraph
+	Providers      map[string]sparta.AWSLambdaProvider
+	Clock          Clock
+	Logger         *logrus.Logger
+	AWSSession     *session.Session
+	MaxTransitions int
+}
+
+// NewLocalExecutor returns a LocalExecutor whose handlers use the blob
+// store and synthesizer rather than S3 and Polly
+func NewLocalExecutor(blobStore BlobStore,
+	synthesizer SpeechSynthesizer,
+	logger *logrus.Logger) *LocalExecutor {
+	return &LocalExecutor{
+		Graph:          NewStateGraph(),
+		Providers:      localProviders(blobStore, synthesizer),
+		Clock:          systemClock{},
+		Logger:         logger,
+		AWSSession:     &session.Session{Config: &aws.Config{}},
+		MaxTransitions: 1000,
+	}
+}
+
+// jsonPathValue returns the value at a $.a.b.c path, or nil if there
+// isn't one
+func jsonPathValue(data interface{}, jsonPath string) interface{} {
+	if jsonPath == "$" {
+		return data
+	}
+	for _, eachComponent := range strings.Split(strings.TrimPrefix(jsonPath, "$."), ".") {
+		dataMap, isMap := data.(map[string]interface{})
+		if !isMap {
+			return nil
+		}
+		data = dataMap[eachComponent]
+	}
+	return data
+}
+
+// Invoke calls the Lambda function directly, as the scheduled feed rebuild
+// does, and returns its JSON output
+func (le *LocalExecutor) Invoke(lambdaName string, input json.RawMessage) (json.RawMessage, error) {
+	return le.invoke(le.context(), lambdaName, input)
+}
+
+// context returns the context that the handlers are invoked with
+func (le *LocalExecutor) context() context.Context {
+	ctx := context.WithValue(context.Background(), sparta.ContextKeyLogger, le.Logger)
+	ctx = context.WithValue(ctx, sparta.ContextKeyAWSSession, le.AWSSession)
+	return context.WithValue(ctx, contextKeyClock, le.Clock)
+}
+
+// invoke calls the Lambda handler with the JSON input and returns its
+// JSON output
+func (le *LocalExecutor) invoke(ctx context.Context,
+	lambdaName string,
+	input json.RawMessage) (json.RawMessage, error) {
+	provider, providerExists := le.Providers[lambdaName]
+	if !providerExists {
+		return nil, fmt.Errorf("Unknown Lambda function: %s", lambdaName)
+	}
+	handler := reflect.ValueOf(provider.Handler())
+	handlerType := handler.Type()
+	if handlerType.Kind() != reflect.Func || handlerType.NumIn() != 2 {
+		return nil, fmt.Errorf("Unsupported handler signature for %s: %s", lambdaName, handlerType)
+	}
+	handlerInput := reflect.New(handlerType.In(1))
+	unmarshalErr := json.Unmarshal(input, handlerInput.Interface())
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("Failed to unmarshal %s input: %s", lambdaName, unmarshalErr)
+	}
+	results := handler.Call([]reflect.Value{reflect.ValueOf(ctx), handlerInput.Elem()})
+	handlerErr, _ := results[len(results)-1].Interface().(error)
+	if handlerErr != nil {
+		return nil, handlerErr
+	}
+	if len(results) == 1 {
+		return json.RawMessage("null"), nil
+	}
+	return json.Marshal(results[0].Interface())
+}
+
+// waitUntil sleeps until the RFC3339 timestamp at the path, like a Wait
+// state with a TimestampPath
+func (le *LocalExecutor) waitUntil(data interface{}, timestampPath string) error {
+	timestamp, _ := jsonPathValue(data, timestampPath).(string)
+	untilTime, untilTimeErr := time.Parse(time.RFC3339, timestamp)
+	if untilTimeErr != nil {
+		return fmt.Errorf("Invalid %s timestamp: %s", timestampPath, timestamp)
+	}
+	if waitDuration := untilTime.Sub(le.Clock.Now()); waitDuration > 0 {
+		le.Clock.Sleep(waitDuration)
+	}
+	return nil
+}
+
+// Execute runs the state machine with the input, such as a CloudTrail
+// event, and returns the transitions it made. If a state fails, the
+// transitions up to that state are returned along with the error.
+func (le *LocalExecutor) Execute(input json.RawMessage) ([]*LocalTransition, error) {
+	ctx := le.context()
+
+	transitions := []*LocalTransition{}
+	stateName := le.Graph.StartAt
+	for stateName != "" {
+		if len(transitions) >= le.MaxTransitions {
+			return transitions, fmt.Errorf("Exceeded %d state transitions", le.MaxTransitions)
+		}
+		state, stateExists := le.Graph.States[stateName]
+		if !stateExists {
+			return transitions, fmt.Errorf("Unknown state: %s", stateName)
+		}
+		transition := &LocalTransition{
+			State:  stateName,
+			Input:  input,
+			Output: input,
+		}
+		transitions = append(transitions, transition)
+		var data interface{}
+		unmarshalErr := json.Unmarshal(input, &data)
+		if unmarshalErr != nil {
+			return transitions, unmarshalErr
+		}
+
+		nextState := state.Next
+		switch state.Type {
+		case StateTypeLambda:
+			output, outputErr := le.invoke(ctx, stateName, input)
+			if outputErr != nil {
+				return transitions, fmt.Errorf("State %s failed: %s", stateName, outputErr)
+			}
+			transition.Output = output
+		case StateTypeChoice:
+			nextState = state.Default
+			for _, eachRule := range state.Choices {
+				if eachRule.matches(data) {
+					nextState = eachRule.Next
+					break
+				}
+			}
+		case StateTypeWaitSeconds:
+			waitSeconds, _ := jsonPathValue(data, state.Path).(float64)
+			le.Clock.Sleep(time.Duration(waitSeconds) * time.Second)
+		case StateTypeWaitUntil:
+			waitErr := le.waitUntil(data, state.Path)
+			if waitErr != nil {
+				return transitions, waitErr
+			}
+		case StateTypeSucceed:
+			nextState = ""
+		default:
+			return transitions, fmt.Errorf("Unsupported type for state %s: %d", stateName, state.Type)
+		}
+		le.Logger.WithFields(logrus.Fields{
+			"state": stateName,
+			"next":  nextState,
+		}).Debug("Local state transition")
+		input = transition.Output
+		stateName = nextState
+	}
+	return transitions, nil
+}
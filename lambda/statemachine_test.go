@@ -0,0 +1,398 @@
+package lambda
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sparta "github.com/mweagle/Sparta"
+)
+
+// testUploadEvent returns a captured CloudTrail PutObject event for the key
+func testUploadEvent(key string) json.RawMessage {
+	return testEvent("PutObject", key, "")
+}
+
+// testEventCount numbers the test events, so that each has its own eventID
+var testEventCount int32
+
+// testEvent returns a captured CloudTrail event for the S3 API call. The
+// key and copySource are omitted if they're empty.
+func testEvent(eventName string, key string, copySource string) json.RawMessage {
+	eventID := fmt.Sprintf("9d7c5a8e-3b0e-4d4e-9f6a-%012d", atomic.AddInt32(&testEventCount, 1))
+	requestParameters := map[string]string{
+		"bucketName": "spartacast-eventbucket",
+		"Host":       "spartacast-eventbucket.s3.us-west-2.amazonaws.com",
+	}
+	if key != "" {
+		requestParameters["key"] = key
+	}
+	if copySource != "" {
+		requestParameters["x-amz-copy-source"] = copySource
+	}
+	requestParametersJSON, _ := json.Marshal(requestParameters)
+	return json.RawMessage(`{
+  "version": "0",
+  "id": "c4d5d5c9-0b6e-4f2d-8a0e-2f8e4a1b0c1d",
+  "detail-type": "AWS API Call via CloudTrail",
+  "source": "aws.s3",
+  "account": "123412341234",
+  "time": "2020-03-01T18:22:15Z",
+  "region": "us-west-2",
+  "resources": [],
+  "detail": {
+    "eventVersion": "1.07",
+    "eventTime": "2020-03-01T18:22:15Z",
+    "eventSource": "s3.amazonaws.com",
+    "eventName": "` + eventName + `",
+    "awsRegion": "us-west-2",
+    "requestParameters": ` + string(requestParametersJSON) + `,
+    "eventID": "` + eventID + `",
+    "eventType": "AwsApiCall"
+  }
+}`)
+}
+
+func testExecutorStore(t *testing.T) (BlobStore, func()) {
+	blobStore, cleanup := testLocalBlobStore(t)
+	for _, eachFile := range []string{"feed.md", "episode1.md"} {
+		fileBytes, fileBytesErr := ioutil.ReadFile(testFile(eachFile))
+		if fileBytesErr != nil {
+			t.Fatalf("Failed to read %s: %s", eachFile, fileBytesErr)
+		}
+		blobStore.Put(eachFile, fileBytes, "")
+	}
+	return blobStore, cleanup
+}
+
+func transitionStates(transitions []*LocalTransition) string {
+	states := []string{}
+	for _, eachTransition := range transitions {
+		states = append(states, eachTransition.State)
+	}
+	return strings.Join(states, " -> ")
+}
+
+func TestStateGraph(t *testing.T) {
+	graph := NewStateGraph()
+	providers := Providers("EventBucket")
+	referenced := map[string]bool{
+		graph.StartAt: true,
+	}
+	for eachName, eachState := range graph.States {
+		targets := []string{}
+		switch eachState.Type {
+		case StateTypeLambda:
+			if _, providerExists := providers[eachName]; !providerExists {
+				t.Fatalf("Lambda state %s doesn't have a provider", eachName)
+			}
+			targets = append(targets, eachState.Next)
+		case StateTypeWaitSeconds, StateTypeWaitUntil:
+			targets = append(targets, eachState.Next)
+		case StateTypeChoice:
+			targets = append(targets, eachState.Default)
+			for _, eachRule := range eachState.Choices {
+				targets = append(targets, eachRule.Next)
+			}
+		}
+		for _, eachTarget := range targets {
+			if _, targetExists := graph.States[eachTarget]; !targetExists {
+				t.Fatalf("State %s goes to unknown state %q", eachName, eachTarget)
+			}
+			referenced[eachTarget] = true
+		}
+	}
+	for eachName := range graph.States {
+		if !referenced[eachName] {
+			t.Fatalf("State %s is unreachable", eachName)
+		}
+	}
+	for eachName := range providers {
+		if _, stateExists := graph.States[eachName]; !stateExists {
+			t.Fatalf("Provider %s isn't a state", eachName)
+		}
+	}
+}
+
+func TestLocalExecutorEpisode(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	clock := NewFakeClock(time.Now().Truncate(time.Second))
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{Polls: 1}, logger)
+	executor.Clock = clock
+	transitions, executeErr := executor.Execute(testUploadEvent("episode1.md"))
+	if executeErr != nil {
+		t.Fatalf("Failed to execute: %s", executeErr)
+	}
+	expected := strings.Join([]string{StateBranchOnUploadType,
+		HandleEpisodeS3StateChangeTask,
+		StateCheckDuplicateEvent,
+		StateCheckSpeechContentChanged,
+		HandlePollyTaskName,
+		StateWaitForPolly,
+		StateCheckPollyTaskStatus,
+		HandlePollyTaskName,
+		StateWaitForPolly,
+		StateCheckPollyTaskStatus,
+		StateWaitForPublish,
+		HandleMarkFeedDirtyTaskName,
+		StateWaitForQuietPeriod,
+		HandleFeedTaskName,
+		StateCheckFeedRebuilt,
+		StateFeedGenerated}, " -> ")
+	if transitionStates(transitions) != expected {
+		t.Fatalf("Unexpected transitions.\nExpected: %s\nActual:   %s",
+			expected,
+			transitionStates(transitions))
+	}
+	// The first poll waits 10s and the completed poll keeps that wait. The
+	// episode is already published, so the feed is rebuilt after the
+	// quiet period.
+	if clock.Slept() != 20*time.Second+feedQuietPeriod {
+		t.Fatalf("Expected to sleep %s, slept %s", 20*time.Second+feedQuietPeriod, clock.Slept())
+	}
+	_, manifestErr := blobStore.Head(manifestKeyPath("episode1.md"))
+	if manifestErr != nil {
+		t.Fatalf("Failed to find manifest: %s", manifestErr)
+	}
+	_, feedErr := blobStore.Head("public/feed/feed.xml")
+	if feedErr != nil {
+		t.Fatalf("Failed to find feed.xml: %s", feedErr)
+	}
+}
+
+func TestLocalExecutorFeed(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{}, logger)
+	executor.Clock = NewFakeClock(time.Now())
+	transitions, executeErr := executor.Execute(testUploadEvent(FeedConfigName))
+	if executeErr != nil {
+		t.Fatalf("Failed to execute: %s", executeErr)
+	}
+	expected := strings.Join([]string{StateBranchOnUploadType,
+		HandleFeedTaskName,
+		StateCheckFeedRebuilt,
+		StateFeedGenerated}, " -> ")
+	if transitionStates(transitions) != expected {
+		t.Fatalf("Unexpected transitions.\nExpected: %s\nActual:   %s",
+			expected,
+			transitionStates(transitions))
+	}
+}
+
+func TestLocalExecutorSynthesisFailure(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	synthesizer := &FakeSynthesizer{FailText: "PollyCast"}
+	executor := NewLocalExecutor(blobStore, synthesizer, logger)
+	executor.Clock = NewFakeClock(time.Now())
+	uploadEvent := testUploadEvent("episode1.md")
+	transitions, executeErr := executor.Execute(uploadEvent)
+	if executeErr == nil || !strings.Contains(executeErr.Error(), HandlePollyTaskName) {
+		t.Fatalf("Expected the %s state to fail, got: %v", HandlePollyTaskName, executeErr)
+	}
+	if transitions[len(transitions)-1].State != HandlePollyTaskName {
+		t.Fatalf("Unexpected transitions: %s", transitionStates(transitions))
+	}
+
+	// The failed execution released its claim, so a redelivery of the
+	// same event synthesizes the episode
+	synthesizer.FailText = ""
+	transitions, executeErr = executor.Execute(uploadEvent)
+	if executeErr != nil {
+		t.Fatalf("Failed to execute redelivered event: %s", executeErr)
+	}
+	if transitions[len(transitions)-1].State != StateFeedGenerated {
+		t.Fatalf("Unexpected transitions: %s", transitionStates(transitions))
+	}
+	_, _, manifestErr := blobStore.Get(manifestKeyPath("episode1.md"))
+	if manifestErr != nil {
+		t.Fatalf("Failed to read manifest: %s", manifestErr)
+	}
+}
+
+func TestLocalExecutorUnchangedSpeech(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	synthesizer := &FakeSynthesizer{}
+	clock := NewFakeClock(time.Now())
+	executor := NewLocalExecutor(blobStore, synthesizer, logger)
+	executor.Clock = clock
+	execute := func(replacements ...string) []*LocalTransition {
+		episodeBytes, _, _ := blobStore.Get("episode1.md")
+		episode := strings.NewReplacer(replacements...).Replace(string(episodeBytes))
+		blobStore.Put("episode1.md", []byte(episode), "")
+		transitions, executeErr := executor.Execute(testUploadEvent("episode1.md"))
+		if executeErr != nil {
+			t.Fatalf("Failed to execute: %s", executeErr)
+		}
+		return transitions
+	}
+	execute()
+	original := testManifest(t, blobStore, "episode1.md")
+	requestCount := len(synthesizer.Requests())
+
+	// A new title only updates the manifest and the feed
+	transitions := execute("| Episode One ", "| Episode 1 ")
+	expected := strings.Join([]string{StateBranchOnUploadType,
+		HandleEpisodeS3StateChangeTask,
+		StateCheckDuplicateEvent,
+		StateCheckSpeechContentChanged,
+		StateWaitForPublish,
+		HandleMarkFeedDirtyTaskName,
+		StateWaitForQuietPeriod,
+		HandleFeedTaskName,
+		StateCheckFeedRebuilt,
+		StateFeedGenerated}, " -> ")
+	if transitionStates(transitions) != expected {
+		t.Fatalf("Unexpected transitions.\nExpected: %s\nActual:   %s",
+			expected,
+			transitionStates(transitions))
+	}
+	if len(synthesizer.Requests()) != requestCount {
+		t.Fatalf("Expected synthesis to be skipped")
+	}
+	retitled := testManifest(t, blobStore, "episode1.md")
+	if retitled.Item.Title != "Episode 1" ||
+		retitled.Item.EnclosureLink != original.Item.EnclosureLink ||
+		retitled.ContentHash != original.ContentHash {
+		t.Fatalf("Unexpected manifest after a title change: %#v", retitled.Item)
+	}
+
+	// A different voice is synthesized again...
+	execute("| Matthew ", "| Joanna ")
+	if len(synthesizer.Requests()) == requestCount {
+		t.Fatalf("Expected a new voice to be synthesized")
+	}
+	requestCount = len(synthesizer.Requests())
+
+	// ...as is an episode whose audio is missing
+	revoiced := testManifest(t, blobStore, "episode1.md")
+	enclosureKey, _ := blobStore.KeyFromURL(revoiced.Item.EnclosureLink)
+	blobStore.Delete(enclosureKey)
+	clock.Sleep(duplicateEventWindow)
+	execute()
+	if len(synthesizer.Requests()) == requestCount {
+		t.Fatalf("Expected missing audio to be synthesized")
+	}
+}
+
+func TestLocalExecutorLongDialogue(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	// Alternating turns are a part each, which is more than Step Functions
+	// can pass between states
+	turnCount := 1000
+	episodeLines := []string{
+		"# Properties",
+		"",
+		"| EpisodeProp | EpisodeValue |",
+		"| ----------- | ------------ |",
+		"| Title       | Dialogue     |",
+		"",
+		"# Speakers",
+		"",
+		"| Speaker | Voice   | Engine |",
+		"| ------- | ------- | ------ |",
+		"| Ann     | Ivy     | neural |",
+		"| Bob     | Matthew | neural |",
+		"",
+		"# Episode",
+		"",
+	}
+	for i := 0; i != turnCount; i++ {
+		speaker := "Ann"
+		if i%2 != 0 {
+			speaker = "Bob"
+		}
+		episodeLines = append(episodeLines, fmt.Sprintf("**%s:** Turn %d.", speaker, i), "")
+	}
+	blobStore.Put("dialogue.md", []byte(strings.Join(episodeLines, "\n")), "")
+
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{Polls: 1}, logger)
+	executor.Clock = NewFakeClock(time.Now())
+	transitions, executeErr := executor.Execute(testUploadEvent("dialogue.md"))
+	if executeErr != nil {
+		t.Fatalf("Failed to execute: %s", executeErr)
+	}
+	for _, eachTransition := range transitions {
+		if len(eachTransition.Input) > 256*1024 || len(eachTransition.Output) > 256*1024 {
+			t.Fatalf("State %s exceeds the Step Functions payload limit: %d bytes in, %d bytes out",
+				eachTransition.State,
+				len(eachTransition.Input),
+				len(eachTransition.Output))
+		}
+	}
+	if !strings.HasSuffix(transitionStates(transitions), StateFeedGenerated) {
+		t.Fatalf("Unexpected transitions: %s", transitionStates(transitions))
+	}
+	manifest := testManifest(t, blobStore, "dialogue.md")
+	if len(manifest.Parts) != turnCount || manifest.PartsKey != "" {
+		t.Fatalf("Expected %d parts in the manifest, got %d", turnCount, len(manifest.Parts))
+	}
+}
+
+func TestLocalExecutorLongEpisode(t *testing.T) {
+	blobStore, cleanup := testExecutorStore(t)
+	defer cleanup()
+	logger, _ := sparta.NewLogger("info")
+
+	// Neither the episode text nor the description fits in the state
+	sentence := "This episode goes on and on. "
+	episodeLines := []string{
+		"# Properties",
+		"",
+		"| EpisodeProp | EpisodeValue |",
+		"| ----------- | ------------ |",
+		"| Title       | Long         |",
+		"",
+		"# Description",
+		"",
+		strings.Repeat(sentence, 10*1024),
+		"",
+		"# Episode",
+		"",
+		strings.Repeat(sentence, 10*1024),
+	}
+	blobStore.Put("long.md", []byte(strings.Join(episodeLines, "\n")), "")
+
+	executor := NewLocalExecutor(blobStore, &FakeSynthesizer{Polls: 1}, logger)
+	executor.Clock = NewFakeClock(time.Now())
+	transitions, executeErr := executor.Execute(testUploadEvent("long.md"))
+	if executeErr != nil {
+		t.Fatalf("Failed to execute: %s", executeErr)
+	}
+	for _, eachTransition := range transitions {
+		if len(eachTransition.Input) > 256*1024 || len(eachTransition.Output) > 256*1024 {
+			t.Fatalf("State %s exceeds the Step Functions payload limit: %d bytes in, %d bytes out",
+				eachTransition.State,
+				len(eachTransition.Input),
+				len(eachTransition.Output))
+		}
+	}
+	if !strings.HasSuffix(transitionStates(transitions), StateFeedGenerated) {
+		t.Fatalf("Unexpected transitions: %s", transitionStates(transitions))
+	}
+	manifest := testManifest(t, blobStore, "long.md")
+	if manifest.ItemKey != "" || len(manifest.Item.Description) < 256*1024 {
+		t.Fatalf("Expected the description in the manifest")
+	}
+	if len(manifest.Parts) < 2 {
+		t.Fatalf("Expected the episode to be synthesized in parts, got %d", len(manifest.Parts))
+	}
+}
@@ -1,21 +1,213 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/session"
 	sparta "github.com/mweagle/Sparta"
 	spartaCF "github.com/mweagle/Sparta/aws/cloudformation"
 	step "github.com/mweagle/Sparta/aws/step"
 	infra "github.com/mweagle/SpartaCast/infra"
 	"github.com/mweagle/SpartaCast/lambda"
+	"github.com/spf13/cobra"
 )
 
 func init() {
 	rand.Seed(time.Now().Unix())
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// Render
+////////////////////////////////////////////////////////////////////////////////
+
+type renderOptions struct {
+	sourceDir    string
+	outputDir    string
+	synthesizer  string
+	command      string
+	pollyBucket  string
+	pollInterval time.Duration
+}
+
+// newRenderSynthesizer returns the SpeechSynthesizer for the render
+// options. Local engines write their output to workDir.
+func newRenderSynthesizer(options *renderOptions, workDir string) (lambda.SpeechSynthesizer, error) {
+	switch options.synthesizer {
+	case "espeak-ng", "piper":
+		command := options.command
+		if command == "" && options.synthesizer == "piper" {
+			command = lambda.PiperCommand
+		} else if command == "" {
+			command = lambda.EspeakNGCommand
+		}
+		return &lambda.LocalSynthesizer{
+			Command:   command,
+			OutputDir: workDir,
+		}, nil
+	case "fake":
+		return &lambda.FakeSynthesizer{}, nil
+	case "polly":
+		if options.pollyBucket == "" {
+			return nil, fmt.Errorf("The polly synthesizer requires a --pollyBucket for its output")
+		}
+		awsSession, awsSessionErr := session.NewSession()
+		if awsSessionErr != nil {
+			return nil, awsSessionErr
+		}
+		return lambda.NewPollySynthesizer(awsSession), nil
+	default:
+		return nil, fmt.Errorf("Unsupported synthesizer: %s", options.synthesizer)
+	}
+}
+
+// newRenderCommand returns the command that runs the whole pipeline
+// locally, so that a show can be previewed before it's uploaded
+func newRenderCommand() *cobra.Command {
+	options := &renderOptions{}
+	renderCmd := &cobra.Command{
+		Use:   "render",
+		Short: "Render the feed and episodes locally",
+		Long: "Parse the feed.md and every episode in the source directory, synthesize the " +
+			"episodes and write the enclosures, metadata and feed.xml to the output directory",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger, loggerErr := sparta.NewLogger(sparta.OptionsGlobal.LogLevel)
+			if loggerErr != nil {
+				return loggerErr
+			}
+			workDir, workDirErr := ioutil.TempDir("", "spartacast-render")
+			if workDirErr != nil {
+				return workDirErr
+			}
+			defer os.RemoveAll(workDir)
+
+			synthesizer, synthesizerErr := newRenderSynthesizer(options, workDir)
+			if synthesizerErr != nil {
+				return synthesizerErr
+			}
+			return lambda.Render(&lambda.RenderOptions{
+				SourceDir:    options.sourceDir,
+				OutputDir:    options.outputDir,
+				Synthesizer:  synthesizer,
+				Bucket:       options.pollyBucket,
+				PollInterval: options.pollInterval,
+			}, logger)
+		},
+	}
+	renderCmd.Flags().StringVar(&options.sourceDir,
+		"source",
+		"./media",
+		"Directory with the feed.md and episode sources")
+	renderCmd.Flags().StringVar(&options.outputDir,
+		"out",
+		"./public",
+		"Output directory, with the same layout as the bucket's /public scope")
+	renderCmd.Flags().StringVar(&options.synthesizer,
+		"synthesizer",
+		"espeak-ng",
+		"Speech synthesizer: espeak-ng, piper, polly or fake")
+	renderCmd.Flags().StringVar(&options.command,
+		"command",
+		"",
+		"Command line for a local synthesizer, which reads text from stdin and writes MP3 to stdout")
+	renderCmd.Flags().StringVar(&options.pollyBucket,
+		"pollyBucket",
+		"",
+		"S3 bucket that the polly synthesizer writes its output to")
+	renderCmd.Flags().DurationVar(&options.pollInterval,
+		"pollInterval",
+		5*time.Second,
+		"Time between synthesis task polls")
+	return renderCmd
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// State machine
+////////////////////////////////////////////////////////////////////////////////
+
+// newChoiceBranch returns the Step Functions branch for the rule
+func newChoiceBranch(rule *lambda.ChoiceRule, next step.MachineState) step.ChoiceBranch {
+	comparisons := []step.ChoiceBranch{}
+	if rule.BooleanEquals {
+		comparisons = append(comparisons, &step.BooleanEquals{
+			Variable: rule.Variable,
+			Value:    true,
+		})
+	}
+	for _, eachValue := range rule.StringEquals {
+		comparisons = append(comparisons, &step.StringEquals{
+			Variable: rule.Variable,
+			Value:    eachValue,
+		})
+	}
+	if rule.Not {
+		var comparison step.ChoiceBranch = &step.Or{
+			Comparison: comparisons,
+		}
+		if len(comparisons) == 1 {
+			comparison = comparisons[0]
+		}
+		return &step.Not{
+			Comparison: comparison,
+			Next:       next,
+		}
+	}
+	return &step.Or{
+		Comparison: comparisons,
+		Next:       next,
+	}
+}
+
+// newStateMachine returns the Step Functions state machine for the graph,
+// which is the same one that the lambda.LocalExecutor runs
+func newStateMachine(graph *lambda.StateGraph,
+	awsLambdas map[string]*sparta.LambdaAWSInfo) *step.StateMachine {
+
+	states := make(map[string]step.TransitionState)
+	var stateFor func(stateName string) step.TransitionState
+	stateFor = func(stateName string) step.TransitionState {
+		if state, stateExists := states[stateName]; stateExists {
+			return state
+		}
+		definition, definitionExists := graph.States[stateName]
+		if !definitionExists {
+			panic(fmt.Sprintf("Unknown state: %s", stateName))
+		}
+		// States are registered before their successors are created, as
+		// the graph has cycles
+		switch definition.Type {
+		case lambda.StateTypeLambda:
+			taskState := step.NewLambdaTaskState(stateName, awsLambdas[stateName])
+			states[stateName] = taskState
+			taskState.Next(stateFor(definition.Next))
+		case lambda.StateTypeWaitSeconds:
+			waitState := step.NewDynamicWaitDurationState(stateName, definition.Path)
+			states[stateName] = waitState
+			waitState.Next(stateFor(definition.Next))
+		case lambda.StateTypeWaitUntil:
+			waitState := step.NewWaitDynamicUntilState(stateName, definition.Path)
+			states[stateName] = waitState
+			waitState.Next(stateFor(definition.Next))
+		case lambda.StateTypeSucceed:
+			states[stateName] = step.NewSuccessState(stateName)
+		case lambda.StateTypeChoice:
+			choices := []step.ChoiceBranch{}
+			for _, eachRule := range definition.Choices {
+				choices = append(choices, newChoiceBranch(eachRule, stateFor(eachRule.Next)))
+			}
+			states[stateName] = step.NewChoiceState(stateName, choices...).
+				WithDefault(stateFor(definition.Default))
+		default:
+			panic(fmt.Sprintf("Unsupported type for state %s: %d", stateName, definition.Type))
+		}
+		return states[stateName]
+	}
+	return step.NewStateMachine("SpartaCast", stateFor(graph.StartAt))
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // Main
 func main() {
@@ -37,61 +229,13 @@ func main() {
 		awsLambdas[eachKey] = lambdaFn
 	}
 
-	// The final state is the generate feed state
-	lambdaFeedGenerateState := step.NewLambdaTaskState(lambda.HandleFeedTaskName,
-		awsLambdas[lambda.HandleFeedTaskName])
-	lambdaFeedGenerateState.Next(step.NewSuccessState("Feed Generated!"))
-
-	// Handle an Episode being uploaded
-	lambdaS3StateChangeTask := step.NewLambdaTaskState(lambda.HandleEpisodeS3StateChangeTask,
-		awsLambdas[lambda.HandleEpisodeS3StateChangeTask])
-
-	// Start with a choice on whether the input is feed.md or
-	// an episode.md entry
-	keyNameChoices := []step.ChoiceBranch{
-		&step.Not{
-			Comparison: &step.StringEquals{
-				Variable: "$.detail.requestParameters.key",
-				Value:    "feed.md",
-			},
-			Next: lambdaS3StateChangeTask,
-		},
-	}
-	initialBranchState := step.NewChoiceState("BranchOnUploadType",
-		keyNameChoices...).
-		WithDefault(lambdaFeedGenerateState)
-
-	// The next state is the check task state...
-	lambdaPollyTaskState := step.NewLambdaTaskState(lambda.HandlePollyTaskName,
-		awsLambdas[lambda.HandlePollyTaskName])
-	lambdaS3StateChangeTask.Next(lambdaPollyTaskState)
-
-	// Create the wait state that waits based on the Selector and then
-	// returns to the polly task
-	waitState := step.NewDynamicWaitDurationState("waitForPolly", "$.WaitDuration")
-	lambdaPollyTaskState.Next(waitState)
-
-	// After the polly task, put in the choice...
-	lambdaChoices := []step.ChoiceBranch{
-		&step.Not{
-			Comparison: &step.StringEquals{
-				Variable: "$.SynthesisTask.TaskStatus",
-				Value:    "completed",
-			},
-			Next: lambdaPollyTaskState,
-		},
-	}
-	choiceState := step.NewChoiceState("CheckPollyTaskStatus",
-		lambdaChoices...).
-		WithDefault(lambdaFeedGenerateState)
-	waitState.Next(choiceState)
-
 	// Create the machine...
-	startMachine := step.NewStateMachine("SpartaCast", initialBranchState)
+	startMachine := newStateMachine(lambda.NewStateGraph(), awsLambdas)
 
 	idCloudTrailDecorator, _ := infra.NewCloudTrailDecorator(lambdaFunctions,
 		stateMachineResourceName,
-		s3BucketResourceName)
+		s3BucketResourceName,
+		awsLambdas[lambda.HandleFeedTaskName].LogicalResourceName())
 	idS3Decorator, _ := infra.NewS3Decorator(lambda.PublicKeyPath, s3BucketResourceName)
 
 	// Setup the hook to annotate
@@ -103,6 +247,10 @@ func main() {
 		},
 	}
 
+	// Preview the feed locally with:
+	// go run main.go render --source ./media --out ./public
+	sparta.CommandLineOptions.Root.AddCommand(newRenderCommand())
+
 	err := sparta.MainEx(userStackName,
 		"Convert markdown to a Polly synthesized podcast",
 		lambdaFunctions,
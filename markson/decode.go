@@ -0,0 +1,472 @@
+package markson
+
+import (
+	"encoding"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Reflection based decoding of KeyValuePairs into tagged structs
+////////////////////////////////////////////////////////////////////////////////
+
+// TagName is the struct tag consulted when mapping a Markdown key to a
+// struct field. The tag value is the case-insensitive key name. A tag value
+// of "-" excludes the field. Untagged exported fields use the lowercased
+// field name. The name may be followed by a "oneof=a|b|c" option that
+// restricts the field to the listed values, a "section" option that
+// marshals the field as an H1 section rather than a table row, and a
+// "markdown" option that assigns the raw Markdown source of a section
+// rather than its HTML rendering.
+const TagName = "markson"
+
+var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	durationType        = reflect.TypeOf(time.Duration(0))
+)
+
+// fieldInfo is a decodable field reachable from the root struct
+type fieldInfo struct {
+	key      string
+	name     string
+	index    []int
+	order    int
+	allowed  []string
+	section  bool
+	markdown bool
+	isMap    bool
+}
+
+func canonicalKey(key string) string {
+	return strings.TrimSpace(strings.ToLower(key))
+}
+
+// isStringMap returns true if t is a map with string keys whose entries
+// are addressed as dotted keys
+func isStringMap(t reflect.Type) bool {
+	return t.Kind() == reflect.Map && t.Key().Kind() == reflect.String
+}
+
+// lookupMapField returns the map field whose key is the longest dotted
+// prefix of keyName, together with the remaining map entry name
+func lookupMapField(fields map[string]*fieldInfo, keyName string) (*fieldInfo, string) {
+	for i := strings.LastIndex(keyName, "."); i > 0; i = strings.LastIndex(keyName[:i], ".") {
+		field, fieldExists := fields[keyName[:i]]
+		if fieldExists && field.isMap {
+			return field, keyName[i+1:]
+		}
+	}
+	return nil, ""
+}
+
+// isLeafType returns true if the type is decoded from a single value rather
+// than by walking into its fields
+func isLeafType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return true
+	}
+	return reflect.PtrTo(t).Implements(textUnmarshalerType)
+}
+
+// typeFields accumulates the set of decodable fields for the struct type t.
+// Anonymous struct fields are flattened into the parent scope. Named struct
+// fields are scoped by their key name, so that field Name in struct
+// field Guest is addressed as "guest.name". Map fields with string keys are
+// scoped the same way, with the map key following the field name.
+func typeFields(t reflect.Type,
+	prefix string,
+	index []int,
+	fields map[string]*fieldInfo) {
+
+	for i := 0; i < t.NumField(); i++ {
+		eachField := t.Field(i)
+		tagValue, tagOptions := parseTag(eachField.Tag.Get(TagName))
+		if tagValue == "-" {
+			continue
+		}
+		// Skip unexported fields, unless they're embedded structs whose
+		// exported fields are promoted
+		if eachField.PkgPath != "" && !eachField.Anonymous {
+			continue
+		}
+		fieldIndex := make([]int, len(index)+1)
+		copy(fieldIndex, index)
+		fieldIndex[len(index)] = i
+
+		fieldType := eachField.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if eachField.Anonymous &&
+			tagValue == "" &&
+			fieldType.Kind() == reflect.Struct &&
+			!isLeafType(fieldType) {
+			typeFields(fieldType, prefix, fieldIndex, fields)
+			continue
+		}
+		if eachField.PkgPath != "" {
+			continue
+		}
+		displayName := tagValue
+		if displayName == "" {
+			displayName = strings.ToLower(eachField.Name)
+		}
+		keyName := canonicalKey(prefix + displayName)
+
+		if fieldType.Kind() == reflect.Struct && !isLeafType(fieldType) {
+			typeFields(fieldType, prefix+displayName+".", fieldIndex, fields)
+			continue
+		}
+		// First one wins, the same way a shallower field would shadow
+		// a deeper promoted field
+		if _, exists := fields[keyName]; !exists {
+			_, isSection := tagOptions["section"]
+			_, isMarkdown := tagOptions["markdown"]
+			fields[keyName] = &fieldInfo{
+				key:      keyName,
+				name:     prefix + displayName,
+				index:    fieldIndex,
+				order:    len(fields),
+				allowed:  tagOptions["oneof"],
+				section:  isSection,
+				markdown: isMarkdown,
+				isMap:    isStringMap(fieldType),
+			}
+		}
+	}
+}
+
+// parseTag splits a markson struct tag into the key name and its options
+func parseTag(tag string) (string, map[string][]string) {
+	tagParts := strings.Split(tag, ",")
+	options := make(map[string][]string)
+	for _, eachOption := range tagParts[1:] {
+		optionParts := strings.SplitN(eachOption, "=", 2)
+		optionValues := []string{}
+		if len(optionParts) == 2 {
+			optionValues = strings.Split(optionParts[1], "|")
+		}
+		options[strings.TrimSpace(optionParts[0])] = optionValues
+	}
+	return strings.TrimSpace(tagParts[0]), options
+}
+
+// validateAllowed returns an error if the field restricts its values and
+// rawValue isn't one of them. Empty values are left to the field default.
+func (fi *fieldInfo) validateAllowed(rawValue string) error {
+	if len(fi.allowed) == 0 {
+		return nil
+	}
+	trimmedValue := strings.TrimSpace(rawValue)
+	if trimmedValue == "" {
+		return nil
+	}
+	for _, eachAllowed := range fi.allowed {
+		if trimmedValue == eachAllowed {
+			return nil
+		}
+	}
+	return errors.Errorf("unknown value %q (expected one of %s)",
+		trimmedValue,
+		strings.Join(fi.allowed, ", "))
+}
+
+// fieldByIndex returns the field in root identified by index, allocating
+// any nil pointers along the way
+func fieldByIndex(root reflect.Value, index []int) reflect.Value {
+	value := root
+	for _, eachIndex := range index {
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				value.Set(reflect.New(value.Type().Elem()))
+			}
+			value = value.Elem()
+		}
+		value = value.Field(eachIndex)
+	}
+	return value
+}
+
+// setValue parses rawValue according to the kind of target
+func setValue(target reflect.Value, rawValue string) error {
+	if target.Kind() == reflect.Ptr {
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+		return setValue(target.Elem(), rawValue)
+	}
+	trimmedValue := strings.TrimSpace(rawValue)
+	if target.CanAddr() && target.Addr().Type().Implements(textUnmarshalerType) {
+		unmarshaler := target.Addr().Interface().(encoding.TextUnmarshaler)
+		return unmarshaler.UnmarshalText([]byte(trimmedValue))
+	}
+	if target.Type() == durationType {
+		duration, durationErr := time.ParseDuration(trimmedValue)
+		if durationErr != nil {
+			return durationErr
+		}
+		target.SetInt(int64(duration))
+		return nil
+	}
+
+	switch target.Kind() {
+	case reflect.String:
+		target.SetString(rawValue)
+	case reflect.Bool:
+		boolVal, boolErr := parseBool(trimmedValue)
+		if boolErr != nil {
+			return boolErr
+		}
+		target.SetBool(boolVal)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		intVal, intErr := strconv.ParseInt(trimmedValue, 10, target.Type().Bits())
+		if intErr != nil {
+			return errors.Errorf("invalid integer %q", trimmedValue)
+		}
+		target.SetInt(intVal)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		uintVal, uintErr := strconv.ParseUint(trimmedValue, 10, target.Type().Bits())
+		if uintErr != nil {
+			return errors.Errorf("invalid unsigned integer %q", trimmedValue)
+		}
+		target.SetUint(uintVal)
+	case reflect.Float32, reflect.Float64:
+		floatVal, floatErr := strconv.ParseFloat(trimmedValue, target.Type().Bits())
+		if floatErr != nil {
+			return errors.Errorf("invalid number %q", trimmedValue)
+		}
+		target.SetFloat(floatVal)
+	case reflect.Interface:
+		if target.NumMethod() != 0 {
+			return errors.Errorf("unsupported type %s", target.Type())
+		}
+		target.Set(reflect.ValueOf(rawValue))
+	default:
+		return errors.Errorf("unsupported type %s", target.Type())
+	}
+	return nil
+}
+
+// setMapEntry decodes rawValue into the entryName element of the map
+// that target refers to
+func setMapEntry(target reflect.Value, entryName string, rawValue string) error {
+	if target.Kind() == reflect.Ptr {
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+		target = target.Elem()
+	}
+	if target.IsNil() {
+		target.Set(reflect.MakeMap(target.Type()))
+	}
+	elem := reflect.New(target.Type().Elem()).Elem()
+	setErr := setValue(elem, rawValue)
+	if setErr != nil {
+		return setErr
+	}
+	target.SetMapIndex(reflect.ValueOf(entryName).Convert(target.Type().Key()), elem)
+	return nil
+}
+
+// decodeRecord decodes the cells of a multi-column table row into elem,
+// which must be a struct or a map with string keys
+func decodeRecord(elem reflect.Value, pair KeyValuePair, options *decodeOptions) error {
+	if elem.Kind() == reflect.Ptr {
+		elem.Set(reflect.New(elem.Type().Elem()))
+		elem = elem.Elem()
+	}
+	switch {
+	case elem.Kind() == reflect.Struct && !isLeafType(elem.Type()):
+		_, decodeErr := decodePairs(pair.Record, elem.Addr().Interface(), options)
+		return decodeErr
+	case isStringMap(elem.Type()):
+		for _, eachCell := range pair.Record {
+			setErr := setMapEntry(elem, canonicalKey(eachCell.Key), eachCell.Value)
+			if setErr != nil {
+				return setErr
+			}
+		}
+		return nil
+	}
+	return errors.Errorf("table rows require a slice of structs or maps, got %s",
+		elem.Type())
+}
+
+// parseBool extends strconv.ParseBool with the yes/no values that
+// are common in podcast metadata
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "y", "on":
+		return true, nil
+	case "no", "n", "off":
+		return false, nil
+	}
+	boolVal, boolErr := strconv.ParseBool(value)
+	if boolErr != nil {
+		return false, errors.Errorf("invalid boolean %q", value)
+	}
+	return boolVal, nil
+}
+
+// isRepeatable returns true if the field accumulates repeated keys
+func isRepeatable(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8
+}
+
+// structValue returns the addressable struct value that instance refers to
+func structValue(instance interface{}) (reflect.Value, error) {
+	value := reflect.ValueOf(instance)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return reflect.Value{}, errors.Errorf("markson: non-nil pointer required, got %T", instance)
+	}
+	// Unwrap pointers to interfaces that hold pointers
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return reflect.Value{}, errors.Errorf("markson: non-nil pointer required, got %T", instance)
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return reflect.Value{}, errors.Errorf("markson: pointer to struct required, got %T", instance)
+	}
+	return value, nil
+}
+
+// decodePairs assigns the properties to the fields of instance. Keys are
+// matched case-insensitively. Slice fields receive one element per occurrence
+// of their key, in document order. Every other field may be assigned at most
+// once. Keys that do not map to a field are returned to the caller, or
+// reported as an *UnknownPropertiesError in strict mode.
+func decodePairs(properties KeyValuePairs,
+	instance interface{},
+	options *decodeOptions) (KeyValuePairs, error) {
+	rootValue, rootValueErr := structValue(instance)
+	if rootValueErr != nil {
+		return nil, rootValueErr
+	}
+	fields := make(map[string]*fieldInfo)
+	typeFields(rootValue.Type(), "", nil, fields)
+
+	unknownPairs := KeyValuePairs{}
+	assigned := make(map[string]int)
+	for _, eachPair := range properties {
+		canonicalName := canonicalKey(eachPair.Key)
+		field, fieldExists := fields[canonicalName]
+		if !fieldExists {
+			mapField, entryName := lookupMapField(fields, canonicalName)
+			if mapField == nil {
+				unknownPairs = append(unknownPairs, eachPair)
+				continue
+			}
+			if assignedLine, isAssigned := assigned[canonicalName]; isAssigned {
+				return nil, options.propertyError(mapField,
+					eachPair,
+					errors.Errorf("property already defined at %s",
+						formatPosition(options.source, assignedLine)))
+			}
+			assigned[canonicalName] = eachPair.Line
+			if eachPair.Record != nil {
+				return nil, options.propertyError(mapField,
+					eachPair,
+					errors.Errorf("table rows require a slice of structs or maps"))
+			}
+			setErr := setMapEntry(fieldByIndex(rootValue, mapField.index),
+				entryName,
+				eachPair.Value)
+			if setErr != nil {
+				return nil, options.propertyError(mapField, eachPair, setErr)
+			}
+			continue
+		}
+		if field.isMap {
+			if strings.TrimSpace(eachPair.Value) == "" {
+				continue
+			}
+			return nil, options.propertyError(field,
+				eachPair,
+				errors.Errorf("map entries must be defined as dotted keys or nested sections"))
+		}
+		target := fieldByIndex(rootValue, field.index)
+		if target.Kind() == reflect.Ptr && isRepeatable(target.Type().Elem()) {
+			if target.IsNil() {
+				target.Set(reflect.New(target.Type().Elem()))
+			}
+			target = target.Elem()
+		}
+		if eachPair.Record != nil {
+			if !isRepeatable(target.Type()) {
+				return nil, options.propertyError(field,
+					eachPair,
+					errors.Errorf("table rows require a slice of structs or maps"))
+			}
+			elem := reflect.New(target.Type().Elem()).Elem()
+			recordErr := decodeRecord(elem, eachPair, options)
+			switch recordErr.(type) {
+			case nil:
+			case *PropertyError, *UnknownPropertiesError:
+				// Already positioned at the cell
+				return nil, recordErr
+			default:
+				return nil, options.propertyError(field, eachPair, recordErr)
+			}
+			target.Set(reflect.Append(target, elem))
+			continue
+		}
+		if isRepeatable(target.Type()) && isRecordType(target.Type().Elem()) {
+			return nil, options.propertyError(field,
+				eachPair,
+				errors.Errorf("expected table rows, found text outside a table"))
+		}
+		fieldValue := eachPair.Value
+		if field.markdown && eachPair.Source != "" {
+			fieldValue = eachPair.Source
+		}
+		allowedErr := field.validateAllowed(fieldValue)
+		if allowedErr != nil {
+			return nil, options.propertyError(field, eachPair, allowedErr)
+		}
+		if isRepeatable(target.Type()) {
+			elem := reflect.New(target.Type().Elem()).Elem()
+			setErr := setValue(elem, fieldValue)
+			if setErr != nil {
+				return nil, options.propertyError(field, eachPair, setErr)
+			}
+			target.Set(reflect.Append(target, elem))
+			continue
+		}
+		if assignedLine, isAssigned := assigned[canonicalName]; isAssigned {
+			return nil, options.propertyError(field,
+				eachPair,
+				errors.Errorf("property already defined at %s",
+					formatPosition(options.source, assignedLine)))
+		}
+		assigned[canonicalName] = eachPair.Line
+		setErr := setValue(target, fieldValue)
+		if setErr != nil {
+			return nil, options.propertyError(field, eachPair, setErr)
+		}
+	}
+	if options.strict && len(unknownPairs) != 0 {
+		return unknownPairs, newUnknownPropertiesError(unknownPairs, fields, options.source)
+	}
+	return unknownPairs, nil
+}
+
+// propertyError annotates err with the field name and the position of pair
+func (options *decodeOptions) propertyError(field *fieldInfo,
+	pair KeyValuePair,
+	err error) error {
+	return &PropertyError{
+		Source: options.source,
+		Line:   pair.Line,
+		Key:    field.name,
+		Err:    err,
+	}
+}
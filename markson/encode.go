@@ -0,0 +1,425 @@
+package markson
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Marshal a tagged struct to a Markdown document
+////////////////////////////////////////////////////////////////////////////////
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// markdownSection is a single H1 section or properties table row. Sections
+// for slices of records have columns and rows rather than values.
+type markdownSection struct {
+	name    string
+	values  []string
+	columns []string
+	rows    [][]string
+}
+
+// Marshal returns the canonical Markdown document for instance, which must be
+// a struct or a pointer to a struct. Fields with the "section" tag option and
+// values that cannot be represented in a table cell are written as H1
+// sections, in field order. All other fields are written as rows of a table
+// under the propertiesHeader H1. Zero valued fields are omitted. Unmarshaling
+// the document with UnmarshalMarkson yields the original values, modulo the
+// leading and trailing whitespace of section values. Section fields without
+// the "markdown" tag option round trip if their value is HTML, as produced
+// by UnmarshalMarkson.
+func Marshal(instance interface{}, propertiesHeader string) ([]byte, error) {
+	rootValue := reflect.ValueOf(instance)
+	for rootValue.Kind() == reflect.Ptr || rootValue.Kind() == reflect.Interface {
+		if rootValue.IsNil() {
+			return nil, errors.Errorf("markson: cannot marshal nil %T", instance)
+		}
+		rootValue = rootValue.Elem()
+	}
+	if rootValue.Kind() != reflect.Struct {
+		return nil, errors.Errorf("markson: struct required, got %T", instance)
+	}
+	fields := make(map[string]*fieldInfo)
+	typeFields(rootValue.Type(), "", nil, fields)
+	orderedFields := make([]*fieldInfo, 0, len(fields))
+	for _, eachField := range fields {
+		orderedFields = append(orderedFields, eachField)
+	}
+	sort.Slice(orderedFields, func(lhs int, rhs int) bool {
+		return orderedFields[lhs].order < orderedFields[rhs].order
+	})
+
+	tableRows := []markdownSection{}
+	sections := []markdownSection{}
+	for _, eachField := range orderedFields {
+		fieldValue, fieldValueOk := lookupField(rootValue, eachField.index)
+		if !fieldValueOk {
+			continue
+		}
+		entries, entriesErr := formatEntries(eachField, fieldValue)
+		if entriesErr != nil {
+			return nil, errors.Errorf("%s: %s", eachField.name, entriesErr)
+		}
+		for _, eachEntry := range entries {
+			if eachField.section ||
+				eachEntry.columns != nil ||
+				!fitsTableCell(eachEntry.values) {
+				sections = append(sections, eachEntry)
+			} else {
+				tableRows = append(tableRows, eachEntry)
+			}
+		}
+	}
+
+	var output bytes.Buffer
+	if len(tableRows) != 0 {
+		writeHeading(&output, propertiesHeader)
+		propertyRows := [][]string{}
+		for _, eachRow := range tableRows {
+			for _, eachValue := range eachRow.values {
+				propertyRows = append(propertyRows, []string{eachRow.name, escapeTableCell(eachValue)})
+			}
+		}
+		writeTable(&output, []string{"Property", "Value"}, propertyRows)
+	}
+	for _, eachSection := range sections {
+		if eachSection.columns != nil {
+			if output.Len() != 0 {
+				output.WriteString("\n")
+			}
+			writeHeading(&output, eachSection.name)
+			writeTable(&output, eachSection.columns, eachSection.rows)
+			continue
+		}
+		for _, eachValue := range eachSection.values {
+			if output.Len() != 0 {
+				output.WriteString("\n")
+			}
+			writeHeading(&output, eachSection.name)
+			writeSectionValue(&output, eachValue)
+		}
+	}
+	return output.Bytes(), nil
+}
+
+// lookupField returns the field in root identified by index, or false if
+// a nil pointer is encountered along the way
+func lookupField(root reflect.Value, index []int) (reflect.Value, bool) {
+	value := root
+	for _, eachIndex := range index {
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				return reflect.Value{}, false
+			}
+			value = value.Elem()
+		}
+		value = value.Field(eachIndex)
+	}
+	return value, true
+}
+
+// formatEntries returns the named values of the field. Maps yield one
+// dotted entry per map key.
+func formatEntries(field *fieldInfo, fieldValue reflect.Value) ([]markdownSection, error) {
+	if fieldValue.Kind() == reflect.Ptr {
+		if fieldValue.IsNil() {
+			return nil, nil
+		}
+		fieldValue = fieldValue.Elem()
+	}
+	if isRepeatable(fieldValue.Type()) && isRecordType(fieldValue.Type().Elem()) {
+		if fieldValue.Len() == 0 {
+			return nil, nil
+		}
+		recordSection, recordSectionErr := formatRecords(field.name, fieldValue)
+		if recordSectionErr != nil {
+			return nil, recordSectionErr
+		}
+		return []markdownSection{*recordSection}, nil
+	}
+	if !field.isMap {
+		values, valuesErr := formatValues(fieldValue)
+		if valuesErr != nil || len(values) == 0 {
+			return nil, valuesErr
+		}
+		return []markdownSection{{name: field.name, values: values}}, nil
+	}
+	mapKeys := fieldValue.MapKeys()
+	sort.Slice(mapKeys, func(lhs int, rhs int) bool {
+		return mapKeys[lhs].String() < mapKeys[rhs].String()
+	})
+	entries := []markdownSection{}
+	for _, eachKey := range mapKeys {
+		values, valuesErr := formatValues(fieldValue.MapIndex(eachKey))
+		if valuesErr != nil {
+			return nil, valuesErr
+		}
+		if len(values) != 0 {
+			entries = append(entries, markdownSection{
+				name:   field.name + "." + eachKey.String(),
+				values: values,
+			})
+		}
+	}
+	return entries, nil
+}
+
+// formatValues returns the non-zero string representations of value. Slices
+// yield one string per element.
+func formatValues(value reflect.Value) ([]string, error) {
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil, nil
+		}
+		value = value.Elem()
+	}
+	if isRepeatable(value.Type()) {
+		values := []string{}
+		for i := 0; i < value.Len(); i++ {
+			elemValue, elemValueErr := formatValue(value.Index(i))
+			if elemValueErr != nil {
+				return nil, elemValueErr
+			}
+			values = append(values, elemValue)
+		}
+		return values, nil
+	}
+	if value.IsZero() {
+		return nil, nil
+	}
+	formatted, formattedErr := formatValue(value)
+	if formattedErr != nil {
+		return nil, formattedErr
+	}
+	return []string{formatted}, nil
+}
+
+// formatValue is the inverse of setValue
+func formatValue(value reflect.Value) (string, error) {
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return "", nil
+		}
+		value = value.Elem()
+	}
+	if value.Type().Implements(textMarshalerType) {
+		text, textErr := value.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), textErr
+	}
+	if value.Type() == durationType {
+		return value.Interface().(fmt.Stringer).String(), nil
+	}
+	switch value.Kind() {
+	case reflect.String:
+		return value.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(value.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(value.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(value.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(value.Float(), 'g', -1, value.Type().Bits()), nil
+	case reflect.Interface:
+		if value.IsNil() {
+			return "", nil
+		}
+		return fmt.Sprintf("%v", value.Interface()), nil
+	}
+	return "", errors.Errorf("unsupported type %s", value.Type())
+}
+
+// fitsTableCell returns true if every value can be written in a single
+// table cell
+func fitsTableCell(values []string) bool {
+	for _, eachValue := range values {
+		if strings.ContainsAny(eachValue, "\n") ||
+			strings.TrimSpace(eachValue) != eachValue ||
+			eachValue == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// tableCellEscaper backslash escapes the characters that start inline
+// Markdown, such as emphasis, code spans, links, HTML and entities. Table
+// cells are decoded from their text alone, so these would otherwise be
+// dropped or changed.
+var tableCellEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	"`", "\\`",
+	"*", "\\*",
+	"_", "\\_",
+	"~", "\\~",
+	"[", "\\[",
+	"!", "\\!",
+	"<", "\\<",
+	"&", "\\&",
+	"|", "\\|",
+)
+
+// autoLinkSchemePattern matches the URL schemes that start an autolink
+var autoLinkSchemePattern = regexp.MustCompile(`(?i)(https?|ftp|file|mailto):`)
+
+// escapeTableCell returns value escaped so that the table cell text decodes
+// to value
+func escapeTableCell(value string) string {
+	return autoLinkSchemePattern.ReplaceAllString(tableCellEscaper.Replace(value), `$1\:`)
+}
+
+func headingText(name string) string {
+	firstRune, runeWidth := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(firstRune)) + name[runeWidth:]
+}
+
+func writeHeading(output *bytes.Buffer, name string) {
+	fmt.Fprintf(output, "# %s\n\n", headingText(name))
+}
+
+func writeTable(output *bytes.Buffer, columns []string, rows [][]string) {
+	widths := make([]int, len(columns))
+	for i, eachColumn := range columns {
+		widths[i] = len(eachColumn)
+	}
+	for _, eachRow := range rows {
+		for i, eachCell := range eachRow {
+			if len(eachCell) > widths[i] {
+				widths[i] = len(eachCell)
+			}
+		}
+	}
+	writeRow := func(cells []string) {
+		for i, eachCell := range cells {
+			fmt.Fprintf(output, "| %-*s ", widths[i], eachCell)
+		}
+		output.WriteString("|\n")
+	}
+	writeRow(columns)
+	delimiters := make([]string, len(columns))
+	for i, eachWidth := range widths {
+		delimiters[i] = strings.Repeat("-", eachWidth)
+	}
+	writeRow(delimiters)
+	for _, eachRow := range rows {
+		writeRow(eachRow)
+	}
+}
+
+// writeSectionValue writes the section body. Section values are Markdown,
+// or HTML that Markdown passes through.
+func writeSectionValue(output *bytes.Buffer, value string) {
+	fmt.Fprintf(output, "%s\n", strings.TrimSpace(value))
+}
+
+// isRecordType returns true if slices of t are written as multi-column tables
+func isRecordType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return (t.Kind() == reflect.Struct && !isLeafType(t)) || isStringMap(t)
+}
+
+// formatRecords returns the multi-column table section for a slice of
+// structs or maps. Struct columns are the fields in declaration order, map
+// columns the sorted union of the map keys.
+func formatRecords(name string, sliceValue reflect.Value) (*markdownSection, error) {
+	records := make([]map[string]string, 0, sliceValue.Len())
+	columns := []string{}
+	elemType := sliceValue.Type().Elem()
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	var recordFields []*fieldInfo
+	if elemType.Kind() == reflect.Struct {
+		fields := make(map[string]*fieldInfo)
+		typeFields(elemType, "", nil, fields)
+		for _, eachField := range fields {
+			recordFields = append(recordFields, eachField)
+		}
+		sort.Slice(recordFields, func(lhs int, rhs int) bool {
+			return recordFields[lhs].order < recordFields[rhs].order
+		})
+		for _, eachField := range recordFields {
+			columns = append(columns, eachField.name)
+		}
+	}
+	mapColumns := make(map[string]bool)
+	for i := 0; i < sliceValue.Len(); i++ {
+		elemValue := sliceValue.Index(i)
+		if elemValue.Kind() == reflect.Ptr {
+			if elemValue.IsNil() {
+				continue
+			}
+			elemValue = elemValue.Elem()
+		}
+		record := make(map[string]string)
+		if elemValue.Kind() == reflect.Struct {
+			for _, eachField := range recordFields {
+				fieldValue, fieldValueOk := lookupField(elemValue, eachField.index)
+				if !fieldValueOk {
+					continue
+				}
+				values, valuesErr := formatValues(fieldValue)
+				if valuesErr != nil {
+					return nil, valuesErr
+				}
+				if len(values) > 1 {
+					return nil, errors.Errorf("%s: slices are not supported in table rows", eachField.name)
+				}
+				if len(values) == 1 {
+					record[eachField.name] = values[0]
+				}
+			}
+		} else {
+			for _, eachKey := range elemValue.MapKeys() {
+				cellValue, cellValueErr := formatValue(elemValue.MapIndex(eachKey))
+				if cellValueErr != nil {
+					return nil, cellValueErr
+				}
+				record[eachKey.String()] = cellValue
+				mapColumns[eachKey.String()] = true
+			}
+		}
+		records = append(records, record)
+	}
+	for eachColumn := range mapColumns {
+		columns = append(columns, eachColumn)
+	}
+	if elemType.Kind() != reflect.Struct {
+		sort.Strings(columns)
+	}
+	if len(columns) < minRecordColumns {
+		return nil, errors.Errorf("table rows require at least %d columns, %s has %d",
+			minRecordColumns,
+			elemType,
+			len(columns))
+	}
+	section := &markdownSection{
+		name:    name,
+		columns: columns,
+	}
+	for _, eachRecord := range records {
+		row := make([]string, len(columns))
+		for i, eachColumn := range columns {
+			cellValue := eachRecord[eachColumn]
+			if !fitsTableCell([]string{cellValue}) && cellValue != "" {
+				return nil, errors.Errorf("%s: value cannot be written in a table cell", eachColumn)
+			}
+			row[i] = escapeTableCell(cellValue)
+		}
+		section.rows = append(section.rows, row)
+	}
+	return section, nil
+}
@@ -0,0 +1,150 @@
+package markson
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// YAML front matter
+////////////////////////////////////////////////////////////////////////////////
+
+const frontMatterDelimiter = "---"
+
+// splitFrontMatter extracts an optional YAML front matter block that is
+// delimited by "---" lines at the very top of the document. The returned
+// body has the front matter lines blanked rather than removed, so that line
+// numbers in the body still match the source.
+func splitFrontMatter(data []byte) ([]byte, []byte) {
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines) == 0 ||
+		strings.TrimSpace(strings.TrimPrefix(string(lines[0]), "\ufeff")) != frontMatterDelimiter {
+		return nil, data
+	}
+	for i := 1; i < len(lines); i++ {
+		trimmedLine := strings.TrimSpace(string(lines[i]))
+		if trimmedLine != frontMatterDelimiter && trimmedLine != "..." {
+			continue
+		}
+		frontMatter := bytes.Join(lines[1:i], nil)
+		body := bytes.Repeat([]byte("\n"), i+1)
+		body = append(body, bytes.Join(lines[i+1:], nil)...)
+		return frontMatter, body
+	}
+	// Unterminated, so it's not front matter. Could just be
+	// a leading horizontal rule
+	return nil, data
+}
+
+// parseFrontMatter returns the flattened KeyValuePairs defined in the YAML
+// frontMatter. Nested mappings are flattened into dotted keys and sequences
+// into repeated keys, matching the struct field addressing used by the
+// Markdown body. Sequences of mappings are records, like the rows of a
+// multi-column table.
+func parseFrontMatter(frontMatter []byte) (KeyValuePairs, error) {
+	rootNode := yaml.Node{}
+	yamlErr := yaml.Unmarshal(frontMatter, &rootNode)
+	if yamlErr != nil {
+		return nil, errors.Wrapf(yamlErr, "invalid front matter")
+	}
+	properties := KeyValuePairs{}
+	if len(rootNode.Content) == 0 {
+		return properties, nil
+	}
+	documentNode := rootNode.Content[0]
+	if documentNode.Kind != yaml.MappingNode {
+		return nil, errors.Errorf("invalid front matter: expected a mapping")
+	}
+	flattenErr := flattenYAMLMapping(documentNode, "", &properties)
+	if flattenErr != nil {
+		return nil, flattenErr
+	}
+	// The front matter starts after the opening delimiter line
+	for i := range properties {
+		properties[i].Line++
+		for j := range properties[i].Record {
+			properties[i].Record[j].Line++
+		}
+	}
+	return properties, nil
+}
+
+func flattenYAMLMapping(mappingNode *yaml.Node,
+	prefix string,
+	properties *KeyValuePairs) error {
+	for i := 0; i+1 < len(mappingNode.Content); i += 2 {
+		keyNode := mappingNode.Content[i]
+		valueNode := mappingNode.Content[i+1]
+		keyName := prefix + keyNode.Value
+
+		switch valueNode.Kind {
+		case yaml.ScalarNode:
+			value := valueNode.Value
+			if valueNode.Tag == "!!null" {
+				value = ""
+			}
+			*properties = append(*properties, KeyValuePair{
+				Key:   keyName,
+				Value: value,
+				Line:  keyNode.Line,
+			})
+		case yaml.MappingNode:
+			flattenErr := flattenYAMLMapping(valueNode, keyName+".", properties)
+			if flattenErr != nil {
+				return flattenErr
+			}
+		case yaml.SequenceNode:
+			for _, eachElement := range valueNode.Content {
+				switch eachElement.Kind {
+				case yaml.ScalarNode:
+					*properties = append(*properties, KeyValuePair{
+						Key:   keyName,
+						Value: eachElement.Value,
+						Line:  eachElement.Line,
+					})
+				case yaml.MappingNode:
+					// Same as a row in a multi-column table
+					record := KeyValuePairs{}
+					flattenErr := flattenYAMLMapping(eachElement, "", &record)
+					if flattenErr != nil {
+						return flattenErr
+					}
+					*properties = append(*properties, KeyValuePair{
+						Key:    keyName,
+						Line:   eachElement.Line,
+						Record: record,
+					})
+				default:
+					return errors.Errorf("%s: unsupported front matter value, sequences must contain scalars or mappings",
+						keyName)
+				}
+			}
+		default:
+			return errors.Errorf("%s: unsupported front matter value", keyName)
+		}
+	}
+	return nil
+}
+
+// mergeFrontMatter returns the front matter properties followed by the
+// body properties. Any key that's defined in the body, either in the
+// Properties table or as an H1 section, replaces all front matter
+// definitions of that key.
+func mergeFrontMatter(frontMatterProperties KeyValuePairs,
+	bodyProperties KeyValuePairs) KeyValuePairs {
+
+	bodyKeys := make(map[string]bool)
+	for _, eachPair := range bodyProperties {
+		bodyKeys[canonicalKey(eachPair.Key)] = true
+	}
+	merged := KeyValuePairs{}
+	for _, eachPair := range frontMatterProperties {
+		if !bodyKeys[canonicalKey(eachPair.Key)] {
+			merged = append(merged, eachPair)
+		}
+	}
+	return append(merged, bodyProperties...)
+}
@@ -1,21 +1,30 @@
 package markson
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"strings"
 
+	"github.com/microcosm-cc/bluemonday"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/russross/blackfriday.v2"
 )
 
-// KeyValuePair represents a KV property pair
+// KeyValuePair represents a KV property pair. Line is the 1-based source
+// line of the heading or table row that defined the pair. The Value of a
+// section is its sanitized HTML rendering and Source is the section's raw
+// Markdown. Pairs produced from a row of a multi-column table have an empty
+// Value and hold the row cells, keyed by column header, in Record. Text
+// around the table is a separate pair with the section's key.
 type KeyValuePair struct {
-	Key   string
-	Value string
+	Key    string
+	Value  string
+	Source string
+	Line   int
+	Record KeyValuePairs
 }
 
 // KeyValuePairs represents a slice of KVPairs
@@ -29,77 +38,53 @@ type headerScopedParser interface {
 ////////////////////////////////////////////////////////////////////////////////
 // Parse everything and accumulate it
 ////////////////////////////////////////////////////////////////////////////////
+// htmlPolicy is the allowlist applied to the HTML rendered from
+// free-text sections, including any raw HTML in the Markdown source
+var htmlPolicy = bluemonday.UGCPolicy()
+
+func newHTMLRenderer() *blackfriday.HTMLRenderer {
+	return blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+		Flags: blackfriday.CommonHTMLFlags,
+	})
+}
+
 type userContentParser struct {
-	key   string
-	value strings.Builder
+	key      string
+	line     int
+	value    bytes.Buffer
+	records  KeyValuePairs
+	locator  *sourceLocator
+	renderer *blackfriday.HTMLRenderer
 }
 
 func (ucp *userContentParser) Pairs() KeyValuePairs {
-	return KeyValuePairs{KeyValuePair{
+	value := KeyValuePair{
 		Key:   ucp.key,
-		Value: ucp.value.String(),
-	}}
-}
-
-func (ucp *userContentParser) writeTag(tagName string, entering bool) {
-	if entering {
-		fmt.Fprintf(&ucp.value, "<%s>", tagName)
-	} else {
-		fmt.Fprintf(&ucp.value, "</%s>", tagName)
+		Value: htmlPolicy.Sanitize(ucp.value.String()),
+		Line:  ucp.line,
 	}
+	// A section with a multi-column table is a set of records. Any
+	// other content is kept as the section value, so that decoding it
+	// reports the text rather than dropping it.
+	if len(ucp.records) != 0 {
+		if strings.TrimSpace(value.Value) == "" {
+			return ucp.records
+		}
+		return append(KeyValuePairs{value}, ucp.records...)
+	}
+	return KeyValuePairs{value}
 }
 
 func (ucp *userContentParser) Walk(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
-	switch node.Type {
-	case blackfriday.List:
-		listElement := "ul"
-		if node.ListData.ListFlags&blackfriday.ListTypeOrdered != 0 {
-			listElement = "ol"
-		}
-		ucp.writeTag(listElement, entering)
-	case blackfriday.Item:
-		ucp.writeTag("li", entering)
-	case blackfriday.Paragraph:
-		fmt.Fprintf(&ucp.value, "\n")
-	case blackfriday.Heading:
-		tag := fmt.Sprintf("h%d", node.HeadingData.Level)
-		ucp.writeTag(tag, entering)
-	case blackfriday.HorizontalRule:
-		ucp.writeTag("hr", entering)
-	case blackfriday.Emph:
-		ucp.writeTag("i", entering)
-	case blackfriday.Strong:
-		ucp.writeTag("b", entering)
-	case blackfriday.Del:
-		ucp.writeTag("del", entering)
-	case blackfriday.Link:
-		if entering {
-			fmt.Fprintf(&ucp.value, `<a href="%s">`, node.LinkData.Destination)
-		} else {
-			fmt.Fprintf(&ucp.value, "</a>")
+	if node.Type == blackfriday.Table && entering {
+		columns := tableColumns(node)
+		if len(columns) >= minRecordColumns {
+			ucp.records = append(ucp.records,
+				tableRecords(ucp.key, node, columns, ucp.locator)...)
+			return blackfriday.SkipChildren
 		}
-	case blackfriday.Softbreak:
-		ucp.writeTag("p", entering)
-	case blackfriday.Hardbreak:
-		ucp.writeTag("br", entering)
-	case blackfriday.Code:
-		ucp.writeTag("code", entering)
-	case blackfriday.HTMLSpan:
-		ucp.writeTag("span", entering)
-	case blackfriday.Table:
-		ucp.writeTag("table", entering)
-	case blackfriday.TableCell:
-		ucp.writeTag("td", entering)
-	case blackfriday.TableHead:
-		ucp.writeTag("th", entering)
-	case blackfriday.TableBody:
-		ucp.writeTag("tbody", entering)
-	case blackfriday.TableRow:
-		ucp.writeTag("tr", entering)
-	default:
-		fmt.Fprintf(&ucp.value, string(node.Literal))
 	}
-	return blackfriday.GoToNext
+	return ucp.renderer.RenderNode(&ucp.value, node, entering)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -110,6 +95,7 @@ type sectionScopedPropertyParser struct {
 	pair        KeyValuePair
 	pairs       KeyValuePairs
 	inTableBody bool
+	locator     *sourceLocator
 }
 
 func (sspp *sectionScopedPropertyParser) Pairs() KeyValuePairs {
@@ -129,8 +115,7 @@ func (sspp *sectionScopedPropertyParser) Walk(node *blackfriday.Node, entering b
 					sspp.pairs = KeyValuePairs{}
 				}
 				sspp.pairs = append(sspp.pairs, sspp.pair)
-				sspp.pair.Key = ""
-				sspp.pair.Value = ""
+				sspp.pair = KeyValuePair{}
 			}
 		}
 	case blackfriday.Text:
@@ -139,6 +124,7 @@ func (sspp *sectionScopedPropertyParser) Walk(node *blackfriday.Node, entering b
 				value := string(node.Literal)
 				if sspp.pair.Key == "" {
 					sspp.pair.Key = strings.ToLower(value)
+					sspp.pair.Line = sspp.locator.tableRowLine(value)
 				} else if value != "" {
 					sspp.pair.Value += value
 				}
@@ -149,35 +135,78 @@ func (sspp *sectionScopedPropertyParser) Walk(node *blackfriday.Node, entering b
 }
 
 func parseMarkson(propertiesTableHeaderName string,
+	locator *sourceLocator,
+	nestedSections bool,
 	properties *[]KeyValuePair) blackfriday.NodeVisitor {
 
 	var curParser headerScopedParser
+	renderer := newHTMLRenderer()
 	headingName := ""
+	headingLevel := 0
 	inHeading := false
+	// Canonical names of the enclosing headings, starting with the H1
+	sectionPath := []string{}
+
+	flushParser := func(omitEmpty bool) {
+		if curParser == nil {
+			return
+		}
+		for _, eachPair := range curParser.Pairs() {
+			if omitEmpty && strings.TrimSpace(eachPair.Value) == "" {
+				continue
+			}
+			*properties = append(*properties, eachPair)
+		}
+		curParser = nil
+	}
 
 	nodeVisitor := func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
 
+		// In nested mode, a sub heading of a content section starts
+		// a nested key
+		_, inContentSection := curParser.(*userContentParser)
+		isNestedHeading := nestedSections &&
+			inContentSection &&
+			node.Type == blackfriday.Heading &&
+			node.HeadingData.Level > 1
+
 		// If there's a parser, return that...
-		if headingName == "" &&
+		if !inHeading &&
+			entering &&
 			node.Type == blackfriday.Heading &&
-			node.HeadingData.Level == 1 {
+			(node.HeadingData.Level == 1 || isNestedHeading) {
 			inHeading = true
+			headingLevel = node.HeadingData.Level
 
-			if curParser != nil {
-				*properties = append(*properties, curParser.Pairs()...)
-			}
-			curParser = nil
+			// The parent section text is optional if it's
+			// followed by sub sections
+			flushParser(isNestedHeading)
 		} else if inHeading && node.Type == blackfriday.Text {
-			headingName = string(node.Literal)
+			headingName += string(node.Literal)
 		} else if inHeading &&
 			node.Type == blackfriday.Heading {
 			canonicalName := strings.TrimSpace(strings.ToLower(headingName))
-			switch canonicalName {
-			case propertiesTableHeaderName:
-				curParser = &sectionScopedPropertyParser{}
+			headingLine := locator.headingLine(headingLevel, headingName)
+			if headingLevel == 1 {
+				sectionPath = []string{canonicalName}
+			} else {
+				parentDepth := headingLevel - 1
+				if parentDepth > len(sectionPath) {
+					parentDepth = len(sectionPath)
+				}
+				sectionPath = append(sectionPath[:parentDepth], canonicalName)
+			}
+			switch {
+			case headingLevel == 1 && canonicalName == propertiesTableHeaderName:
+				curParser = &sectionScopedPropertyParser{
+					locator: locator,
+				}
 			default:
 				curParser = &userContentParser{
-					key: canonicalName,
+					key:      strings.Join(sectionPath, "."),
+					line:     headingLine,
+					locator:  locator,
+					renderer: renderer,
 				}
 			}
 			headingName = ""
@@ -190,7 +219,7 @@ func parseMarkson(propertiesTableHeaderName string,
 			if node.Next == nil &&
 				node.Type == blackfriday.Document &&
 				!entering {
-				*properties = append(*properties, curParser.Pairs()...)
+				flushParser(false)
 			}
 			return nextNode
 		}
@@ -199,56 +228,105 @@ func parseMarkson(propertiesTableHeaderName string,
 	return nodeVisitor
 }
 
+// Option configures UnmarshalMarkson
+type Option func(options *decodeOptions)
+
+type decodeOptions struct {
+	strict         bool
+	nestedSections bool
+	source         string
+}
+
+// Strict returns an Option that fails the unmarshal with an
+// *UnknownPropertiesError if any key does not map to a field of the
+// target struct
+func Strict() Option {
+	return func(options *decodeOptions) {
+		options.strict = true
+	}
+}
+
+// NestedSections returns an Option that treats H2 and deeper headings within
+// an H1 section as nested keys. For instance, "## Intro" under "# Chapters"
+// defines the key "chapters.intro", which decodes into the Intro field of a
+// Chapters struct field or the "intro" entry of a Chapters map field. Without
+// this option sub headings are part of the enclosing H1 section value.
+func NestedSections() Option {
+	return func(options *decodeOptions) {
+		options.nestedSections = true
+	}
+}
+
+// Source returns an Option that names the input in error messages, typically
+// with the object key or filename the document was read from
+func Source(sourceName string) Option {
+	return func(options *decodeOptions) {
+		options.source = sourceName
+	}
+}
+
 // UnmarshalMarkson unmarshals the Markdown definition of instance
 // based on the contents of input. The propertyTableHeaderName is the reserved
 // H1 - level element name whose content will be parsed as a KV table definition
-// in a Markdown table. All other H1 level nodes will be treated as KV definitions
-// The merged KV multimap will be JSON unmarshalled into instance.
+// in a Markdown table. All other H1 level nodes will be treated as KV definitions.
+// The merged KV multimap is decoded into the fields of instance, which must be
+// a pointer to a struct. Fields are matched by their `markson` struct tag.
+// The document may begin with a YAML front matter block delimited by "---"
+// lines. Front matter values are defaults: a key that's also defined in the
+// Markdown body, either in the properties table or as an H1 section, takes
+// the body value.
+// Keys without a matching field are ignored unless the Strict option is set.
+// Decode errors are reported as *PropertyError values that include the
+// source line of the offending property.
 func UnmarshalMarkson(input io.Reader,
 	propertyTableHeaderName string,
 	instance interface{},
-	logger *logrus.Logger) error {
+	logger *logrus.Logger,
+	options ...Option) error {
+	decodeOpts := &decodeOptions{}
+	for _, eachOption := range options {
+		eachOption(decodeOpts)
+	}
+
 	data, dataErr := ioutil.ReadAll(input)
 	if dataErr != nil {
 		return dataErr
 	}
+	frontMatter, body := splitFrontMatter(data)
+	frontMatterProperties := KeyValuePairs{}
+	if frontMatter != nil {
+		parsedProperties, parsedPropertiesErr := parseFrontMatter(frontMatter)
+		if parsedPropertiesErr != nil {
+			return errors.Errorf("%s: %s",
+				formatPosition(decodeOpts.source, 0),
+				parsedPropertiesErr)
+		}
+		frontMatterProperties = parsedProperties
+	}
 	mdParser := blackfriday.New(blackfriday.WithExtensions(blackfriday.CommonExtensions))
-	tree := mdParser.Parse([]byte(data))
+	tree := mdParser.Parse(body)
 	if tree == nil {
 		return errors.Errorf("Failed to parse input")
 	}
 
-	properties := make([]KeyValuePair, 0)
-	tree.Walk(parseMarkson(propertyTableHeaderName, &properties))
-
-	// So we need to extract the content
-	mapProperties := make(map[string]interface{})
-	for _, eachPair := range properties {
-		canonicalKeyName := strings.ToLower(eachPair.Key)
-
-		// Set it...
-		existingVal := mapProperties[canonicalKeyName]
-		switch typedVal := existingVal.(type) {
-		case string:
-			mapProperties[canonicalKeyName] = []string{typedVal, eachPair.Value}
-		case []string:
-			mapProperties[canonicalKeyName] = append(typedVal, eachPair.Value)
-		default:
-			mapProperties[canonicalKeyName] = eachPair.Value
-		}
+	bodyProperties := make([]KeyValuePair, 0)
+	locator := newSourceLocator(body)
+	tree.Walk(parseMarkson(propertyTableHeaderName,
+		locator,
+		decodeOpts.nestedSections,
+		&bodyProperties))
+	for i := range bodyProperties {
+		bodyProperties[i].Source = locator.sectionSource(bodyProperties[i].Line)
 	}
-	// Great, marshal to json
-	jsonBytes, jsonBytesErr := json.MarshalIndent(mapProperties, "", " ")
-	if jsonBytesErr != nil {
-		return jsonBytesErr
-	}
-	unmarshallErr := json.Unmarshal(jsonBytes, instance)
-	if unmarshallErr != nil {
-		return unmarshallErr
+	properties := mergeFrontMatter(frontMatterProperties, bodyProperties)
+
+	unknownProperties, decodeErr := decodePairs(properties, instance, decodeOpts)
+	if decodeErr != nil {
+		return decodeErr
 	}
 	logger.WithFields(logrus.Fields{
-		"jsonBytes":             string(jsonBytes),
-		"configProps":           mapProperties,
+		"configProps":           properties,
+		"unknownProps":          unknownProperties,
 		"unmarshaleledInstance": instance,
 		"configType":            fmt.Sprintf("%#v", instance),
 	}).Debug("Raw config props")
@@ -0,0 +1,623 @@
+package markson
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testPropertiesHeader = "properties"
+
+type testVoice struct {
+	VoiceID string `markson:"voiceID"`
+	Rate    int    `markson:"rate"`
+}
+
+type testEpisode struct {
+	Title     string        `markson:"title"`
+	Episode   string        `markson:"episode,markdown"`
+	Order     int           `markson:"itunes:order"`
+	Engine    string        `markson:"polly:engineType,oneof=standard|neural"`
+	Explicit  bool          `markson:"itunes:explicit"`
+	Published time.Time     `markson:"pubDate"`
+	Length    time.Duration `markson:"length"`
+	Tags      []string      `markson:"tag"`
+	Voice     testVoice     `markson:"polly"`
+	Ignored   string        `markson:"-"`
+}
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+	return logger
+}
+
+func unmarshalTestDoc(t *testing.T, doc string, instance interface{}) error {
+	t.Helper()
+	return UnmarshalMarkson(strings.NewReader(doc),
+		testPropertiesHeader,
+		instance,
+		testLogger())
+}
+
+func TestUnmarshalTypedFields(t *testing.T) {
+	doc := `
+# Properties
+
+| Key              | Value                |
+| ---------------- | -------------------- |
+| Title            | Episode One          |
+| itunes:order     | 42                   |
+| itunes:explicit  | No                   |
+| pubDate          | 2020-01-02T03:04:05Z |
+| length           | 1m30s                |
+| tag              | go                   |
+| tag              | aws                  |
+| polly.voiceID    | Matthew              |
+| polly.rate       | 90                   |
+| ignored          | nope                 |
+
+# Episode
+
+Hello world
+`
+	episode := testEpisode{}
+	err := unmarshalTestDoc(t, doc, &episode)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if episode.Title != "Episode One" {
+		t.Errorf("Unexpected title: %q", episode.Title)
+	}
+	if episode.Order != 42 {
+		t.Errorf("Unexpected order: %d", episode.Order)
+	}
+	if episode.Explicit {
+		t.Errorf("Expected explicit to be false")
+	}
+	expectedDate := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if !episode.Published.Equal(expectedDate) {
+		t.Errorf("Unexpected pubDate: %s", episode.Published)
+	}
+	if episode.Length != 90*time.Second {
+		t.Errorf("Unexpected length: %s", episode.Length)
+	}
+	if strings.Join(episode.Tags, ",") != "go,aws" {
+		t.Errorf("Unexpected tags: %#v", episode.Tags)
+	}
+	if episode.Voice.VoiceID != "Matthew" || episode.Voice.Rate != 90 {
+		t.Errorf("Unexpected nested struct: %#v", episode.Voice)
+	}
+	if episode.Ignored != "" {
+		t.Errorf("Excluded field was assigned: %q", episode.Ignored)
+	}
+	if !strings.Contains(episode.Episode, "Hello world") {
+		t.Errorf("Unexpected episode: %q", episode.Episode)
+	}
+}
+
+func TestUnmarshalRepeatedScalar(t *testing.T) {
+	doc := `
+# Title
+
+First
+
+# Title
+
+Second
+`
+	episode := testEpisode{}
+	err := unmarshalTestDoc(t, doc, &episode)
+	if err == nil {
+		t.Fatalf("Expected an error for a repeated scalar property")
+	}
+	if !strings.Contains(err.Error(), "title") {
+		t.Errorf("Error does not name the property: %v", err)
+	}
+}
+
+func TestUnmarshalInvalidValue(t *testing.T) {
+	doc := `
+# Properties
+
+| Key          | Value |
+| ------------ | ----- |
+| itunes:order | first |
+`
+	episode := testEpisode{}
+	err := unmarshalTestDoc(t, doc, &episode)
+	if err == nil {
+		t.Fatalf("Expected an error for an invalid integer")
+	}
+}
+
+func TestUnmarshalRequiresStructPointer(t *testing.T) {
+	episode := testEpisode{}
+	if unmarshalTestDoc(t, "# Title\n\nValue\n", episode) == nil {
+		t.Errorf("Expected an error for a non-pointer instance")
+	}
+	var target interface{} = &episode
+	if err := unmarshalTestDoc(t, "# Title\n\nValue\n", &target); err != nil {
+		t.Errorf("Failed to unmarshal through interface: %v", err)
+	}
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	doc := `
+# Properties
+
+| Key             | Value   |
+| --------------- | ------- |
+| Titel           | Typo    |
+| polly.voiceIdd  | Matthew |
+| completely-new  | value   |
+`
+	episode := testEpisode{}
+	if err := unmarshalTestDoc(t, doc, &episode); err != nil {
+		t.Fatalf("Non-strict unmarshal failed: %v", err)
+	}
+	err := UnmarshalMarkson(strings.NewReader(doc),
+		testPropertiesHeader,
+		&episode,
+		testLogger(),
+		Strict())
+	unknownErr, unknownErrOk := err.(*UnknownPropertiesError)
+	if !unknownErrOk {
+		t.Fatalf("Expected *UnknownPropertiesError, got: %#v", err)
+	}
+	expected := []UnknownProperty{
+		{Key: "titel", Line: 6, Suggestion: "title"},
+		{Key: "polly.voiceidd", Line: 7, Suggestion: "polly.voiceID"},
+		{Key: "completely-new", Line: 8, Suggestion: ""},
+	}
+	if len(unknownErr.Properties) != len(expected) {
+		t.Fatalf("Unexpected unknown properties: %#v", unknownErr.Properties)
+	}
+	for i, eachExpected := range expected {
+		if unknownErr.Properties[i] != eachExpected {
+			t.Errorf("Property %d: expected %#v, got %#v",
+				i,
+				eachExpected,
+				unknownErr.Properties[i])
+		}
+	}
+	t.Logf("Strict error: %s", err)
+}
+
+func TestUnmarshalErrorPositions(t *testing.T) {
+	doc := `# Title
+
+Episode One
+
+# Properties
+
+| Key              | Value  |
+| ---------------- | ------ |
+| itunes:order     | 1      |
+| polly:engineType | nueral |
+`
+	episode := testEpisode{}
+	err := UnmarshalMarkson(strings.NewReader(doc),
+		testPropertiesHeader,
+		&episode,
+		testLogger(),
+		Source("episode3.md"))
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown engine type")
+	}
+	expected := `episode3.md:10: polly:engineType: unknown value "nueral" (expected one of standard, neural)`
+	if err.Error() != expected {
+		t.Errorf("Unexpected error.\nExpected: %s\nActual:   %s", expected, err)
+	}
+
+	repeatedDoc := "# Title\n\nOne\n\n```\n# Title\n```\n\nTitle\n=====\n\nTwo\n"
+	err = UnmarshalMarkson(strings.NewReader(repeatedDoc),
+		testPropertiesHeader,
+		&testEpisode{},
+		testLogger(),
+		Source("episode3.md"))
+	expected = "episode3.md:9: title: property already defined at episode3.md:1"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Unexpected error.\nExpected: %s\nActual:   %v", expected, err)
+	}
+}
+
+func TestUnmarshalFrontMatter(t *testing.T) {
+	doc := `---
+title: Front Matter Title
+itunes:order: 7
+tag:
+  - go
+  - aws
+polly:
+  voiceID: Joanna
+  rate: 80
+---
+
+# Properties
+
+| Key           | Value   |
+| ------------- | ------- |
+| polly.voiceID | Matthew |
+
+# Episode
+
+Body text
+`
+	episode := testEpisode{}
+	err := unmarshalTestDoc(t, doc, &episode)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if episode.Title != "Front Matter Title" || episode.Order != 7 {
+		t.Errorf("Front matter scalars not decoded: %#v", episode)
+	}
+	if strings.Join(episode.Tags, ",") != "go,aws" {
+		t.Errorf("Front matter sequence not decoded: %#v", episode.Tags)
+	}
+	// The Properties table overrides the front matter
+	if episode.Voice.VoiceID != "Matthew" || episode.Voice.Rate != 80 {
+		t.Errorf("Unexpected nested values: %#v", episode.Voice)
+	}
+	if !strings.Contains(episode.Episode, "Body text") {
+		t.Errorf("Unexpected episode: %q", episode.Episode)
+	}
+
+	err = UnmarshalMarkson(strings.NewReader(doc),
+		testPropertiesHeader,
+		&struct {
+			Title string `markson:"title"`
+		}{},
+		testLogger(),
+		Strict(),
+		Source("episode.md"))
+	unknownErr, unknownErrOk := err.(*UnknownPropertiesError)
+	if !unknownErrOk || unknownErr.Properties[0].Line != 3 {
+		t.Errorf("Expected front matter position in error, got: %v", err)
+	}
+}
+
+func TestUnmarshalLeadingHorizontalRule(t *testing.T) {
+	doc := "---\n\n# Title\n\nNo front matter\n"
+	episode := testEpisode{}
+	err := unmarshalTestDoc(t, doc, &episode)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if !strings.Contains(episode.Title, "No front matter") {
+		t.Errorf("Unexpected title: %q", episode.Title)
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	source := testEpisode{
+		Title:     "Episode One",
+		Order:     3,
+		Engine:    "neural",
+		Explicit:  true,
+		Published: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Length:    90 * time.Second,
+		Tags:      []string{"go", "aws"},
+		Voice: testVoice{
+			VoiceID: "Matthew",
+		},
+		Episode: "<speak>\n  Hello <break time=\"1s\"/> world\n</speak>",
+		Ignored: "not written",
+	}
+	markdown, markdownErr := Marshal(&source, testPropertiesHeader)
+	if markdownErr != nil {
+		t.Fatalf("Failed to marshal: %v", markdownErr)
+	}
+	t.Logf("Markdown:\n%s", markdown)
+	if strings.Contains(string(markdown), "not written") {
+		t.Errorf("Excluded field was marshaled")
+	}
+
+	roundTrip := testEpisode{}
+	err := unmarshalTestDoc(t, string(markdown), &roundTrip)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	roundTrip.Episode = strings.TrimSpace(roundTrip.Episode)
+	source.Ignored = ""
+	if !reflect.DeepEqual(source, roundTrip) {
+		t.Errorf("Round trip mismatch.\nExpected: %#v\nActual:   %#v", source, roundTrip)
+	}
+
+	// Marshaling the round tripped value is stable
+	secondMarkdown, _ := Marshal(roundTrip, testPropertiesHeader)
+	if string(secondMarkdown) != string(markdown) {
+		t.Errorf("Marshal is not canonical.\nFirst:\n%s\nSecond:\n%s", markdown, secondMarkdown)
+	}
+}
+
+func TestMarshalRoundTripMarkdownValues(t *testing.T) {
+	values := []string{
+		"*Bold* and _italic_ and ~~struck~~",
+		"snake_case_name",
+		"`go test` output",
+		"<b>not HTML</b> & &amp; entities",
+		"Left | Right",
+		`C:\Users\spartacast\*`,
+		"[Link](https://example.com/a_b) ![Image](x.png)",
+		"https://example.com/path_with_underscores?a=1&b=2.",
+		"mailto:someone@example.com",
+	}
+	for _, eachValue := range values {
+		source := testEpisode{
+			Title: eachValue,
+			Tags:  []string{eachValue},
+			Voice: testVoice{
+				VoiceID: eachValue,
+			},
+		}
+		markdown, markdownErr := Marshal(&source, testPropertiesHeader)
+		if markdownErr != nil {
+			t.Fatalf("Failed to marshal %q: %v", eachValue, markdownErr)
+		}
+		roundTrip := testEpisode{}
+		err := unmarshalTestDoc(t, string(markdown), &roundTrip)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal %q: %v", eachValue, err)
+		}
+		if !reflect.DeepEqual(source, roundTrip) {
+			t.Errorf("Round trip mismatch.\nExpected: %#v\nActual:   %#v\n%s", source, roundTrip, markdown)
+		}
+
+		credits := testCredits{
+			Guests: []testGuest{{Name: eachValue, Role: "Host", URL: eachValue}},
+		}
+		markdown, markdownErr = Marshal(&credits, testPropertiesHeader)
+		if markdownErr != nil {
+			t.Fatalf("Failed to marshal %q: %v", eachValue, markdownErr)
+		}
+		roundTripCredits := testCredits{}
+		err = unmarshalTestDoc(t, string(markdown), &roundTripCredits)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal %q: %v", eachValue, err)
+		}
+		if !reflect.DeepEqual(credits, roundTripCredits) {
+			t.Errorf("Round trip mismatch.\nExpected: %#v\nActual:   %#v\n%s", credits, roundTripCredits, markdown)
+		}
+	}
+}
+
+type testChapters struct {
+	Intro  string `markson:"intro"`
+	Outro  string `markson:"outro"`
+	Guests struct {
+		Host string `markson:"host"`
+	} `markson:"guests"`
+}
+
+type testShowNotes struct {
+	Title    string            `markson:"title"`
+	Chapters testChapters      `markson:"chapters"`
+	Credits  map[string]string `markson:"credits"`
+}
+
+func TestUnmarshalNestedSections(t *testing.T) {
+	doc := `# Title
+
+Nested
+
+# Chapters
+
+## Intro
+
+Welcome
+
+## Guests
+
+### Host
+
+Alice
+
+# Credits
+
+## Music
+
+Bob
+
+## Art
+
+Carol
+`
+	notes := testShowNotes{}
+	err := UnmarshalMarkson(strings.NewReader(doc),
+		testPropertiesHeader,
+		&notes,
+		testLogger(),
+		Strict(),
+		NestedSections())
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if strings.TrimSpace(notes.Chapters.Intro) != "<p>Welcome</p>" ||
+		strings.TrimSpace(notes.Chapters.Guests.Host) != "<p>Alice</p>" {
+		t.Errorf("Unexpected nested struct: %#v", notes.Chapters)
+	}
+	if len(notes.Credits) != 2 ||
+		strings.TrimSpace(notes.Credits["music"]) != "<p>Bob</p>" ||
+		strings.TrimSpace(notes.Credits["art"]) != "<p>Carol</p>" {
+		t.Errorf("Unexpected nested map: %#v", notes.Credits)
+	}
+
+	// Without the option the sub headings are part of the H1 value,
+	// which can't be assigned to a map
+	err = unmarshalTestDoc(t, doc, &testShowNotes{})
+	if err == nil || !strings.Contains(err.Error(), "credits") {
+		t.Errorf("Expected error for flattened map section, got: %v", err)
+	}
+
+	// Maps round trip as dotted keys
+	markdown, markdownErr := Marshal(&notes, testPropertiesHeader)
+	if markdownErr != nil {
+		t.Fatalf("Failed to marshal: %v", markdownErr)
+	}
+	roundTrip := testShowNotes{}
+	err = unmarshalTestDoc(t, string(markdown), &roundTrip)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal marshaled notes: %v\n%s", err, markdown)
+	}
+	if strings.TrimSpace(roundTrip.Credits["music"]) != "<p>Bob</p>" {
+		t.Errorf("Unexpected round trip map: %#v\n%s", roundTrip.Credits, markdown)
+	}
+}
+
+type testGuest struct {
+	Name string `markson:"name"`
+	Role string `markson:"role"`
+	URL  string `markson:"url"`
+}
+
+type testCredits struct {
+	Guests   []testGuest         `markson:"guests"`
+	Chapters []map[string]string `markson:"chapters"`
+}
+
+func TestUnmarshalRecordTables(t *testing.T) {
+	doc := `# Guests
+
+| Name  | Role  | URL                 |
+| ----- | ----- | ------------------- |
+| Alice | Host  | https://example.com |
+| Bob   | Guest |                     |
+
+# Chapters
+
+| Time  | Title   | URL                 |
+| ----- | ------- | ------------------- |
+| 00:00 | Intro   |                     |
+| 05:30 | Lambda  | https://example.com |
+`
+	credits := testCredits{}
+	err := UnmarshalMarkson(strings.NewReader(doc),
+		testPropertiesHeader,
+		&credits,
+		testLogger(),
+		Strict())
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	expectedGuests := []testGuest{
+		{Name: "Alice", Role: "Host", URL: "https://example.com"},
+		{Name: "Bob", Role: "Guest"},
+	}
+	if !reflect.DeepEqual(credits.Guests, expectedGuests) {
+		t.Errorf("Unexpected guests: %#v", credits.Guests)
+	}
+	if len(credits.Chapters) != 2 ||
+		credits.Chapters[1]["time"] != "05:30" ||
+		credits.Chapters[1]["title"] != "Lambda" {
+		t.Errorf("Unexpected chapters: %#v", credits.Chapters)
+	}
+
+	markdown, markdownErr := Marshal(&credits, testPropertiesHeader)
+	if markdownErr != nil {
+		t.Fatalf("Failed to marshal: %v", markdownErr)
+	}
+	roundTrip := testCredits{}
+	err = unmarshalTestDoc(t, string(markdown), &roundTrip)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal marshaled records: %v", err)
+	}
+	if !reflect.DeepEqual(credits, roundTrip) {
+		t.Errorf("Round trip mismatch.\nExpected: %#v\nActual:   %#v\n%s", credits, roundTrip, markdown)
+	}
+
+	badDoc := "# Guests\n\n| Name | Rol | URL |\n| --- | --- | --- |\n| Alice | Host | x |\n"
+	err = UnmarshalMarkson(strings.NewReader(badDoc),
+		testPropertiesHeader,
+		&testCredits{},
+		testLogger(),
+		Strict())
+	unknownErr, unknownErrOk := err.(*UnknownPropertiesError)
+	if !unknownErrOk ||
+		unknownErr.Properties[0].Suggestion != "role" ||
+		unknownErr.Properties[0].Line != 5 {
+		t.Errorf("Expected unknown column error, got: %v", err)
+	}
+
+	// Text around the table isn't silently dropped
+	mixedDoc := "# Guests\n\nEveryone who was on the show.\n\n| Name | Role | URL |\n| --- | --- | --- |\n| Alice | Host | x |\n"
+	err = unmarshalTestDoc(t, mixedDoc, &testCredits{})
+	propertyErr, propertyErrOk := err.(*PropertyError)
+	if !propertyErrOk ||
+		propertyErr.Key != "guests" ||
+		propertyErr.Line != 1 ||
+		!strings.Contains(err.Error(), "outside a table") {
+		t.Errorf("Expected mixed content error, got: %v", err)
+	}
+}
+
+func TestUnmarshalFrontMatterRecords(t *testing.T) {
+	doc := `---
+guests:
+  - name: Alice
+    role: Host
+    url: https://example.com
+---
+`
+	credits := testCredits{}
+	err := unmarshalTestDoc(t, doc, &credits)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if len(credits.Guests) != 1 || credits.Guests[0].Role != "Host" {
+		t.Errorf("Unexpected guests: %#v", credits.Guests)
+	}
+}
+
+func TestUnmarshalSectionHTML(t *testing.T) {
+	type showNotes struct {
+		Description string `markson:"description"`
+		Source      string `markson:"source,markdown"`
+	}
+	doc := `# Description
+
+Save 100% on *everything* & more <script>alert("x")</script>
+with a softbreak.
+
+> A quote
+
+![Gopher](https://example.com/gopher.png)
+
+~~~go
+if a < b {}
+~~~
+
+# Source
+
+Some **bold** text
+`
+	notes := showNotes{}
+	err := unmarshalTestDoc(t, doc, &notes)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	expectedFragments := []string{
+		"100%",
+		"<em>everything</em> &amp; more",
+		"more \nwith a softbreak",
+		"<blockquote>",
+		`<img src="https://example.com/gopher.png" alt="Gopher"`,
+		"<pre><code",
+		"if a &lt; b {}",
+	}
+	for _, eachFragment := range expectedFragments {
+		if !strings.Contains(notes.Description, eachFragment) {
+			t.Errorf("Expected %q in description:\n%s", eachFragment, notes.Description)
+		}
+	}
+	if strings.Contains(notes.Description, "<script>") ||
+		strings.Contains(notes.Description, "<p>with") {
+		t.Errorf("Unexpected markup in description:\n%s", notes.Description)
+	}
+	if notes.Source != "Some **bold** text" {
+		t.Errorf("Unexpected Markdown source: %q", notes.Source)
+	}
+}
@@ -0,0 +1,163 @@
+package markson
+
+import (
+	"fmt"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Source positions
+////////////////////////////////////////////////////////////////////////////////
+
+// blackfriday doesn't record source positions on nodes, so the sourceLocator
+// recovers them by scanning forward through the raw lines in the same order
+// the parse tree is walked.
+type sourceLocator struct {
+	lines    []string
+	inFence  []bool
+	cursor   int
+	headings []int
+}
+
+func newSourceLocator(data []byte) *sourceLocator {
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	inFence := make([]bool, len(lines))
+	fenceMarker := ""
+	for i, eachLine := range lines {
+		trimmed := strings.TrimSpace(eachLine)
+		if fenceMarker != "" {
+			inFence[i] = true
+			if strings.HasPrefix(trimmed, fenceMarker) {
+				fenceMarker = ""
+			}
+			continue
+		}
+		for _, eachMarker := range []string{"```", "~~~"} {
+			if strings.HasPrefix(trimmed, eachMarker) {
+				fenceMarker = eachMarker
+				inFence[i] = true
+			}
+		}
+	}
+	return &sourceLocator{
+		lines:   lines,
+		inFence: inFence,
+	}
+}
+
+// locate returns the 1-based number of the next line at or after the cursor
+// that satisfies predicate and advances the cursor past it. It returns 0 if
+// there is no such line.
+func (sl *sourceLocator) locate(predicate func(lineIndex int) bool) int {
+	for i := sl.cursor; i < len(sl.lines); i++ {
+		if !sl.inFence[i] && predicate(i) {
+			sl.cursor = i + 1
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// headingLine returns the line of the next heading at the given level
+// whose text includes headingText
+func (sl *sourceLocator) headingLine(level int, headingText string) int {
+	canonicalText := strings.ToLower(strings.TrimSpace(headingText))
+	line := sl.locate(func(lineIndex int) bool {
+		line := strings.TrimSpace(sl.lines[lineIndex])
+		if !strings.Contains(strings.ToLower(line), canonicalText) {
+			return false
+		}
+		// ATX style
+		atxPrefix := strings.Repeat("#", level)
+		if strings.HasPrefix(line, atxPrefix) &&
+			!strings.HasPrefix(line, atxPrefix+"#") {
+			return true
+		}
+		// Setext style
+		if level <= 2 && lineIndex+1 < len(sl.lines) {
+			underline := strings.TrimSpace(sl.lines[lineIndex+1])
+			underlineChar := "="
+			if level == 2 {
+				underlineChar = "-"
+			}
+			return underline != "" &&
+				strings.Trim(underline, underlineChar) == ""
+		}
+		return false
+	})
+	if line != 0 {
+		sl.headings = append(sl.headings, line)
+	}
+	return line
+}
+
+// sectionSource returns the raw Markdown between the heading at
+// headingLine and the next located heading. It returns the empty string
+// if headingLine isn't a located heading.
+func (sl *sourceLocator) sectionSource(headingLine int) string {
+	if headingLine <= 0 {
+		return ""
+	}
+	endLine := len(sl.lines) + 1
+	isHeading := false
+	for _, eachLine := range sl.headings {
+		if eachLine == headingLine {
+			isHeading = true
+		} else if eachLine > headingLine && eachLine < endLine {
+			endLine = eachLine
+		}
+	}
+	if !isHeading {
+		return ""
+	}
+	// Skip the setext underline, if any
+	startIndex := headingLine
+	if startIndex < len(sl.lines) && !strings.HasPrefix(strings.TrimSpace(sl.lines[headingLine-1]), "#") {
+		startIndex++
+	}
+	if startIndex >= endLine-1 {
+		return ""
+	}
+	return strings.Trim(strings.Join(sl.lines[startIndex:endLine-1], "\n"), "\n")
+}
+
+// tableRowLine returns the line of the next table row that includes
+// cellText
+func (sl *sourceLocator) tableRowLine(cellText string) int {
+	canonicalText := strings.ToLower(strings.TrimSpace(cellText))
+	return sl.locate(func(lineIndex int) bool {
+		line := strings.ToLower(sl.lines[lineIndex])
+		return strings.Contains(line, "|") &&
+			strings.Contains(line, canonicalText)
+	})
+}
+
+// PropertyError is a decode or validation error for a single property,
+// annotated with the source position of its definition
+type PropertyError struct {
+	Source string
+	Line   int
+	Key    string
+	Err    error
+}
+
+func (pe *PropertyError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", formatPosition(pe.Source, pe.Line), pe.Key, pe.Err)
+}
+
+// Cause returns the underlying error
+func (pe *PropertyError) Cause() error {
+	return pe.Err
+}
+
+// formatPosition returns the "source:line" position prefix used
+// in error messages
+func formatPosition(source string, line int) string {
+	if source == "" {
+		source = "<input>"
+	}
+	if line <= 0 {
+		return source
+	}
+	return fmt.Sprintf("%s:%d", source, line)
+}
@@ -0,0 +1,103 @@
+package markson
+
+import (
+	"strings"
+
+	"gopkg.in/russross/blackfriday.v2"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// Multi-column tables as records
+////////////////////////////////////////////////////////////////////////////////
+
+// minRecordColumns is the minimum number of columns for a table in a content
+// section to be decoded as records. Two column tables remain part of the
+// section text, as they're indistinguishable from Key-Value tables.
+const minRecordColumns = 3
+
+// nodeText returns the concatenated text content of node
+func nodeText(node *blackfriday.Node) string {
+	var text strings.Builder
+	node.Walk(func(childNode *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		if entering {
+			switch childNode.Type {
+			case blackfriday.Text, blackfriday.Code, blackfriday.HTMLSpan:
+				text.Write(childNode.Literal)
+			}
+		}
+		return blackfriday.GoToNext
+	})
+	return strings.TrimSpace(text.String())
+}
+
+// tableChild returns the first direct child of tableNode with the given type
+func tableChild(tableNode *blackfriday.Node, nodeType blackfriday.NodeType) *blackfriday.Node {
+	for childNode := tableNode.FirstChild; childNode != nil; childNode = childNode.Next {
+		if childNode.Type == nodeType {
+			return childNode
+		}
+	}
+	return nil
+}
+
+// rowCells returns the text of each cell in a TableRow node
+func rowCells(rowNode *blackfriday.Node) []string {
+	cells := []string{}
+	for cellNode := rowNode.FirstChild; cellNode != nil; cellNode = cellNode.Next {
+		if cellNode.Type == blackfriday.TableCell {
+			cells = append(cells, nodeText(cellNode))
+		}
+	}
+	return cells
+}
+
+// tableColumns returns the header names of a Table node
+func tableColumns(tableNode *blackfriday.Node) []string {
+	headNode := tableChild(tableNode, blackfriday.TableHead)
+	if headNode == nil || headNode.FirstChild == nil {
+		return nil
+	}
+	return rowCells(headNode.FirstChild)
+}
+
+// tableRecords returns one KeyValuePair per body row of tableNode. Each
+// pair's Record holds the row cells keyed by the column header.
+func tableRecords(key string,
+	tableNode *blackfriday.Node,
+	columns []string,
+	locator *sourceLocator) KeyValuePairs {
+
+	records := KeyValuePairs{}
+	bodyNode := tableChild(tableNode, blackfriday.TableBody)
+	if bodyNode == nil {
+		return records
+	}
+	for rowNode := bodyNode.FirstChild; rowNode != nil; rowNode = rowNode.Next {
+		cells := rowCells(rowNode)
+		record := KeyValuePair{
+			Key:    key,
+			Record: KeyValuePairs{},
+		}
+		for i, eachCell := range cells {
+			if i >= len(columns) {
+				break
+			}
+			// Empty cells leave the field at its zero value
+			if eachCell == "" {
+				continue
+			}
+			if record.Line == 0 {
+				record.Line = locator.tableRowLine(eachCell)
+			}
+			record.Record = append(record.Record, KeyValuePair{
+				Key:   columns[i],
+				Value: eachCell,
+			})
+		}
+		for i := range record.Record {
+			record.Record[i].Line = record.Line
+		}
+		records = append(records, record)
+	}
+	return records
+}
@@ -0,0 +1,114 @@
+package markson
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// UnknownProperty is a property that does not map to any field of the
+// target struct
+type UnknownProperty struct {
+	Key  string
+	Line int
+	// Suggestion is the closest known key, or the empty string if nothing
+	// is similar enough to be a likely misspelling
+	Suggestion string
+}
+
+// UnknownPropertiesError is returned in strict mode and lists every
+// property that could not be decoded
+type UnknownPropertiesError struct {
+	Source     string
+	Properties []UnknownProperty
+}
+
+func (upe *UnknownPropertiesError) Error() string {
+	messages := make([]string, 0, len(upe.Properties))
+	for _, eachProperty := range upe.Properties {
+		message := fmt.Sprintf("%s: %s: unknown property",
+			formatPosition(upe.Source, eachProperty.Line),
+			eachProperty.Key)
+		if eachProperty.Suggestion != "" {
+			message = fmt.Sprintf("%s (did you mean %q?)", message, eachProperty.Suggestion)
+		}
+		messages = append(messages, message)
+	}
+	return strings.Join(messages, "\n")
+}
+
+func newUnknownPropertiesError(unknownPairs KeyValuePairs,
+	fields map[string]*fieldInfo,
+	source string) *UnknownPropertiesError {
+
+	// Stable ordering for the candidate list s.t. ties resolve the
+	// same way on every run
+	candidates := make([]*fieldInfo, 0, len(fields))
+	for _, eachField := range fields {
+		candidates = append(candidates, eachField)
+	}
+	sort.Slice(candidates, func(lhs int, rhs int) bool {
+		return candidates[lhs].key < candidates[rhs].key
+	})
+
+	upe := &UnknownPropertiesError{
+		Source: source,
+	}
+	for _, eachPair := range unknownPairs {
+		upe.Properties = append(upe.Properties, UnknownProperty{
+			Key:        eachPair.Key,
+			Line:       eachPair.Line,
+			Suggestion: closestFieldName(canonicalKey(eachPair.Key), candidates),
+		})
+	}
+	return upe
+}
+
+// closestFieldName returns the name of the candidate with the smallest edit
+// distance to key, provided the distance is small relative to the key length
+func closestFieldName(key string, candidates []*fieldInfo) string {
+	maxDistance := len(key) / 3
+	if maxDistance < 2 {
+		maxDistance = 2
+	}
+	bestName := ""
+	bestDistance := maxDistance + 1
+	for _, eachCandidate := range candidates {
+		distance := levenshtein(key, eachCandidate.key)
+		if distance < bestDistance {
+			bestName = eachCandidate.name
+			bestDistance = distance
+		}
+	}
+	return bestName
+}
+
+// levenshtein returns the edit distance between lhs and rhs
+func levenshtein(lhs string, rhs string) int {
+	lhsRunes := []rune(lhs)
+	rhsRunes := []rune(rhs)
+	prevRow := make([]int, len(rhsRunes)+1)
+	curRow := make([]int, len(rhsRunes)+1)
+	for j := range prevRow {
+		prevRow[j] = j
+	}
+	for i := 1; i <= len(lhsRunes); i++ {
+		curRow[0] = i
+		for j := 1; j <= len(rhsRunes); j++ {
+			cost := 1
+			if lhsRunes[i-1] == rhsRunes[j-1] {
+				cost = 0
+			}
+			curRow[j] = minInt(minInt(prevRow[j]+1, curRow[j-1]+1), prevRow[j-1]+cost)
+		}
+		prevRow, curRow = curRow, prevRow
+	}
+	return prevRow[len(rhsRunes)]
+}
+
+func minInt(lhs int, rhs int) int {
+	if lhs < rhs {
+		return lhs
+	}
+	return rhs
+}